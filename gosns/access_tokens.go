@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// パーソナルアクセストークンの接頭辞（JWTと区別するため）
+const accessTokenPrefix = "gosns_pat_"
+
+// APIスコープ
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeFollow = "follow"
+	scopeAdmin  = "admin"
+)
+
+var allScopes = []string{scopeRead, scopeWrite, scopeFollow, scopeAdmin}
+
+// 有効期限の選択肢（日数、0 は無期限）
+var accessTokenExpiryDays = []int{30, 90, 365, 0}
+
+var errInvalidAccessToken = errors.New("invalid access token")
+
+// 入力されたスコープのうち有効なものだけを返す
+func normalizeScopes(scopes []string) []string {
+	var valid []string
+	for _, s := range allScopes {
+		for _, requested := range scopes {
+			if requested == s {
+				valid = append(valid, s)
+				break
+			}
+		}
+	}
+	return valid
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// トークン作成（平文のトークンは作成時のみ返す）
+func (app *App) createAccessToken(userID int, name string, scopes []string, expiresIn time.Duration) (string, error) {
+	token := accessTokenPrefix + randomToken(32)
+
+	var expiresAt interface{}
+	if expiresIn > 0 {
+		expiresAt = sqlTime(time.Now().Add(expiresIn))
+	}
+
+	_, err := app.db.Exec("INSERT INTO access_tokens (user_id, name, token_hash, scopes, expires_at) VALUES (?, ?, ?, ?, ?)",
+		userID, name, hashToken(token), strings.Join(scopes, " "), expiresAt)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// トークンの検証と最終使用日時の更新
+func (app *App) authenticateAccessToken(token string) (*Claims, error) {
+	var id, userID int
+	var username, scopes string
+	err := app.db.QueryRow(`SELECT t.id, t.user_id, u.username, t.scopes
+		FROM access_tokens t
+		JOIN users u ON t.user_id = u.id
+		WHERE t.token_hash = ? AND (t.expires_at IS NULL OR t.expires_at > ?)`,
+		hashToken(token), sqlTime(time.Now())).Scan(&id, &userID, &username, &scopes)
+	if err != nil {
+		return nil, errInvalidAccessToken
+	}
+
+	app.db.Exec("UPDATE access_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)",
+		id, sqlTime(time.Now().Add(-lastSeenResolution)))
+
+	return &Claims{UserID: userID, Username: username, Scopes: strings.Fields(scopes)}, nil
+}
+
+// ユーザーのトークン一覧
+func (app *App) getAccessTokens(userID int) []AccessToken {
+	rows, err := app.db.Query(`SELECT id, user_id, name, scopes, expires_at, last_used_at, created_at
+		FROM access_tokens WHERE user_id = ? ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return []AccessToken{}
+	}
+	defer rows.Close()
+
+	var tokens []AccessToken
+	for rows.Next() {
+		var t AccessToken
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &expiresAt, &lastUsedAt, &t.CreatedAt); err != nil {
+			continue
+		}
+		t.Scopes = strings.Fields(scopes)
+		if expiresAt.Valid {
+			t.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			t.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+// スコープの確認（Cookieによるログインは全スコープを持つ）
+func (app *App) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scopes, limited := r.Context().Value("scopes").([]string)
+		if !limited || hasScope(scopes, scope) {
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Token is missing required scope: " + scope,
+		})
+	}
+}
+
+// アクセストークン管理ページ
+func (app *App) accessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	app.renderAccessTokens(w, r, userID, "", "")
+}
+
+func (app *App) renderAccessTokens(w http.ResponseWriter, r *http.Request, userID int, newToken, errMsg string) {
+	app.renderTemplate(w, r, "tokens", PageData{
+		Title:           "アクセストークン",
+		IsAuthenticated: true,
+		CurrentUserID:   userID,
+		AccessTokens:    app.getAccessTokens(userID),
+		Scopes:          allScopes,
+		ExpiryDays:      accessTokenExpiryDays,
+		Token:           newToken,
+		Error:           errMsg,
+	})
+}
+
+// アクセストークン作成
+func (app *App) createAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	r.ParseForm()
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		app.renderAccessTokens(w, r, userID, "", "トークンの名前を入力してください")
+		return
+	}
+
+	scopes := normalizeScopes(r.Form["scopes"])
+	if len(scopes) == 0 {
+		app.renderAccessTokens(w, r, userID, "", "スコープを1つ以上選択してください")
+		return
+	}
+
+	days, err := strconv.Atoi(r.FormValue("expires_in"))
+	if err != nil || days < 0 {
+		app.renderAccessTokens(w, r, userID, "", "有効期限が正しくありません")
+		return
+	}
+
+	token, err := app.createAccessToken(userID, name, scopes, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		log.Println("アクセストークン作成エラー:", err)
+		app.renderAccessTokens(w, r, userID, "", "トークンの作成に失敗しました")
+		return
+	}
+
+	// 平文のトークンはこの画面でのみ表示する
+	app.renderAccessTokens(w, r, userID, token, "")
+}
+
+// アクセストークン削除
+func (app *App) deleteAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err == nil {
+		app.db.Exec("DELETE FROM access_tokens WHERE id = ? AND user_id = ?", id, userID)
+	}
+	http.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+}
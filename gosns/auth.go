@@ -2,44 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
+// 起動時に設定から読み込む
 var (
-	jwtSecret = []byte("your-secret-key-change-this")
-	googleOAuth = &oauth2.Config{
-		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		RedirectURL:  "http://podd.win:9090/auth/google/callback",
-		Scopes:       []string{"email", "profile"},
-		Endpoint:     google.Endpoint,
-	}
+	jwtSecret []byte
+	baseURL   string
 )
 
 type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	SessionID string   `json:"sid"`
+	Scopes    []string `json:"-"`
 	jwt.RegisteredClaims
 }
 
-type GoogleUser struct {
-	ID      string `json:"id"`
-	Email   string `json:"email"`
-	Name    string `json:"name"`
-	Picture string `json:"picture"`
-}
-
 func hashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
 	return string(bytes), err
@@ -50,12 +41,48 @@ func checkPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func generateJWT(userID int, username string) (string, error) {
+// ランダムトークン生成（URLセーフ）
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DB保存用のトークンハッシュ
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ペイロードにHMAC署名を付与
+func signToken(payload string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 署名を検証してペイロードを返す
+func verifySignedToken(token string) (string, bool) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", false
+	}
+	payload := token[:i]
+	if !hmac.Equal([]byte(signToken(payload)), []byte(token)) {
+		return "", false
+	}
+	return payload, true
+}
+
+func generateJWT(userID int, username string, sessionID string) (string, error) {
 	claims := Claims{
-		UserID:   userID,
-		Username: username,
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "gosns",
 		},
@@ -81,30 +108,21 @@ func validateJWT(tokenString string) (*Claims, error) {
 	return nil, fmt.Errorf("invalid token")
 }
 
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+func (app *App) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenString := ""
-		
-		// Cookie から取得
-		if cookie, err := r.Cookie("token"); err == nil {
-			tokenString = cookie.Value
-		}
-		
-		// Authorization ヘッダーから取得
-		if tokenString == "" {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
-				tokenString = strings.TrimPrefix(authHeader, "Bearer ")
-			}
-		}
-
-		if tokenString == "" {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		claims, err := validateJWT(tokenString)
+		claims, err := app.authenticate(w, r)
 		if err != nil {
+			// トークンを送ってきたAPIクライアントにはリダイレクトではなく401を返す
+			if strings.HasPrefix(r.URL.Path, "/api/") && r.Header.Get("Authorization") != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(APIResponse{
+					Success: false,
+					Message: "Invalid or expired token",
+				})
+				return
+			}
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
@@ -112,91 +130,11 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// ユーザー情報をcontextに追加
 		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
 		ctx = context.WithValue(ctx, "username", claims.Username)
-		
-		next(w, r.WithContext(ctx))
-	}
-}
-
-func (app *App) googleOAuthHandler(w http.ResponseWriter, r *http.Request) {
-	state := uuid.New().String()
-	http.SetCookie(w, &http.Cookie{
-		Name:     "oauth_state",
-		Value:    state,
-		HttpOnly: true,
-		Secure:   false,
-		MaxAge:   600,
-	})
-	
-	url := googleOAuth.AuthCodeURL(state, oauth2.AccessTypeOffline)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
-}
-
-func (app *App) googleCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	stateCookie, err := r.Cookie("oauth_state")
-	if err != nil || stateCookie.Value != r.URL.Query().Get("state") {
-		http.Error(w, "Invalid state", http.StatusBadRequest)
-		return
-	}
-
-	code := r.URL.Query().Get("code")
-	token, err := googleOAuth.Exchange(context.Background(), code)
-	if err != nil {
-		http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
-		return
-	}
-
-	client := googleOAuth.Client(context.Background(), token)
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
-	if err != nil {
-		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	var googleUser GoogleUser
-	if err := json.NewDecoder(resp.Body).Decode(&googleUser); err != nil {
-		http.Error(w, "Failed to decode user info", http.StatusInternalServerError)
-		return
-	}
-
-	// ユーザーを作成または取得
-	var user User
-	err = app.db.QueryRow("SELECT id, username, email, avatar, bio, verified FROM users WHERE google_id = ? OR email = ?", 
-		googleUser.ID, googleUser.Email).Scan(&user.ID, &user.Username, &user.Email, &user.Avatar, &user.Bio, &user.Verified)
-	
-	if err != nil {
-		// 新規ユーザー作成
-		username := strings.Split(googleUser.Email, "@")[0]
-		_, err = app.db.Exec("INSERT INTO users (username, email, avatar, google_id, verified) VALUES (?, ?, ?, ?, ?)",
-			username, googleUser.Email, googleUser.Picture, googleUser.ID, true)
-		if err != nil {
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
-			return
+		ctx = context.WithValue(ctx, "session_id", claims.SessionID)
+		if claims.Scopes != nil {
+			ctx = context.WithValue(ctx, "scopes", claims.Scopes)
 		}
 		
-		err = app.db.QueryRow("SELECT id, username FROM users WHERE google_id = ?", googleUser.ID).Scan(&user.ID, &user.Username)
-		if err != nil {
-			http.Error(w, "Failed to get user", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// JWT生成
-	jwtToken, err := generateJWT(user.ID, user.Username)
-	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		return
+		next(w, r.WithContext(ctx))
 	}
-
-	// Cookieに保存
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    jwtToken,
-		HttpOnly: true,
-		Secure:   false,
-		MaxAge:   86400,
-		Path:     "/",
-	})
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
\ No newline at end of file
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// BlurHash（https://blurha.sh）による画像読み込み前のプレースホルダー
+const (
+	blurhashComponentsX = 4
+	blurhashComponentsY = 3
+	blurhashChars       = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// 縮小済みの画像からBlurHashを計算する（大きな画像は計算量が多いため事前に縮小すること）
+func encodeBlurhash(img *image.RGBA) string {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+
+	factors := make([][3]float64, 0, blurhashComponentsX*blurhashComponentsY)
+	for cy := 0; cy < blurhashComponentsY; cy++ {
+		for cx := 0; cx < blurhashComponentsX; cx++ {
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(cx)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(cy)*float64(y)/float64(h))
+					i := img.PixOffset(x, y)
+					f[0] += basis * srgbToLinear(img.Pix[i])
+					f[1] += basis * srgbToLinear(img.Pix[i+1])
+					f[2] += basis * srgbToLinear(img.Pix[i+2])
+				}
+			}
+			scale := 2.0
+			if cx == 0 && cy == 0 {
+				scale = 1
+			}
+			scale /= float64(w * h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(encodeBase83((blurhashComponentsX-1)+(blurhashComponentsY-1)*9, 1))
+
+	maxValue := 1.0
+	ac := factors[1:]
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantised+1) / 166
+		b.WriteString(encodeBase83(quantised, 1))
+	} else {
+		b.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	b.WriteString(encodeBase83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		b.WriteString(encodeBase83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+	return b.String()
+}
+
+func encodeBase83(value, length int) string {
+	out := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		out[i-1] = blurhashChars[digit]
+	}
+	return string(out)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// WebAuthn の attestationObject / COSE鍵 を読むための最小限のCBORデコーダ
+// 対応: 整数, バイト列, 文字列, 配列, マップ, true/false/null
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+const cborMaxDepth = 16
+
+// 先頭の1要素をデコードし、残りのバイト列を返す
+func cborDecode(b []byte) (interface{}, []byte, error) {
+	return cborDecodeItem(b, 0)
+}
+
+func cborDecodeItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: nesting too deep")
+	}
+	if len(b) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+
+	major := b[0] >> 5
+	info := b[0] & 0x1f
+	b = b[1:]
+
+	// 単純値
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		default:
+			return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+
+	n, b, err := cborReadLength(info, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return int64(n), b, nil
+	case 1:
+		if n > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(n), b, nil
+	case 2, 3:
+		if uint64(len(b)) < n {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 2 {
+			return append([]byte(nil), b[:n]...), b[n:], nil
+		}
+		return string(b[:n]), b[n:], nil
+	case 4:
+		if n > uint64(len(b)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			item, b, err = cborDecodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, b, nil
+	case 5:
+		if n > uint64(len(b)) {
+			return nil, nil, errCBORTruncated
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var key, value interface{}
+			key, b, err = cborDecodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: unsupported map key type")
+			}
+			value, b, err = cborDecodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, b, nil
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+	}
+}
+
+// 追加情報から長さ（または整数値）を読む
+func cborReadLength(info byte, b []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24:
+		if len(b) < 1 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(b[0]), b[1:], nil
+	case info == 25:
+		if len(b) < 2 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26:
+		if len(b) < 4 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27:
+		if len(b) < 8 {
+			return 0, nil, errCBORTruncated
+		}
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	default:
+		return 0, nil, fmt.Errorf("cbor: unsupported length encoding %d", info)
+	}
+}
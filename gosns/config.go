@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	envDevelopment = "development"
+	envProduction  = "production"
+	minSecretLen   = 32
+	storageLocal   = "local"
+	storageS3      = "s3"
+)
+
+// 以前ソースに埋め込まれていた値など、本番環境で使ってはいけない秘密鍵
+var insecureSecrets = []string{
+	"your-secret-key-change-this",
+	"your-session-secret-change-this",
+	"changeme",
+	"secret",
+}
+
+// OIDCプロバイダー名（コールバックURLと「.」区切りの state Cookie に使う）
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// アプリケーション設定
+type Config struct {
+	Env           string
+	ListenAddr    string
+	BaseURL       string
+	DatabasePath  string
+	UploadDir     string
+	Storage       StorageConfig
+	Video         VideoConfig
+	JWTSecret     string
+	SessionSecret string
+	SecretsFile   string
+	SMTP          SMTPConfig
+	Google        OIDCProviderConfig
+	OIDC          map[string]OIDCProviderConfig
+}
+
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// メディアの保存先
+type StorageConfig struct {
+	Backend string
+	Private string
+	S3      S3Config
+}
+
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PublicURL string
+	PathStyle string
+}
+
+func (c StorageConfig) private() bool {
+	v, _ := strconv.ParseBool(c.Private)
+	return v
+}
+
+func (c S3Config) pathStyle() bool {
+	v, _ := strconv.ParseBool(c.PathStyle)
+	return v
+}
+
+// 動画変換に使う外部コマンド（空の場合は動画投稿を無効化）
+type VideoConfig struct {
+	FFmpeg  string
+	FFprobe string
+}
+
+type OIDCProviderConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	DisplayName  string
+}
+
+// 設定項目（ファイルのキー・環境変数・フラグの対応）
+type setting struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	target *string
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"env", "GOSNS_ENV", "env", "実行環境 (development / production)", &c.Env},
+		{"server.listen", "GOSNS_LISTEN", "listen", "待ち受けアドレス", &c.ListenAddr},
+		{"server.base_url", "GOSNS_BASE_URL", "base-url", "公開URL（メール内リンク・OAuthコールバックに使用）", &c.BaseURL},
+		{"database.path", "GOSNS_DATABASE", "db", "SQLiteデータベースファイル", &c.DatabasePath},
+		{"storage.upload_dir", "GOSNS_UPLOAD_DIR", "upload-dir", "アップロードファイルの保存先", &c.UploadDir},
+		{"storage.backend", "GOSNS_STORAGE", "storage", "メディアの保存先 (local / s3)", &c.Storage.Backend},
+		{"storage.private", "GOSNS_STORAGE_PRIVATE", "", "", &c.Storage.Private},
+		{"s3.endpoint", "S3_ENDPOINT", "", "", &c.Storage.S3.Endpoint},
+		{"s3.region", "S3_REGION", "", "", &c.Storage.S3.Region},
+		{"s3.bucket", "S3_BUCKET", "", "", &c.Storage.S3.Bucket},
+		{"s3.access_key", "S3_ACCESS_KEY", "", "", &c.Storage.S3.AccessKey},
+		{"s3.secret_key", "S3_SECRET_KEY", "", "", &c.Storage.S3.SecretKey},
+		{"s3.public_url", "S3_PUBLIC_URL", "", "", &c.Storage.S3.PublicURL},
+		{"s3.path_style", "S3_PATH_STYLE", "", "", &c.Storage.S3.PathStyle},
+		{"video.ffmpeg", "GOSNS_FFMPEG", "ffmpeg", "動画変換に使うffmpegのパス（空にすると動画投稿を無効化）", &c.Video.FFmpeg},
+		{"video.ffprobe", "GOSNS_FFPROBE", "", "", &c.Video.FFprobe},
+		{"security.jwt_secret", "GOSNS_JWT_SECRET", "", "", &c.JWTSecret},
+		{"security.session_secret", "GOSNS_SESSION_SECRET", "", "", &c.SessionSecret},
+		{"security.secrets_file", "GOSNS_SECRETS_FILE", "secrets-file", "自動生成した秘密鍵の保存先", &c.SecretsFile},
+		{"smtp.host", "SMTP_HOST", "", "", &c.SMTP.Host},
+		{"smtp.port", "SMTP_PORT", "", "", &c.SMTP.Port},
+		{"smtp.username", "SMTP_USERNAME", "", "", &c.SMTP.Username},
+		{"smtp.password", "SMTP_PASSWORD", "", "", &c.SMTP.Password},
+		{"smtp.from", "SMTP_FROM", "", "", &c.SMTP.From},
+		{"google.client_id", "GOOGLE_CLIENT_ID", "", "", &c.Google.ClientID},
+		{"google.client_secret", "GOOGLE_CLIENT_SECRET", "", "", &c.Google.ClientSecret},
+	}
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Env:          envDevelopment,
+		ListenAddr:   ":9090",
+		BaseURL:      "http://podd.win:9090",
+		DatabasePath: "./gosns.db",
+		UploadDir:    "uploads",
+		Storage: StorageConfig{
+			Backend: storageLocal,
+			Private: "false",
+			S3:      S3Config{Region: "us-east-1", PathStyle: "true"},
+		},
+		Video:       VideoConfig{FFmpeg: "ffmpeg", FFprobe: "ffprobe"},
+		SecretsFile: "./gosns.secrets",
+		SMTP:        SMTPConfig{Port: "587"},
+		OIDC:        make(map[string]OIDCProviderConfig),
+	}
+}
+
+// 設定読み込み（優先順位: フラグ > 環境変数 > 設定ファイル > デフォルト）
+func loadConfig(args []string) (*Config, error) {
+	cfg := defaultConfig()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet("gosns", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("GOSNS_CONFIG"), "設定ファイル (.toml / .yaml)")
+	flagValues := make(map[string]*string)
+	for _, s := range settings {
+		if s.flag != "" {
+			flagValues[s.flag] = fs.String(s.flag, *s.target, s.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		values, err := parseConfigFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range settings {
+			if v, ok := values[s.key]; ok {
+				*s.target = v
+			}
+		}
+		cfg.applyOIDCFile(values)
+	}
+
+	for _, s := range settings {
+		if v := os.Getenv(s.env); v != "" {
+			*s.target = v
+		}
+	}
+	cfg.applyOIDCEnv()
+
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := flagValues[f.Name]; ok {
+			for _, s := range settings {
+				if s.flag == f.Name {
+					*s.target = *v
+				}
+			}
+		}
+	})
+
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	if cfg.Google.ClientID != "" {
+		cfg.OIDC["google"] = OIDCProviderConfig{
+			Issuer:       "https://accounts.google.com",
+			ClientID:     cfg.Google.ClientID,
+			ClientSecret: cfg.Google.ClientSecret,
+			DisplayName:  "Google",
+		}
+	}
+
+	if err := cfg.ensureSecrets(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// 設定ファイルの oidc.<name>.<field> を読み込む
+func (c *Config) applyOIDCFile(values map[string]string) {
+	for key, v := range values {
+		parts := strings.Split(key, ".")
+		if len(parts) != 3 || parts[0] != "oidc" {
+			continue
+		}
+		p := c.OIDC[parts[1]]
+		p.set(parts[2], v)
+		c.OIDC[parts[1]] = p
+	}
+}
+
+// 環境変数 OIDC_PROVIDERS=keycloak,gitlab と OIDC_<NAME>_* を読み込む
+func (c *Config) applyOIDCEnv() {
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		p := c.OIDC[name]
+		for _, field := range []string{"issuer", "client_id", "client_secret", "display_name"} {
+			if v := os.Getenv(prefix + strings.ToUpper(field)); v != "" {
+				p.set(field, v)
+			}
+		}
+		c.OIDC[name] = p
+	}
+}
+
+func (p *OIDCProviderConfig) set(field, value string) {
+	switch field {
+	case "issuer":
+		p.Issuer = value
+	case "client_id":
+		p.ClientID = value
+	case "client_secret":
+		p.ClientSecret = value
+	case "display_name":
+		p.DisplayName = value
+	}
+}
+
+func (c *Config) isProduction() bool {
+	return c.Env == envProduction
+}
+
+// 秘密鍵が未設定の場合は保存済みのものを読み込み、なければ生成して保存
+func (c *Config) ensureSecrets() error {
+	if c.JWTSecret != "" && c.SessionSecret != "" {
+		return nil
+	}
+
+	stored := make(map[string]string)
+	if _, err := os.Stat(c.SecretsFile); err == nil {
+		values, err := parseConfigFile(c.SecretsFile)
+		if err != nil {
+			return err
+		}
+		stored = values
+	}
+
+	generated := false
+	for _, s := range []struct {
+		key    string
+		target *string
+	}{
+		{"jwt_secret", &c.JWTSecret},
+		{"session_secret", &c.SessionSecret},
+	} {
+		if *s.target != "" {
+			continue
+		}
+		if stored[s.key] == "" {
+			stored[s.key] = randomToken(48)
+			generated = true
+		}
+		*s.target = stored[s.key]
+	}
+
+	if generated {
+		if err := writeSecretsFile(c.SecretsFile, stored); err != nil {
+			return fmt.Errorf("秘密鍵の保存に失敗しました: %w", err)
+		}
+		log.Printf("秘密鍵を生成して %s に保存しました", c.SecretsFile)
+	}
+	return nil
+}
+
+func writeSecretsFile(path string, values map[string]string) error {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("# gosns が自動生成した秘密鍵です。共有・コミットしないでください。\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s = %s\n", k, strconv.Quote(values[k]))
+	}
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
+
+// 設定値の検証
+func (c *Config) validate() error {
+	var errs []error
+
+	if c.Env != envDevelopment && c.Env != envProduction {
+		errs = append(errs, fmt.Errorf("env は %s または %s を指定してください: %q", envDevelopment, envProduction, c.Env))
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listen の形式が正しくありません: %q", c.ListenAddr))
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("base_url の形式が正しくありません: %q", c.BaseURL))
+	} else if c.isProduction() && u.Scheme != "https" {
+		log.Println("警告: 本番環境の base_url が https ではありません")
+	}
+	if c.DatabasePath == "" {
+		errs = append(errs, errors.New("database.path を指定してください"))
+	}
+	if c.UploadDir == "" {
+		errs = append(errs, errors.New("storage.upload_dir を指定してください"))
+	}
+	if _, err := strconv.ParseBool(c.Storage.Private); err != nil {
+		errs = append(errs, fmt.Errorf("storage.private は true または false を指定してください: %q", c.Storage.Private))
+	}
+	switch c.Storage.Backend {
+	case storageLocal:
+	case storageS3:
+		s3 := c.Storage.S3
+		if u, err := url.Parse(s3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("s3.endpoint の形式が正しくありません: %q", s3.Endpoint))
+		}
+		if s3.Bucket == "" || s3.AccessKey == "" || s3.SecretKey == "" || s3.Region == "" {
+			errs = append(errs, errors.New("s3.bucket・s3.region・s3.access_key・s3.secret_key を指定してください"))
+		}
+		if _, err := strconv.ParseBool(s3.PathStyle); err != nil {
+			errs = append(errs, fmt.Errorf("s3.path_style は true または false を指定してください: %q", s3.PathStyle))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage.backend は %s または %s を指定してください: %q", storageLocal, storageS3, c.Storage.Backend))
+	}
+	if c.isProduction() && c.SMTP.Host == "" {
+		errs = append(errs, errors.New("本番環境では smtp.host を指定してください（確認メールやパスワード再設定メールを送信できません）"))
+	}
+	if port, err := strconv.Atoi(c.SMTP.Port); c.SMTP.Host != "" && (err != nil || port <= 0 || port > 65535) {
+		errs = append(errs, fmt.Errorf("smtp.port が正しくありません: %q", c.SMTP.Port))
+	}
+
+	for name, secret := range map[string]string{"jwt_secret": c.JWTSecret, "session_secret": c.SessionSecret} {
+		insecure := len(secret) < minSecretLen
+		for _, s := range insecureSecrets {
+			if secret == s {
+				insecure = true
+			}
+		}
+		if !insecure {
+			continue
+		}
+		if c.isProduction() {
+			errs = append(errs, fmt.Errorf("本番環境ではデフォルトまたは短すぎる %s は使用できません（%d文字以上の値を設定するか、未設定にして自動生成してください）", name, minSecretLen))
+		} else {
+			log.Printf("警告: %s が安全ではありません。本番環境では起動できません", name)
+		}
+	}
+
+	for name, p := range c.OIDC {
+		if !providerNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("OIDCプロバイダー名 %q には英小文字・数字・「_」「-」のみ使用できます", name))
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			errs = append(errs, fmt.Errorf("OIDCプロバイダー %s の issuer と client_id を指定してください", name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// 設定ファイルの読み込み（TOML / YAML のサブセット）
+// ネストしたキーは "server.listen" のようにドット区切りで返す
+func parseConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		values, err = parseYAML(lines)
+	default:
+		values, err = parseTOML(lines)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+func parseTOML(lines []string) (map[string]string, error) {
+	values := make(map[string]string)
+	section := ""
+	for i, line := range lines {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%d行目: セクションの形式が正しくありません", i+1)
+			}
+			section = strings.TrimSpace(line[1:len(line)-1]) + "."
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%d行目: key = value の形式で記述してください", i+1)
+		}
+		v, err := unquoteValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%d行目: %w", i+1, err)
+		}
+		values[section+strings.TrimSpace(key)] = v
+	}
+	return values, nil
+}
+
+func parseYAML(lines []string) (map[string]string, error) {
+	type level struct {
+		indent int
+		key    string
+	}
+	values := make(map[string]string)
+	var stack []level
+
+	for i, raw := range lines {
+		line := stripComment(raw)
+		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		line = strings.TrimSpace(line)
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%d行目: key: value の形式で記述してください", i+1)
+		}
+		key = strings.TrimSpace(key)
+
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		path := make([]string, 0, len(stack)+1)
+		for _, l := range stack {
+			path = append(path, l.key)
+		}
+		path = append(path, key)
+
+		value = strings.TrimSpace(value)
+		if value == "" {
+			stack = append(stack, level{indent, key})
+			continue
+		}
+		v, err := unquoteValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%d行目: %w", i+1, err)
+		}
+		values[strings.Join(path, ".")] = v
+	}
+	return values, nil
+}
+
+// 引用符の外にある # 以降をコメントとして除去
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return "", errors.New("引用符が閉じられていません")
+		}
+		return v[1 : len(v)-1], nil
+	}
+	return v, nil
+}
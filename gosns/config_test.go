@@ -0,0 +1,314 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 本番環境として起動できる設定
+func productionConfig() *Config {
+	c := defaultConfig()
+	c.Env = envProduction
+	c.BaseURL = "https://gosns.example"
+	c.JWTSecret = strings.Repeat("j", minSecretLen)
+	c.SessionSecret = strings.Repeat("s", minSecretLen)
+	c.SMTP.Host = "smtp.example.com"
+	c.SMTP.From = "noreply@gosns.example"
+	return c
+}
+
+func TestValidateRequiresSMTPInProduction(t *testing.T) {
+	if err := productionConfig().validate(); err != nil {
+		t.Fatalf("valid production config rejected: %v", err)
+	}
+
+	c := productionConfig()
+	c.SMTP.Host = ""
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "smtp.host") {
+		t.Fatalf("err = %v, want smtp.host error", err)
+	}
+
+	// 開発環境ではログ出力で代用できる
+	c.Env = envDevelopment
+	if err := c.validate(); err != nil {
+		t.Fatalf("development config rejected: %v", err)
+	}
+}
+
+func TestValidateOIDCProviderNames(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"keycloak": true,
+		"my-idp_2": true,
+		"my.idp":   false,
+		"KeyCloak": false,
+		"idp/../x": false,
+		"":         false,
+		"sso idp":  false,
+		"ｋｅｙｃｌｏａｋ": false,
+	} {
+		c := defaultConfig()
+		c.OIDC[name] = OIDCProviderConfig{Issuer: "https://sso.example.com", ClientID: "gosns"}
+		err := c.validate()
+		if valid && err != nil {
+			t.Errorf("%q rejected: %v", name, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]string
+	}{
+		{
+			name:  "top-level and sections",
+			input: "env = \"production\"\n\n[server]\nlisten = \":8080\"\n[smtp]\nport = 25",
+			want:  map[string]string{"env": "production", "server.listen": ":8080", "smtp.port": "25"},
+		},
+		{
+			name:  "nested section",
+			input: "[oidc.keycloak]\nissuer = \"https://sso.example.com/realms/main\"\nclient_id = 'gosns'",
+			want:  map[string]string{"oidc.keycloak.issuer": "https://sso.example.com/realms/main", "oidc.keycloak.client_id": "gosns"},
+		},
+		{
+			name:  "comments",
+			input: "# comment\n[security] # section comment\njwt_secret = \"abc#def\" # trailing\nsession_secret = 'x#y'\nsecrets_file = ./s # bare",
+			want:  map[string]string{"security.jwt_secret": "abc#def", "security.session_secret": "x#y", "security.secrets_file": "./s"},
+		},
+		{
+			name:  "escapes in basic strings",
+			input: `key = "say \"hi\" # not a comment\tend"` + "\n" + `literal = 'C:\path'`,
+			want:  map[string]string{"key": "say \"hi\" # not a comment\tend", "literal": `C:\path`},
+		},
+		{
+			name:  "spacing",
+			input: "  [ server ]  \n  listen=\":1\"  \n",
+			want:  map[string]string{"server.listen": ":1"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTOML(strings.Split(tc.input, "\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	for _, input := range []string{
+		"[server",
+		"listen",
+		`key = "unterminated`,
+		"key = 'unterminated",
+		`key = "a" b`,
+	} {
+		if _, err := parseTOML([]string{input}); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]string
+	}{
+		{
+			name:  "nesting",
+			input: "---\nenv: production\nserver:\n  listen: \":8080\"\n  base_url: https://gosns.example:8443\ndatabase:\n  path: ./db.sqlite",
+			want: map[string]string{
+				"env":             "production",
+				"server.listen":   ":8080",
+				"server.base_url": "https://gosns.example:8443",
+				"database.path":   "./db.sqlite",
+			},
+		},
+		{
+			name:  "deeper nesting and dedent",
+			input: "oidc:\n  keycloak:\n    issuer: https://sso.example.com\n    client_id: gosns\n  gitlab:\n    client_id: 'gl'\nsmtp:\n  port: 25",
+			want: map[string]string{
+				"oidc.keycloak.issuer":    "https://sso.example.com",
+				"oidc.keycloak.client_id": "gosns",
+				"oidc.gitlab.client_id":   "gl",
+				"smtp.port":               "25",
+			},
+		},
+		{
+			name:  "comments",
+			input: "# comment\nsecurity: # section\n  jwt_secret: \"abc#def\" # trailing\n\n  session_secret: 'x#y'",
+			want:  map[string]string{"security.jwt_secret": "abc#def", "security.session_secret": "x#y"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseYAML(strings.Split(tc.input, "\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, input := range []string{
+		"- item",
+		`key: "unterminated`,
+	} {
+		if _, err := parseYAML([]string{input}); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+// 設定ファイルを書き出し、秘密鍵の保存先を一時ディレクトリにする
+func writeConfigFile(t *testing.T, name, content string) (path, secrets string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	path = filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, filepath.Join(dir, "gosns.secrets")
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path, secrets := writeConfigFile(t, "gosns.toml", `
+[server]
+listen = ":1111"
+base_url = "http://file.example"
+[database]
+path = "file.db"
+[storage]
+upload_dir = "file-uploads"
+`)
+	t.Setenv("GOSNS_SECRETS_FILE", secrets)
+	t.Setenv("GOSNS_BASE_URL", "http://env.example/")
+	t.Setenv("GOSNS_DATABASE", "env.db")
+
+	cfg, err := loadConfig([]string{"-config", path, "-db", "flag.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, got, want string
+	}{
+		{"default", cfg.SMTP.Port, "587"},
+		{"file", cfg.ListenAddr, ":1111"},
+		{"file over default", cfg.UploadDir, "file-uploads"},
+		{"env over file", cfg.BaseURL, "http://env.example"},
+		{"flag over env", cfg.DatabasePath, "flag.db"},
+	}
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestLoadConfigYAMLAndOIDC(t *testing.T) {
+	path, secrets := writeConfigFile(t, "gosns.yaml", `
+oidc:
+  keycloak:
+    issuer: https://sso.example.com/realms/main
+    client_id: gosns
+`)
+	t.Setenv("GOSNS_SECRETS_FILE", secrets)
+	t.Setenv("OIDC_PROVIDERS", "gitlab")
+	t.Setenv("OIDC_GITLAB_ISSUER", "https://gitlab.example.com")
+	t.Setenv("OIDC_GITLAB_CLIENT_ID", "gl")
+
+	cfg, err := loadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]OIDCProviderConfig{
+		"keycloak": {Issuer: "https://sso.example.com/realms/main", ClientID: "gosns"},
+		"gitlab":   {Issuer: "https://gitlab.example.com", ClientID: "gl"},
+	}
+	if !reflect.DeepEqual(cfg.OIDC, want) {
+		t.Fatalf("OIDC = %+v, want %+v", cfg.OIDC, want)
+	}
+}
+
+func TestGeneratedSecretsArePersisted(t *testing.T) {
+	secrets := filepath.Join(t.TempDir(), "gosns.secrets")
+	t.Setenv("GOSNS_SECRETS_FILE", secrets)
+
+	first, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.JWTSecret) < minSecretLen || len(first.SessionSecret) < minSecretLen || first.JWTSecret == first.SessionSecret {
+		t.Fatalf("generated secrets %q %q", first.JWTSecret, first.SessionSecret)
+	}
+	info, err := os.Stat(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("secrets file mode = %o, want 600", perm)
+	}
+
+	// 再起動しても同じ秘密鍵を使う
+	second, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.JWTSecret != first.JWTSecret || second.SessionSecret != first.SessionSecret {
+		t.Fatal("secrets changed between loads")
+	}
+}
+
+func TestProductionRefusesInsecureSecrets(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{"known default", "your-secret-key-change-this"},
+		{"short", "short-secret"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := productionConfig()
+			c.JWTSecret = tc.secret
+			err := c.validate()
+			if err == nil || !strings.Contains(err.Error(), "jwt_secret") {
+				t.Fatalf("err = %v, want jwt_secret error", err)
+			}
+
+			// 開発環境では警告のみ
+			c.Env = envDevelopment
+			if err := c.validate(); err != nil {
+				t.Fatalf("development: %v", err)
+			}
+		})
+	}
+
+	// 環境変数で本番環境にしてもデフォルトの秘密鍵では起動しない
+	t.Setenv("GOSNS_SECRETS_FILE", filepath.Join(t.TempDir(), "gosns.secrets"))
+	t.Setenv("GOSNS_ENV", envProduction)
+	t.Setenv("GOSNS_BASE_URL", "https://gosns.example")
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("GOSNS_JWT_SECRET", "changeme")
+	if _, err := loadConfig(nil); err == nil {
+		t.Fatal("production started with a default secret")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"html/template"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ハッシュタグの最大文字数
+const maxHashtagLength = 50
+
+// 文字・数字・アンダースコアの直前に # があればハッシュタグとみなす
+// （URLの # や &#... の文字参照は除く）
+var hashtagPattern = regexp.MustCompile(`(^|[^\p{L}\p{N}_&/#])#([\p{L}\p{N}_]+)`)
+
+// @ の直後のユーザー名をメンションとみなす（メールアドレスは除く）
+var mentionPattern = regexp.MustCompile(`(^|[^\p{L}\p{N}_@.])@([\p{L}\p{N}_][\p{L}\p{N}_.\-]*)`)
+
+// タグを比較用の形に揃える
+func normalizeTag(tag string) string {
+	return strings.ToLower(tag)
+}
+
+// 数字だけのタグ（#1 など）や長すぎるタグは扱わない
+func validHashtag(tag string) bool {
+	if utf8.RuneCountInString(tag) > maxHashtagLength {
+		return false
+	}
+	for _, r := range tag {
+		if !unicode.IsNumber(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// 本文に含まれるハッシュタグ（正規化・重複除去済み）
+func extractHashtags(content string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, m := range hashtagPattern.FindAllStringSubmatch(content, -1) {
+		tag := normalizeTag(m[2])
+		if !validHashtag(tag) || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// 文末の「.」「-」はユーザー名に含めない
+func trimMention(name string) string {
+	return strings.TrimRight(name, ".-")
+}
+
+// 本文に含まれるメンションのユーザー名（重複除去済み）
+func extractMentions(content string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		name := trimMention(m[2])
+		key := strings.ToLower(name)
+		if name == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// 本文中のリンクにする範囲
+type contentLink struct {
+	start, end int
+	href       string
+	class      string
+}
+
+// 本文をエスケープし、ハッシュタグをタグページへ、メンションをプロフィールへのリンクにする
+// mentions は解決済みのユーザー名（存在しないユーザーへのメンションはリンクにしない）
+func renderContent(content string, mentions []string) template.HTML {
+	var links []contentLink
+	for _, m := range hashtagPattern.FindAllStringSubmatchIndex(content, -1) {
+		// m[4]:m[5] がタグ名、その直前の1文字が #
+		tag := content[m[4]:m[5]]
+		if !validHashtag(tag) {
+			continue
+		}
+		links = append(links, contentLink{m[4] - 1, m[5], "/tags/" + url.PathEscape(normalizeTag(tag)), "hashtag"})
+	}
+
+	resolved := make(map[string]string, len(mentions))
+	for _, name := range mentions {
+		resolved[strings.ToLower(name)] = name
+	}
+	for _, m := range mentionPattern.FindAllStringSubmatchIndex(content, -1) {
+		name := trimMention(content[m[4]:m[5]])
+		username, ok := resolved[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		links = append(links, contentLink{m[4] - 1, m[4] + len(name), "/profile/" + url.PathEscape(username), "mention"})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].start < links[j].start })
+
+	var b strings.Builder
+	last := 0
+	for _, l := range links {
+		if l.start < last {
+			continue
+		}
+		b.WriteString(template.HTMLEscapeString(content[last:l.start]))
+		b.WriteString(`<a href="` + template.HTMLEscapeString(l.href) + `" class="` + l.class + `">`)
+		b.WriteString(template.HTMLEscapeString(content[l.start:l.end]))
+		b.WriteString(`</a>`)
+		last = l.end
+	}
+	b.WriteString(template.HTMLEscapeString(content[last:]))
+	return template.HTML(b.String())
+}
+
+// テンプレートで本文を表示する
+func (p Post) ContentHTML() template.HTML {
+	return renderContent(p.Content, p.Mentions)
+}
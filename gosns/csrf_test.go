@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ブラウザが送るCookieとフォーム用トークン
+type csrfBrowser struct {
+	session *http.Cookie
+	csrf    *http.Cookie
+	token   string
+}
+
+func newCSRFBrowser(t *testing.T, app *App, userID int) *csrfBrowser {
+	secret := randomToken(32)
+	return &csrfBrowser{
+		session: loginCookie(t, app, userID),
+		csrf:    &http.Cookie{Name: csrfCookieName, Value: secret},
+		token:   csrfTokenFor(secret),
+	}
+}
+
+func (b *csrfBrowser) do(h http.Handler, method, target string, form url.Values, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	r.AddCookie(b.session)
+	r.AddCookie(b.csrf)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCSRFFormPost(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	h := app.routes()
+	b := newCSRFBrowser(t, app, alice)
+
+	if w := b.do(h, "POST", "/settings/notifications", url.Values{}, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("without token: status %d, want 403", w.Code)
+	}
+	if w := b.do(h, "POST", "/settings/notifications", url.Values{csrfFormField: {"forged"}}, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("wrong token: status %d, want 403", w.Code)
+	}
+	if w := b.do(h, "POST", "/settings/notifications", url.Values{csrfFormField: {b.token}}, nil); w.Code == http.StatusForbidden {
+		t.Fatal("form token rejected")
+	}
+	if w := b.do(h, "POST", "/settings/notifications", url.Values{}, map[string]string{csrfHeaderName: b.token}); w.Code == http.StatusForbidden {
+		t.Fatal("header token rejected")
+	}
+
+	// 別のブラウザのトークンは使えない
+	other := newCSRFBrowser(t, app, alice)
+	if w := b.do(h, "POST", "/settings/notifications", url.Values{csrfFormField: {other.token}}, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("token for another cookie: status %d, want 403", w.Code)
+	}
+}
+
+func TestCSRFAPIResponse(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	postID, err := app.createPost(alice, "投稿", postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := app.routes()
+	b := newCSRFBrowser(t, app, alice)
+	target := "/api/posts/" + strconv.Itoa(postID) + "/like"
+
+	w := b.do(h, "POST", target, url.Values{}, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("without token: status %d, want 403", w.Code)
+	}
+	var resp APIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Success {
+		t.Fatalf("response %q is not a JSON error", w.Body.String())
+	}
+
+	if w := b.do(h, "POST", target, url.Values{}, map[string]string{csrfHeaderName: b.token}); w.Code != http.StatusOK {
+		t.Fatalf("with header: status %d", w.Code)
+	}
+}
+
+func TestLogoutRequiresPostWithToken(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	h := app.routes()
+	b := newCSRFBrowser(t, app, alice)
+
+	if w := b.do(h, "GET", "/logout", nil, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /logout: status %d, want 405", w.Code)
+	}
+	if w := b.do(h, "POST", "/logout", url.Values{}, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("POST /logout without token: status %d, want 403", w.Code)
+	}
+	if len(app.getActiveSessions(alice, "")) != 1 {
+		t.Fatal("session ended without a valid logout")
+	}
+
+	if w := b.do(h, "POST", "/logout", url.Values{csrfFormField: {b.token}}, nil); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /logout: status %d, want 303", w.Code)
+	}
+	if n := len(app.getActiveSessions(alice, "")); n != 0 {
+		t.Fatalf("%d sessions still active after logout", n)
+	}
+}
+
+func TestCSRFExemptions(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	postID, err := app.createPost(alice, "投稿", postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pat, err := app.createAccessToken(alice, "test", []string{scopeWrite}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := app.routes()
+
+	post := func(target string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", target, strings.NewReader(""))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Authorizationヘッダーはブラウザが自動で付けないのでトークン不要
+	w := post("/api/posts/"+strconv.Itoa(postID)+"/like", map[string]string{"Authorization": "Bearer " + pat})
+	if w.Code != http.StatusOK {
+		t.Fatalf("bearer request: status %d %s", w.Code, w.Body.String())
+	}
+
+	// トークンエンドポイントはクライアント認証で保護する
+	if w := post("/oauth/token", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("/oauth/token: status %d, want 401 from client authentication", w.Code)
+	}
+
+	// 同意画面はCookieで認証するので対象外にしない
+	b := newCSRFBrowser(t, app, alice)
+	if w := b.do(h, "POST", "/oauth/authorize", url.Values{"action": {"approve"}}, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("/oauth/authorize without token: status %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const loginHistoryLimit = 50
+
+// ログイン方法（外部ログインはプロバイダー名を記録）
+const (
+	loginMethodPassword = "password"
+	loginMethodPasskey  = "passkey"
+	loginMethodTOTP     = "totp"
+)
+
+// ログイン履歴の記録（userID が 0 の場合は該当ユーザーなし）
+func (app *App) recordLogin(r *http.Request, userID int, email, method string, success bool) {
+	var uid sql.NullInt64
+	if userID > 0 {
+		uid = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	app.db.Exec("INSERT INTO login_events (user_id, email, method, success, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?)",
+		uid, email, method, success, clientIP(r), r.UserAgent())
+}
+
+// 有効なセッション一覧取得
+func (app *App) getActiveSessions(userID int, currentSessionID string) []Session {
+	rows, err := app.db.Query(`SELECT id, user_id, ip, user_agent, created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY last_seen_at DESC`, userID, sqlTime(time.Now()))
+	if err != nil {
+		return []Session{}
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		err := rows.Scan(&s.ID, &s.UserID, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+		if err != nil {
+			continue
+		}
+		s.Current = s.ID == currentSessionID
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// ログイン履歴取得
+func (app *App) getLoginHistory(userID, limit int) []LoginEvent {
+	rows, err := app.db.Query(`SELECT id, method, success, ip, user_agent, created_at
+		FROM login_events
+		WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?`, userID, limit)
+	if err != nil {
+		return []LoginEvent{}
+	}
+	defer rows.Close()
+
+	var events []LoginEvent
+	for rows.Next() {
+		var e LoginEvent
+		err := rows.Scan(&e.ID, &e.Method, &e.Success, &e.IP, &e.UserAgent, &e.CreatedAt)
+		if err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// 端末・ログイン履歴ページ
+func (app *App) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	sessionID := r.Context().Value("session_id").(string)
+
+	app.renderTemplate(w, r, "devices", PageData{
+		Title:           "ログイン中の端末",
+		IsAuthenticated: true,
+		CurrentUserID:   userID,
+		Sessions:        app.getActiveSessions(userID, sessionID),
+		LoginHistory:    app.getLoginHistory(userID, loginHistoryLimit),
+	})
+}
+
+// 端末のログアウト
+func (app *App) revokeDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	sessionID := mux.Vars(r)["id"]
+
+	app.db.Exec("UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		sessionID, userID)
+
+	if sessionID == r.Context().Value("session_id").(string) {
+		clearSessionCookies(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/settings/devices", http.StatusSeeOther)
+}
+
+// セッション一覧API
+func (app *App) getSessionsAPI(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	sessionID := r.Context().Value("session_id").(string)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APIResponse{
+		Success:  true,
+		Sessions: app.getActiveSessions(userID, sessionID),
+	})
+}
+
+// セッション失効API
+func (app *App) revokeSessionAPI(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	sessionID := mux.Vars(r)["id"]
+
+	res, err := app.db.Exec("UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		sessionID, userID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Failed to revoke session",
+		})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Session not found",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Message: "Session revoked successfully",
+	})
+}
@@ -9,12 +9,11 @@ require (
 	github.com/gorilla/sessions v1.2.2
 	github.com/mattn/go-sqlite3 v1.14.19
 	golang.org/x/crypto v0.18.0
+	golang.org/x/image v0.18.0
 	golang.org/x/oauth2 v0.16.0
 )
 
 require (
-	cloud.google.com/go/compute v1.20.1 // indirect
-	cloud.google.com/go/compute/metadata v0.2.3 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/gorilla/securecookie v1.1.2 // indirect
 	golang.org/x/net v0.20.0 // indirect
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
 	"strconv"
@@ -17,7 +18,16 @@ type APIResponse struct {
 	Comments []Comment  `json:"comments,omitempty"`
 	Likes   int         `json:"likes,omitempty"`
 	Liked   bool        `json:"liked,omitempty"`
+	Reposts int         `json:"reposts,omitempty"`
+	Reposted bool       `json:"reposted,omitempty"`
 	Following bool      `json:"following,omitempty"`
+	Sessions []Session  `json:"sessions,omitempty"`
+	Post    *Post       `json:"post,omitempty"`
+	Revisions []PostRevision `json:"revisions,omitempty"`
+	Thread  *Thread     `json:"thread,omitempty"`
+	Notifications []Notification `json:"notifications,omitempty"`
+	NextCursor int      `json:"next_cursor,omitempty"`
+	Unread  int         `json:"unread,omitempty"`
 }
 
 // 投稿一覧API
@@ -71,6 +81,17 @@ func (app *App) likePostAPI(w http.ResponseWriter, r *http.Request) {
 		app.db.Exec("UPDATE posts SET likes = likes + 1 WHERE id = ?", postID)
 	}
 
+	// 投稿者への通知（いいね解除の場合は通知を削除）
+	if authorID, err := postAuthor(app.db, postID); err == nil {
+		if count > 0 {
+			deleteNotification(app.db, userID, notificationLike, authorID, postID)
+		} else {
+			createNotification(app.db, authorID, userID, notificationLike, postID, 0)
+		}
+		app.publishNotifications(authorID)
+	}
+	app.publishCounts(postID)
+
 	// 最新のいいね数取得
 	var likes int
 	app.db.QueryRow("SELECT likes FROM posts WHERE id = ?", postID).Scan(&likes)
@@ -132,9 +153,16 @@ func (app *App) createCommentAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// コメント作成
-	_, err = app.db.Exec("INSERT INTO comments (user_id, post_id, content) VALUES (?, ?, ?)",
-		userID, postID, req.Content)
+	// コメントは返信の投稿として作成（投稿のコメント数も更新される）
+	_, err = app.createPost(userID, req.Content, postRefs{replyTo: postID}, &postAttachments{})
+	if err == errPostNotFound {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Post not found",
+		})
+		return
+	}
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(APIResponse{
@@ -144,9 +172,6 @@ func (app *App) createCommentAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 投稿のコメント数更新
-	app.db.Exec("UPDATE posts SET comments = comments + 1 WHERE id = ?", postID)
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(APIResponse{
 		Success: true,
@@ -181,8 +206,19 @@ func (app *App) deletePostAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 投稿削除（CASCADE制約で関連データも削除される）
-	_, err = app.db.Exec("DELETE FROM posts WHERE id = ?", postID)
+	media := app.postMediaRefs(postID)
+	recipients := app.notificationRecipients(postID)
+
+	// 投稿と関連データを削除（返信の場合は返信先の返信数も減らす）
+	parentID, err := app.deletePost(postID, userID)
+	if err == errPostNotFound {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Post not found",
+		})
+		return
+	}
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(APIResponse{
@@ -191,6 +227,12 @@ func (app *App) deletePostAPI(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	app.deleteMedia(r.Context(), media...)
+
+	if parentID != 0 {
+		app.publishCounts(parentID)
+	}
+	app.publishNotifications(recipients...)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(APIResponse{
@@ -233,11 +275,14 @@ func (app *App) followUserAPI(w http.ResponseWriter, r *http.Request) {
 		// フォロー解除
 		app.db.Exec("DELETE FROM follows WHERE follower_id = ? AND following_id = ?", 
 			userID, targetUserID)
+		deleteNotification(app.db, userID, notificationFollow, targetUserID, 0)
 	} else {
 		// フォロー追加
 		app.db.Exec("INSERT INTO follows (follower_id, following_id) VALUES (?, ?)", 
 			userID, targetUserID)
+		createNotification(app.db, targetUserID, userID, notificationFollow, 0, 0)
 	}
+	app.publishNotifications(targetUserID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(APIResponse{
@@ -253,28 +298,74 @@ func (app *App) getTimelinePosts(userID int) []Post {
 	return app.getTimelinePostsPaginated(userID, 20, 0)
 }
 
+// 自分とフォローしているユーザーの投稿・リポストを新しい順に並べる
+// 同じ投稿は最後に投稿・リポストされた位置に1回だけ表示する
 func (app *App) getTimelinePostsPaginated(userID int, limit, offset int) []Post {
 	query := `
-		SELECT p.id, p.user_id, u.username, u.avatar, p.content, p.image_url, 
-		       p.likes, p.comments, p.created_at
-		FROM posts p
-		JOIN users u ON p.user_id = u.id
-		WHERE p.user_id = ? OR p.user_id IN (
-			SELECT following_id FROM follows WHERE follower_id = ?
+		SELECT post_id, reposted_by, MAX(activity_at) AS activity_at
+		FROM (
+			SELECT p.id AS post_id, '' AS reposted_by, p.created_at AS activity_at
+			FROM posts p
+			WHERE (p.user_id = ? OR p.user_id IN (
+				SELECT following_id FROM follows WHERE follower_id = ?
+			)) AND p.in_reply_to IS NULL
+			UNION ALL
+			SELECT r.post_id, u.username, r.created_at
+			FROM reposts r
+			JOIN users u ON r.user_id = u.id
+			WHERE r.user_id = ? OR r.user_id IN (
+				SELECT following_id FROM follows WHERE follower_id = ?
+			)
 		)
-		ORDER BY p.created_at DESC
+		GROUP BY post_id
+		ORDER BY activity_at DESC, post_id DESC
 		LIMIT ? OFFSET ?
 	`
-	return app.queryPosts(query, userID, userID, limit, offset)
+
+	rows, err := app.db.Query(query, userID, userID, userID, userID, limit, offset)
+	if err != nil {
+		return []Post{}
+	}
+	defer rows.Close()
+
+	var ids []int
+	repostedBy := make(map[int]string)
+	for rows.Next() {
+		var postID int
+		var reposter string
+		var activityAt interface{}
+		if err := rows.Scan(&postID, &reposter, &activityAt); err != nil {
+			continue
+		}
+		ids = append(ids, postID)
+		repostedBy[postID] = reposter
+	}
+	rows.Close()
+
+	if len(ids) == 0 {
+		return []Post{}
+	}
+	found := app.getPostsByID(ids)
+	posts := make([]Post, 0, len(ids))
+	for _, id := range ids {
+		post, ok := found[id]
+		if !ok {
+			continue
+		}
+		post.RepostedBy = repostedBy[id]
+		posts = append(posts, post)
+	}
+	return posts
 }
 
 // 最新投稿取得（未認証ユーザー向け）
 func (app *App) getLatestPosts(limit int) []Post {
 	query := `
-		SELECT p.id, p.user_id, u.username, u.avatar, p.content, p.image_url, 
-		       p.likes, p.comments, p.created_at
+		SELECT p.id, p.user_id, u.username, u.avatar, p.content, p.in_reply_to, p.quote_of,
+		       p.likes, p.comments, p.reposts, p.created_at, p.edited_at
 		FROM posts p
 		JOIN users u ON p.user_id = u.id
+		WHERE p.in_reply_to IS NULL
 		ORDER BY p.created_at DESC
 		LIMIT ?
 	`
@@ -284,19 +375,41 @@ func (app *App) getLatestPosts(limit int) []Post {
 // ユーザーの投稿取得
 func (app *App) getUserPosts(userID, limit int) []Post {
 	query := `
-		SELECT p.id, p.user_id, u.username, u.avatar, p.content, p.image_url, 
-		       p.likes, p.comments, p.created_at
+		SELECT p.id, p.user_id, u.username, u.avatar, p.content, p.in_reply_to, p.quote_of,
+		       p.likes, p.comments, p.reposts, p.created_at, p.edited_at
 		FROM posts p
 		JOIN users u ON p.user_id = u.id
-		WHERE p.user_id = ?
+		WHERE p.user_id = ? AND p.in_reply_to IS NULL
 		ORDER BY p.created_at DESC
 		LIMIT ?
 	`
 	return app.queryPosts(query, userID, limit)
 }
 
-// 投稿クエリ実行
+// 投稿を1件取得
+func (app *App) getPost(postID int) *Post {
+	query := `
+		SELECT p.id, p.user_id, u.username, u.avatar, p.content, p.in_reply_to, p.quote_of,
+		       p.likes, p.comments, p.reposts, p.created_at, p.edited_at
+		FROM posts p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.id = ?
+	`
+	posts := app.queryPosts(query, postID)
+	if len(posts) == 0 {
+		return nil
+	}
+	return &posts[0]
+}
+
+// 投稿クエリ実行（引用された投稿も読み込む）
 func (app *App) queryPosts(query string, args ...interface{}) []Post {
+	posts := app.queryPostRows(query, args...)
+	app.attachQuotedPosts(posts)
+	return posts
+}
+
+func (app *App) queryPostRows(query string, args ...interface{}) []Post {
 	rows, err := app.db.Query(query, args...)
 	if err != nil {
 		return []Post{}
@@ -306,24 +419,37 @@ func (app *App) queryPosts(query string, args ...interface{}) []Post {
 	var posts []Post
 	for rows.Next() {
 		var post Post
+		var inReplyTo, quoteOf sql.NullInt64
+		var editedAt sql.NullTime
 		err := rows.Scan(&post.ID, &post.UserID, &post.Username, &post.Avatar, 
-			&post.Content, &post.ImageURL, &post.Likes, &post.Comments, &post.CreatedAt)
+			&post.Content, &inReplyTo, &quoteOf, &post.Likes, &post.Comments, &post.Reposts,
+			&post.CreatedAt, &editedAt)
 		if err != nil {
 			continue
 		}
+		post.InReplyTo = int(inReplyTo.Int64)
+		post.QuoteOf = int(quoteOf.Int64)
+		if editedAt.Valid {
+			post.EditedAt = &editedAt.Time
+		}
+		post.Avatar = app.mediaURL(post.Avatar)
 		posts = append(posts, post)
 	}
+	rows.Close()
+
+	app.attachPostMedia(posts)
+	app.attachPostMentions(posts)
 	return posts
 }
 
-// コメント取得
+// コメント取得（投稿への直接の返信）
 func (app *App) getPostComments(postID int) []Comment {
 	query := `
-		SELECT c.id, c.user_id, c.post_id, u.username, u.avatar, c.content, c.created_at
-		FROM comments c
+		SELECT c.id, c.user_id, c.in_reply_to, u.username, u.avatar, c.content, c.comments, c.created_at
+		FROM posts c
 		JOIN users u ON c.user_id = u.id
-		WHERE c.post_id = ?
-		ORDER BY c.created_at ASC
+		WHERE c.in_reply_to = ?
+		ORDER BY c.created_at ASC, c.id ASC
 	`
 	
 	rows, err := app.db.Query(query, postID)
@@ -336,10 +462,11 @@ func (app *App) getPostComments(postID int) []Comment {
 	for rows.Next() {
 		var comment Comment
 		err := rows.Scan(&comment.ID, &comment.UserID, &comment.PostID, 
-			&comment.Username, &comment.Avatar, &comment.Content, &comment.CreatedAt)
+			&comment.Username, &comment.Avatar, &comment.Content, &comment.Replies, &comment.CreatedAt)
 		if err != nil {
 			continue
 		}
+		comment.Avatar = app.mediaURL(comment.Avatar)
 		comments = append(comments, comment)
 	}
 	return comments
@@ -370,6 +497,7 @@ func (app *App) getSuggestedUsers(userID, limit int) []User {
 		if err != nil {
 			continue
 		}
+		user.Avatar = app.mediaURL(user.Avatar)
 		users = append(users, user)
 	}
 	return users
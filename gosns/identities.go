@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	pendingLinkCookie = "pending_link"
+	pendingLinkTTL    = 10 * time.Minute
+)
+
+var (
+	errIdentityTaken   = errors.New("identity is linked to another account")
+	errProviderLinked  = errors.New("provider is already linked")
+	errLastLoginMethod = errors.New("cannot remove the last login method")
+)
+
+// 外部IDに紐づくユーザーを取得
+func (app *App) findIdentityUser(provider, subject string) (int, string, error) {
+	var userID int
+	var username string
+	err := app.db.QueryRow(`SELECT u.id, u.username FROM identities i
+		JOIN users u ON u.id = i.user_id
+		WHERE i.provider = ? AND i.subject = ?`, provider, subject).Scan(&userID, &username)
+	return userID, username, err
+}
+
+// 外部IDで新規ユーザーを作成
+func (app *App) createExternalUser(provider string, claims *OIDCClaims) (int, string, error) {
+	if claims.Email == "" {
+		return 0, "", errors.New("email claim is required")
+	}
+
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.Split(claims.Email, "@")[0]
+	}
+	username := app.uniqueUsername(base)
+
+	avatar := claims.Picture
+	if avatar == "" {
+		avatar = "/static/img/default-avatar.png"
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO users (username, email, avatar, verified) VALUES (?, ?, ?, ?)",
+		username, claims.Email, avatar, claims.EmailVerified)
+	if err != nil {
+		return 0, "", err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	if err := insertIdentity(tx, int(id), provider, claims.Subject, claims.Email); err != nil {
+		return 0, "", err
+	}
+	return int(id), username, tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertIdentity(db execer, userID int, provider, subject, email string) error {
+	if _, err := db.Exec("INSERT INTO identities (user_id, provider, subject, email) VALUES (?, ?, ?, ?)",
+		userID, provider, subject, email); err != nil {
+		return err
+	}
+	// 旧カラムとの互換性のため google_id も更新
+	if provider == "google" {
+		if _, err := db.Exec("UPDATE users SET google_id = ? WHERE id = ?", subject, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 外部IDをユーザーに連携
+func (app *App) linkIdentity(userID int, provider, subject, email string) error {
+	var owner int
+	err := app.db.QueryRow("SELECT user_id FROM identities WHERE provider = ? AND subject = ?",
+		provider, subject).Scan(&owner)
+	if err == nil {
+		if owner == userID {
+			return nil
+		}
+		return errIdentityTaken
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	var count int
+	app.db.QueryRow("SELECT COUNT(*) FROM identities WHERE user_id = ? AND provider = ?",
+		userID, provider).Scan(&count)
+	if count > 0 {
+		return errProviderLinked
+	}
+	return insertIdentity(app.db, userID, provider, subject, email)
+}
+
+// 外部IDの連携解除（他にログイン手段がない場合は拒否）
+func (app *App) unlinkIdentity(userID int, provider string) error {
+	var password sql.NullString
+	var passkeys, identities int
+	app.db.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&password)
+	app.db.QueryRow("SELECT COUNT(*) FROM credentials WHERE user_id = ?", userID).Scan(&passkeys)
+	app.db.QueryRow("SELECT COUNT(*) FROM identities WHERE user_id = ? AND provider != ?", userID, provider).Scan(&identities)
+	if password.String == "" && passkeys == 0 && identities == 0 {
+		return errLastLoginMethod
+	}
+
+	if _, err := app.db.Exec("DELETE FROM identities WHERE user_id = ? AND provider = ?", userID, provider); err != nil {
+		return err
+	}
+	if provider == "google" {
+		app.db.Exec("UPDATE users SET google_id = NULL WHERE id = ?", userID)
+	}
+	return nil
+}
+
+// 連携済みの外部ID一覧
+func (app *App) getIdentities(userID int) []Identity {
+	rows, err := app.db.Query(`SELECT id, user_id, provider, subject, email, created_at
+		FROM identities WHERE user_id = ? ORDER BY provider`, userID)
+	if err != nil {
+		return []Identity{}
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		var i Identity
+		if err := rows.Scan(&i.ID, &i.UserID, &i.Provider, &i.Subject, &i.Email, &i.CreatedAt); err != nil {
+			continue
+		}
+		i.DisplayName = i.Provider
+		if p, ok := app.providers[i.Provider]; ok {
+			i.DisplayName = p.DisplayName
+		}
+		identities = append(identities, i)
+	}
+	return identities
+}
+
+// 連携確認待ちの外部IDを署名付きCookieに保存
+func setPendingLink(w http.ResponseWriter, provider, subject, email string, userID int) {
+	expires := time.Now().Add(pendingLinkTTL).Unix()
+	payload := strings.Join([]string{
+		provider,
+		base64.RawURLEncoding.EncodeToString([]byte(subject)),
+		base64.RawURLEncoding.EncodeToString([]byte(email)),
+		strconv.Itoa(userID),
+		strconv.FormatInt(expires, 10),
+	}, ".")
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLinkCookie,
+		Value:    signToken(payload),
+		HttpOnly: true,
+		Secure:   false,
+		MaxAge:   int(pendingLinkTTL.Seconds()),
+		Path:     "/login/link",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func readPendingLink(r *http.Request) (provider, subject, email string, userID int, ok bool) {
+	cookie, err := r.Cookie(pendingLinkCookie)
+	if err != nil {
+		return "", "", "", 0, false
+	}
+	payload, valid := verifySignedToken(cookie.Value)
+	if !valid {
+		return "", "", "", 0, false
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 5 {
+		return "", "", "", 0, false
+	}
+	sub, err1 := base64.RawURLEncoding.DecodeString(parts[1])
+	addr, err2 := base64.RawURLEncoding.DecodeString(parts[2])
+	uid, err3 := strconv.Atoi(parts[3])
+	expires, err4 := strconv.ParseInt(parts[4], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || time.Now().Unix() > expires {
+		return "", "", "", 0, false
+	}
+	return parts[0], string(sub), string(addr), uid, true
+}
+
+func clearPendingLink(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLinkCookie,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/login/link",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// 既存アカウントへの連携確認ページ
+func (app *App) linkConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	providerName, subject, email, userID, ok := readPendingLink(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	identity := &Identity{Provider: providerName, Email: email, DisplayName: providerName}
+	if p, ok := app.providers[providerName]; ok {
+		identity.DisplayName = p.DisplayName
+	}
+	data := PageData{
+		Title:    "アカウントの連携",
+		Identity: identity,
+	}
+
+	var user User
+	var password sql.NullString
+	if err := app.db.QueryRow("SELECT id, username, password FROM users WHERE id = ?", userID).
+		Scan(&user.ID, &user.Username, &password); err != nil {
+		clearPendingLink(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// パスワード未設定のアカウントは既存の方法でログインしてから設定画面で連携してもらう
+	if password.String == "" {
+		data.Identity = nil
+		data.Error = "このアカウントにはパスワードが設定されていません。既存の方法でログインしてから「連携アカウント」設定で連携してください"
+		app.renderTemplate(w, r, "link_account", data)
+		return
+	}
+
+	if r.Method == "GET" {
+		app.renderTemplate(w, r, "link_account", data)
+		return
+	}
+
+	if wait := app.loginRetryAfter(r, userID, ""); wait > 0 {
+		setRetryAfter(w, wait)
+		data.Error = "ログインの試行回数が多すぎます。しばらく時間をおいてから再度お試しください"
+		app.renderTemplate(w, r, "link_account", data)
+		return
+	}
+
+	valid, err := app.comparePassword(r.FormValue("password"), password.String)
+	if err == errBcryptBusy {
+		http.Error(w, "サーバーが混雑しています。しばらくしてから再度お試しください", http.StatusServiceUnavailable)
+		return
+	}
+	if !valid {
+		app.recordLoginFailure(r, userID, email, loginMethodPassword)
+		data.Error = "パスワードが正しくありません"
+		app.renderTemplate(w, r, "link_account", data)
+		return
+	}
+
+	if err := app.linkIdentity(userID, providerName, subject, email); err != nil {
+		log.Println("アカウント連携エラー:", err)
+		data.Identity = nil
+		data.Error = "アカウントの連携に失敗しました"
+		app.renderTemplate(w, r, "link_account", data)
+		return
+	}
+	clearPendingLink(w)
+
+	app.recordLogin(r, userID, email, providerName, true)
+	app.completeLogin(w, r, userID, user.Username)
+}
+
+// 連携アカウント設定ページ
+func (app *App) connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	app.renderConnections(w, r, userID, "")
+}
+
+func (app *App) renderConnections(w http.ResponseWriter, r *http.Request, userID int, errMsg string) {
+	identities := app.getIdentities(userID)
+
+	linked := make(map[string]bool)
+	for _, i := range identities {
+		linked[i.Provider] = true
+	}
+	var available []ProviderInfo
+	for _, p := range app.providerInfos() {
+		if !linked[p.Name] {
+			available = append(available, p)
+		}
+	}
+
+	app.renderTemplate(w, r, "connections", PageData{
+		Title:           "連携アカウント",
+		IsAuthenticated: true,
+		CurrentUserID:   userID,
+		Identities:      identities,
+		Providers:       available,
+		Error:           errMsg,
+	})
+}
+
+// 外部アカウントの連携開始
+func (app *App) linkProviderHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	provider, ok := app.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	app.startOIDCFlow(w, r, provider, userID)
+}
+
+// 外部アカウントの連携完了（OIDCコールバックから呼ばれる）
+func (app *App) finishIdentityLink(w http.ResponseWriter, r *http.Request, provider *OIDCProvider, claims *OIDCClaims, userID int) {
+	err := app.linkIdentity(userID, provider.Name, claims.Subject, claims.Email)
+	switch err {
+	case nil:
+		http.Redirect(w, r, "/settings/connections", http.StatusSeeOther)
+	case errIdentityTaken:
+		app.renderConnections(w, r, userID, fmt.Sprintf("この%sアカウントは別のユーザーに連携されています", provider.DisplayName))
+	case errProviderLinked:
+		app.renderConnections(w, r, userID, fmt.Sprintf("%sアカウントは既に連携されています", provider.DisplayName))
+	default:
+		log.Println("アカウント連携エラー:", err)
+		app.renderConnections(w, r, userID, "アカウントの連携に失敗しました")
+	}
+}
+
+// 外部アカウントの連携解除
+func (app *App) unlinkProviderHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	err := app.unlinkIdentity(userID, mux.Vars(r)["provider"])
+	if err == errLastLoginMethod {
+		app.renderConnections(w, r, userID, "他にログイン手段がないため連携を解除できません。先にパスワード（パスワード再設定から設定できます）またはパスキーを登録してください")
+		return
+	}
+	if err != nil {
+		log.Println("連携解除エラー:", err)
+		app.renderConnections(w, r, userID, "連携の解除に失敗しました")
+		return
+	}
+	http.Redirect(w, r, "/settings/connections", http.StatusSeeOther)
+}
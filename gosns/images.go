@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// 生成する画像サイズ（長辺の最大ピクセル数）
+type imageVariant struct {
+	name    string
+	maxSize int
+	square  bool
+}
+
+var postImageVariants = []imageVariant{
+	{name: "thumb", maxSize: 320, square: true},
+	{name: "feed", maxSize: 1080},
+	{name: "full", maxSize: 2048},
+}
+
+var avatarImageVariants = []imageVariant{
+	{name: "avatar", maxSize: 256, square: true},
+}
+
+const jpegQuality = 85
+
+// 処理済みの画像データ
+type processedImage struct {
+	files    map[string]imageFile
+	blurhash string
+}
+
+type imageFile struct {
+	data   []byte
+	ext    string
+	width  int
+	height int
+}
+
+// 画像をデコードし、向きを補正したうえで各サイズに再エンコードする
+// 再エンコードによりEXIF（位置情報を含む）などのメタデータはすべて取り除かれる
+func processImage(data []byte, variants []imageVariant) (*processedImage, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUploadInvalid
+	}
+
+	// アニメーションGIFはフレームを保ったまま再エンコードし、サムネイルのみ静止画にする
+	// 正方形のサイズしか作らない場合は先頭フレームだけで足りるので全フレームをデコードしない
+	var anim *gif.GIF
+	if format == "gif" && !allSquare(variants) {
+		// 各フレームは論理画面の大きさを超えないので、画面の大きさで上限を見積もる
+		cfg, err := gif.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, errUploadInvalid
+		}
+		frames := gifFrameCount(data)
+		if frames*cfg.Width*cfg.Height > maxAnimationPixels {
+			return nil, errUploadTooLarge
+		}
+		if frames > 1 {
+			if g, err := gif.DecodeAll(bytes.NewReader(data)); err == nil && len(g.Image) > 1 {
+				anim = g
+			}
+		}
+	}
+	if format == "jpeg" {
+		img = applyOrientation(toRGBA(img), jpegOrientation(data))
+	}
+
+	result := &processedImage{
+		files:    make(map[string]imageFile),
+		blurhash: encodeBlurhash(resizeImage(img, imageVariant{maxSize: 32})),
+	}
+	for _, v := range variants {
+		if anim != nil && !v.square {
+			scaled := scaleAnimation(anim, v.maxSize)
+			var buf bytes.Buffer
+			if err := gif.EncodeAll(&buf, scaled); err != nil {
+				return nil, err
+			}
+			result.files[v.name] = imageFile{data: buf.Bytes(), ext: ".gif", width: scaled.Config.Width, height: scaled.Config.Height}
+			continue
+		}
+
+		resized := resizeImage(img, v)
+		var buf bytes.Buffer
+		ext := ".jpg"
+		if resized.Opaque() {
+			err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			ext = ".png"
+			err = png.Encode(&buf, resized)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.files[v.name] = imageFile{data: buf.Bytes(), ext: ext, width: resized.Rect.Dx(), height: resized.Rect.Dy()}
+	}
+	return result, nil
+}
+
+func allSquare(variants []imageVariant) bool {
+	for _, v := range variants {
+		if !v.square {
+			return false
+		}
+	}
+	return true
+}
+
+// アニメーションGIFを長辺が maxSize 以下になるよう縮小する（拡大はしない）
+// パレットを保つため、各フレームを最近傍法で縮小する
+func scaleAnimation(g *gif.GIF, maxSize int) *gif.GIF {
+	w, h := g.Config.Width, g.Config.Height
+	out := &gif.GIF{
+		Delay:           g.Delay,
+		Disposal:        g.Disposal,
+		LoopCount:       g.LoopCount,
+		BackgroundIndex: g.BackgroundIndex,
+		Config:          g.Config,
+	}
+	if w <= maxSize && h <= maxSize {
+		out.Image = g.Image
+		return out
+	}
+
+	dw, dh := fitSize(w, h, maxSize)
+	out.Config.Width, out.Config.Height = dw, dh
+	scale := func(p image.Point) image.Point {
+		return image.Pt(p.X*dw/w, p.Y*dh/h)
+	}
+	for _, frame := range g.Image {
+		r := image.Rectangle{Min: scale(frame.Rect.Min), Max: scale(frame.Rect.Max)}
+		if r.Dx() < 1 {
+			r.Max.X = r.Min.X + 1
+		}
+		if r.Dy() < 1 {
+			r.Max.Y = r.Min.Y + 1
+		}
+		out.Image = append(out.Image, scalePaletted(frame, r))
+	}
+	return out
+}
+
+// パレット画像を最近傍法で r の大きさに縮小する
+func scalePaletted(src *image.Paletted, r image.Rectangle) *image.Paletted {
+	dst := image.NewPaletted(r, src.Palette)
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	for y := 0; y < r.Dy(); y++ {
+		sy := src.Rect.Min.Y + y*sh/r.Dy()
+		for x := 0; x < r.Dx(); x++ {
+			sx := src.Rect.Min.X + x*sw/r.Dx()
+			dst.Pix[y*dst.Stride+x] = src.Pix[src.PixOffset(sx, sy)]
+		}
+	}
+	return dst
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// 指定サイズに縮小（拡大はしない）。square の場合は中央を正方形に切り抜く
+func resizeImage(img image.Image, v imageVariant) *image.RGBA {
+	src := img.Bounds()
+	if v.square {
+		side := src.Dx()
+		if src.Dy() < side {
+			side = src.Dy()
+		}
+		x := src.Min.X + (src.Dx()-side)/2
+		y := src.Min.Y + (src.Dy()-side)/2
+		src = image.Rect(x, y, x+side, y+side)
+	}
+
+	w, h := fitSize(src.Dx(), src.Dy(), v.maxSize)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if w == src.Dx() && h == src.Dy() {
+		draw.Draw(dst, dst.Bounds(), img, src.Min, draw.Src)
+	} else {
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	}
+	return dst
+}
+
+// 縦横比を保ったまま長辺が maxSize 以下になる大きさ
+func fitSize(w, h, maxSize int) (int, int) {
+	if w > maxSize || h > maxSize {
+		if w >= h {
+			h = h * maxSize / w
+			w = maxSize
+		} else {
+			w = w * maxSize / h
+			h = maxSize
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// GIFの画像ブロックの数を数える（全フレームをデコードせずにアニメーションか判定する）
+func gifFrameCount(data []byte) int {
+	if len(data) < 13 {
+		return 0
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // 拡張ブロック
+			pos += 2
+		case 0x2C: // 画像ブロック
+			frames++
+			if pos+10 > len(data) {
+				return frames
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos++ // LZW最小コードサイズ
+		default: // 終端（0x3B）
+			return frames
+		}
+		// データサブブロックを読み飛ばす
+		for pos < len(data) && data[pos] != 0 {
+			pos += int(data[pos]) + 1
+		}
+		pos++
+	}
+	return frames
+}
+
+// JPEGのEXIFから向き（Orientationタグ）を取得する。見つからない場合は 1
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || length < 2 || pos+2+length > len(data) {
+			break
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// EXIFの向きに従って画像を回転・反転する
+func applyOrientation(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+)
+
+// 論理画面が w×h で、frame の大きさのフレームを n 枚持つアニメーションGIF
+func testGIF(t *testing.T, w, h int, frame image.Rectangle, n int) []byte {
+	t.Helper()
+
+	g := &gif.GIF{Config: image.Config{Width: w, Height: h, ColorModel: color.Palette(palette.Plan9)}}
+	for i := 0; i < n; i++ {
+		img := image.NewPaletted(frame, palette.Plan9)
+		for j := range img.Pix {
+			img.Pix[j] = uint8(i*16 + j%16)
+		}
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAnimatedGIFIsScaled(t *testing.T) {
+	data := testGIF(t, 400, 200, image.Rect(0, 0, 400, 200), 3)
+
+	processed, err := processImage(data, []imageVariant{
+		{name: "thumb", maxSize: 64, square: true},
+		{name: "feed", maxSize: 100},
+		{name: "full", maxSize: 1000},
+	})
+	if err != nil {
+		t.Fatalf("processImage: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		width, height int
+	}{
+		{"feed", 100, 50},
+		{"full", 400, 200},
+	}
+	for _, tc := range tests {
+		f := processed.files[tc.name]
+		if f.ext != ".gif" || f.width != tc.width || f.height != tc.height {
+			t.Fatalf("%s: %s %dx%d, want .gif %dx%d", tc.name, f.ext, f.width, f.height, tc.width, tc.height)
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(f.data))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(g.Image) != 3 {
+			t.Fatalf("%s: %d frames, want 3", tc.name, len(g.Image))
+		}
+		if g.Config.Width != tc.width || g.Config.Height != tc.height {
+			t.Fatalf("%s: screen %dx%d", tc.name, g.Config.Width, g.Config.Height)
+		}
+		for i, frame := range g.Image {
+			if frame.Rect != image.Rect(0, 0, tc.width, tc.height) {
+				t.Fatalf("%s: frame %d bounds %v", tc.name, i, frame.Rect)
+			}
+		}
+	}
+	if thumb := processed.files["thumb"]; thumb.ext == ".gif" || thumb.width != 64 || thumb.height != 64 {
+		t.Fatalf("thumb: %s %dx%d", thumb.ext, thumb.width, thumb.height)
+	}
+}
+
+// フレーム数×論理画面の大きさが上限を超えるGIFは全フレームをデコードしない
+func TestAnimatedGIFPixelBudget(t *testing.T) {
+	frames := maxAnimationPixels/(4000*4000) + 1
+	data := testGIF(t, 4000, 4000, image.Rect(0, 0, 1, 1), frames)
+	if err := validateImage(data); err != nil {
+		t.Fatalf("validateImage: %v", err)
+	}
+
+	if _, err := processImage(data, postImageVariants); err != errUploadTooLarge {
+		t.Fatalf("post image: err = %v, want errUploadTooLarge", err)
+	}
+
+	// アバターは正方形のみなので先頭フレームだけで処理できる
+	processed, err := processImage(data, avatarImageVariants)
+	if err != nil {
+		t.Fatalf("avatar: %v", err)
+	}
+	if f := processed.files["avatar"]; f.ext == ".gif" {
+		t.Fatalf("avatar saved as %s", f.ext)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	loginFailureWindow      = 15 * time.Minute
+	loginBackoffThreshold   = 3
+	loginBackoffBase        = time.Second
+	loginBackoffMax         = 5 * time.Minute
+	accountLockoutThreshold = 10
+	accountLockoutDuration  = 15 * time.Minute
+	ipFailureThreshold      = 30
+	bcryptQueueTimeout      = 3 * time.Second
+)
+
+var errBcryptBusy = errors.New("too many concurrent password operations")
+
+// bcrypt処理の同時実行数を制限
+func (app *App) withBcryptSlot(fn func()) error {
+	timer := time.NewTimer(bcryptQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case app.bcryptSlots <- struct{}{}:
+		defer func() { <-app.bcryptSlots }()
+		fn()
+		return nil
+	case <-timer.C:
+		return errBcryptBusy
+	}
+}
+
+func (app *App) comparePassword(password, hash string) (bool, error) {
+	var ok bool
+	err := app.withBcryptSlot(func() {
+		ok = checkPasswordHash(password, hash)
+	})
+	return ok, err
+}
+
+func (app *App) hashPasswordLimited(password string) (string, error) {
+	var hashed string
+	var hashErr error
+	if err := app.withBcryptSlot(func() {
+		hashed, hashErr = hashPassword(password)
+	}); err != nil {
+		return "", err
+	}
+	return hashed, hashErr
+}
+
+// 直近の失敗回数と最後の失敗日時
+// 成功しても数え直さない（自分のアカウントへのログインや2段階目の前のパスワード認証で
+// 他のアカウントへの試行やTOTPの総当たりの回数を消せないようにする）
+func (app *App) recentLoginFailures(column string, value interface{}) (int, time.Time) {
+	since := sqlTime(time.Now().Add(-loginFailureWindow))
+
+	var count int
+	var lastFailure time.Time
+	app.db.QueryRow("SELECT COUNT(*) FROM login_events WHERE "+column+" = ? AND success = FALSE AND created_at >= ?",
+		value, since).Scan(&count)
+	app.db.QueryRow("SELECT created_at FROM login_events WHERE "+column+" = ? AND success = FALSE AND created_at >= ? ORDER BY created_at DESC LIMIT 1",
+		value, since).Scan(&lastFailure)
+	return count, lastFailure
+}
+
+// 失敗回数に応じた待ち時間（指数バックオフ）
+func loginBackoff(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	delay := loginBackoffBase
+	for i := threshold; i < failures && delay < loginBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > loginBackoffMax {
+		delay = loginBackoffMax
+	}
+	return delay
+}
+
+// ログイン試行が可能か判定し、不可の場合は再試行までの時間を返す
+// userID が 0 の場合はメールアドレス単位で数える
+func (app *App) loginRetryAfter(r *http.Request, userID int, email string) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+
+	column, value := "email", interface{}(email)
+	if userID > 0 {
+		column, value = "user_id", userID
+	}
+	if userID > 0 || email != "" {
+		failures, last := app.recentLoginFailures(column, value)
+		if failures >= accountLockoutThreshold {
+			wait = time.Until(last.Add(accountLockoutDuration))
+		} else if d := time.Until(last.Add(loginBackoff(failures, loginBackoffThreshold))); d > wait {
+			wait = d
+		}
+	}
+
+	ipFailures, ipLast := app.recentLoginFailures("ip", clientIP(r))
+	if d := ipLast.Add(loginBackoff(ipFailures, ipFailureThreshold)).Sub(now); d > wait {
+		wait = d
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// 失敗を記録し、ロックに達した場合はアカウント所有者に通知
+func (app *App) recordLoginFailure(r *http.Request, userID int, email, method string) {
+	app.recordLogin(r, userID, email, method, false)
+	if userID == 0 {
+		return
+	}
+
+	failures, _ := app.recentLoginFailures("user_id", userID)
+	if failures != accountLockoutThreshold {
+		return
+	}
+
+	var address string
+	if err := app.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&address); err != nil {
+		return
+	}
+	ip := clientIP(r)
+	go func() {
+		err := app.mailer.Send(Message{
+			To:      address,
+			Subject: "【GoSNS】ログインが一時的にロックされました",
+			Body: fmt.Sprintf("お使いのアカウントでログインの失敗が続いたため、%d分間ログインを制限しました。\n\n"+
+				"最後の試行元IPアドレス: %s\n\n"+
+				"心当たりがない場合はパスワードの再設定をおすすめします。\n%s/password/forgot\n",
+				int(accountLockoutDuration.Minutes()), ip, baseURL),
+		})
+		if err != nil {
+			log.Println("ロック通知メール送信エラー:", err)
+		}
+	}()
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
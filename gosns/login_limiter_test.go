@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// テスト用にパスワードを設定する（テストを速くするため最小コストでハッシュ化）
+func setTestPassword(t *testing.T, app *App, userID int, password string) {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.db.Exec("UPDATE users SET password = ? WHERE id = ?", string(hash), userID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func formRequest(target string, form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// 記録済みのログイン履歴を過去にずらす（created_at は秒単位のため）
+func ageLoginEvents(t *testing.T, app *App, d time.Duration) {
+	t.Helper()
+
+	rows, err := app.db.Query("SELECT id, created_at FROM login_events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(map[int]time.Time)
+	for rows.Next() {
+		var id int
+		var createdAt time.Time
+		if err := rows.Scan(&id, &createdAt); err != nil {
+			t.Fatal(err)
+		}
+		events[id] = createdAt
+	}
+	rows.Close()
+	for id, createdAt := range events {
+		if _, err := app.db.Exec("UPDATE login_events SET created_at = ? WHERE id = ?", sqlTime(createdAt.Add(-d)), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func passwordLogin(app *App, email, password string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	app.loginHandler(w, formRequest("/login", url.Values{"email": {email}, "password": {password}}))
+	return w
+}
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{loginBackoffThreshold - 1, 0},
+		{loginBackoffThreshold, loginBackoffBase},
+		{loginBackoffThreshold + 1, 2 * loginBackoffBase},
+		{loginBackoffThreshold + 3, 8 * loginBackoffBase},
+		{loginBackoffThreshold + 100, loginBackoffMax},
+	}
+	for _, tc := range tests {
+		if got := loginBackoff(tc.failures, loginBackoffThreshold); got != tc.want {
+			t.Errorf("loginBackoff(%d) = %v, want %v", tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestLoginBackoffAfterFailures(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	setTestPassword(t, app, alice, "correct horse")
+
+	for i := 0; i < loginBackoffThreshold; i++ {
+		if w := passwordLogin(app, "alice@example.com", "wrong"); w.Code != http.StatusOK {
+			t.Fatalf("failure %d: status %d, want 200 with an error", i+1, w.Code)
+		}
+	}
+
+	// 正しいパスワードでも待ち時間の間は拒否する
+	w := passwordLogin(app, "alice@example.com", "correct horse")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("Retry-After header missing")
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	app, mailer := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	r := httptest.NewRequest("POST", "/login", nil)
+
+	for i := 0; i < accountLockoutThreshold; i++ {
+		app.recordLoginFailure(r, alice, "alice@example.com", loginMethodPassword)
+	}
+	ageLoginEvents(t, app, 10*time.Second)
+	// 別の端末からの成功があってもロックは解除されない
+	app.recordLogin(r, alice, "alice@example.com", loginMethodPasskey, true)
+
+	wait := app.loginRetryAfter(r, alice, "alice@example.com")
+	if wait < accountLockoutDuration-time.Minute || wait > accountLockoutDuration-10*time.Second {
+		t.Fatalf("wait = %v, want about %v", wait, accountLockoutDuration)
+	}
+
+	// ロック通知は非同期に送られる
+	deadline := time.Now().Add(time.Second)
+	for len(mailer.Messages()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	msgs := mailer.Messages()
+	if len(msgs) != 1 || msgs[0].To != "alice@example.com" {
+		t.Fatalf("messages = %+v, want one lockout notice to alice", msgs)
+	}
+}
+
+// 自分のアカウントへのログインで同じIPからの失敗回数を消せない
+func TestLoginSuccessDoesNotResetIPFailures(t *testing.T) {
+	app, _ := newTestApp(t)
+	mallory := createTestUser(t, app, "mallory", true)
+	setTestPassword(t, app, mallory, "mallory's password")
+	r := httptest.NewRequest("POST", "/login", nil)
+
+	for i := 0; i < ipFailureThreshold+5; i++ {
+		app.recordLoginFailure(r, 0, "victim"+strconv.Itoa(i)+"@example.com", loginMethodPassword)
+	}
+	if w := passwordLogin(app, "mallory@example.com", "mallory's password"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("own login: status %d, want 429", w.Code)
+	}
+
+	// 後から記録された成功があっても数え直さない
+	ageLoginEvents(t, app, 10*time.Second)
+	app.recordLogin(r, mallory, "mallory@example.com", loginMethodPassword, true)
+	if wait := app.loginRetryAfter(r, 0, "carol@example.com"); wait <= 0 {
+		t.Fatal("IP failures were reset by a successful login")
+	}
+}
+
+// パスワード認証をやり直しても認証コードの失敗回数は消えない
+func TestTOTPFailuresSurvivePasswordLogin(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice, code := enableTestTOTP(t, app, "alice")
+	setTestPassword(t, app, alice, "correct horse")
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	passwordStep := func() *http.Cookie {
+		t.Helper()
+		w := passwordLogin(app, "alice@example.com", "correct horse")
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login/2fa" {
+			t.Fatalf("password step: status %d location %q", w.Code, w.Header().Get("Location"))
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == pendingLoginCookie {
+				return c
+			}
+		}
+		t.Fatal("pending login cookie not set")
+		return nil
+	}
+	totpStep := func(pending *http.Cookie, code string) int {
+		r := formRequest("/login/2fa", url.Values{"code": {code}})
+		r.AddCookie(pending)
+		w := httptest.NewRecorder()
+		app.twoFactorLoginHandler(w, r)
+		return w.Code
+	}
+
+	pending := passwordStep()
+	for i := 0; i < loginBackoffThreshold-1; i++ {
+		if status := totpStep(pending, wrong); status != http.StatusOK {
+			t.Fatalf("wrong code %d: status %d", i+1, status)
+		}
+	}
+	ageLoginEvents(t, app, 10*time.Second)
+	pending = passwordStep()
+	if status := totpStep(pending, wrong); status != http.StatusOK {
+		t.Fatalf("third wrong code: status %d", status)
+	}
+
+	if status := totpStep(pending, code); status != http.StatusTooManyRequests {
+		t.Fatalf("code after failures: status %d, want 429", status)
+	}
+	if w := passwordLogin(app, "alice@example.com", "correct horse"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("password after code failures: status %d, want 429", w.Code)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// メール送信用インターフェース
+type Mailer interface {
+	Send(msg Message) error
+}
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// SMTP経由でメール送信
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	addr := net.JoinHostPort(m.Host, m.Port)
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	if err := smtp.SendMail(addr, auth, m.envelopeFrom(), []string{msg.To}, m.format(msg)); err != nil {
+		return fmt.Errorf("send mail to %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+// ヘッダーと本文を組み立てる（件名は日本語を含むため MIME エンコードする）
+func (m *SMTPMailer) format(msg Message) []byte {
+	headers := []string{
+		"From: " + m.From,
+		"To: " + msg.To,
+		"Subject: " + mime.BEncoding.Encode("UTF-8", msg.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: " + m.messageID(),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + msg.Body)
+}
+
+// MAIL FROM に使うアドレス（From が "名前 <アドレス>" 形式の場合はアドレス部分）
+func (m *SMTPMailer) envelopeFrom() string {
+	if addr, err := mail.ParseAddress(m.From); err == nil {
+		return addr.Address
+	}
+	return m.From
+}
+
+// 送信元アドレスのドメインで一意な Message-ID を生成
+func (m *SMTPMailer) messageID() string {
+	domain := m.Host
+	if addr, err := mail.ParseAddress(m.From); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+			domain = addr.Address[i+1:]
+		}
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), randomToken(12), domain)
+}
+
+// 送信内容をメモリに保持（テスト用）
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// SMTP未設定時（開発環境のみ）は宛先と件名だけをログ出力
+// 本文には確認やパスワード再設定のリンクが含まれるため記録しない
+type LogMailer struct{}
+
+func (LogMailer) Send(msg Message) error {
+	log.Printf("メール送信 to=%s subject=%s（SMTP未設定のため本文は省略、%dバイト）", msg.To, msg.Subject, len(msg.Body))
+	return nil
+}
+
+// 設定からMailerを生成
+func newMailer(cfg SMTPConfig) Mailer {
+	if cfg.Host == "" {
+		return LogMailer{}
+	}
+
+	return &SMTPMailer{
+		Host:     cfg.Host,
+		Port:     cfg.Port,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		From:     cfg.From,
+	}
+}
\ No newline at end of file
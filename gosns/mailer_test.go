@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSMTPMailerFormat(t *testing.T) {
+	m := &SMTPMailer{Host: "smtp.example.com", From: "GoSNS <noreply@gosns.example>"}
+	raw := m.format(Message{To: "alice@example.com", Subject: "【GoSNS】メールアドレスの確認", Body: "本文\n"})
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "【GoSNS】メールアドレスの確認" {
+		t.Errorf("subject = %q", subject)
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date header: %v", err)
+	}
+	id := msg.Header.Get("Message-ID")
+	if len(id) < 3 || id[0] != '<' || !bytes.HasSuffix([]byte(id), []byte("@gosns.example>")) {
+		t.Errorf("Message-ID = %q", id)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if string(body) != "本文\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+// 1通だけ受け付けるSMTPサーバーのスタンドイン
+type fakeSMTP struct {
+	addr string
+	done chan struct{}
+
+	from string
+	to   []string
+	data []byte
+	err  error
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeSMTP{addr: ln.Addr().String(), done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		conn, err := ln.Accept()
+		if err != nil {
+			f.err = err
+			return
+		}
+		defer conn.Close()
+		f.err = f.serve(textproto.NewConn(conn))
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(c *textproto.Conn) error {
+	if err := c.PrintfLine("220 localhost ESMTP"); err != nil {
+		return err
+	}
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return err
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "MAIL":
+			f.from = strings.TrimSuffix(strings.TrimPrefix(line, "MAIL FROM:<"), ">")
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			f.to = append(f.to, strings.TrimSuffix(strings.TrimPrefix(line, "RCPT TO:<"), ">"))
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			if f.data, err = c.ReadDotBytes(); err != nil {
+				return err
+			}
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return nil
+		default:
+			c.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	srv := newFakeSMTP(t)
+	host, port, _ := net.SplitHostPort(srv.addr)
+	m := &SMTPMailer{Host: host, Port: port, From: "GoSNS <noreply@gosns.example>"}
+
+	body := "リンク: http://localhost/verify?token=abc\n.先頭のドット\n"
+	if err := m.Send(Message{To: "alice@example.com", Subject: "【GoSNS】確認", Body: body}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	<-srv.done
+	if srv.err != nil {
+		t.Fatal(srv.err)
+	}
+
+	if srv.from != "noreply@gosns.example" {
+		t.Errorf("MAIL FROM = %q", srv.from)
+	}
+	if len(srv.to) != 1 || srv.to[0] != "alice@example.com" {
+		t.Errorf("RCPT TO = %q", srv.to)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(srv.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"From":         "GoSNS <noreply@gosns.example>",
+		"To":           "alice@example.com",
+		"MIME-Version": "1.0",
+		"Content-Type": "text/plain; charset=UTF-8",
+	} {
+		if got := msg.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "【GoSNS】確認" {
+		t.Errorf("subject = %q", subject)
+	}
+	got, _ := io.ReadAll(msg.Body)
+	if strings.ReplaceAll(string(got), "\r\n", "\n") != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+}
+
+func TestLogMailerOmitsBody(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	LogMailer{}.Send(Message{To: "alice@example.com", Subject: "件名", Body: "http://localhost/password/reset?token=secret-token"})
+	if strings.Contains(buf.String(), "secret-token") {
+		t.Fatalf("body logged: %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), "alice@example.com") {
+		t.Fatalf("recipient not logged: %q", buf.String())
+	}
+}
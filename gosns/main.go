@@ -4,22 +4,31 @@ import (
 	"database/sql"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
-	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type App struct {
-	db       *Database
-	store    *sessions.CookieStore
-	templates *template.Template
+	config      *Config
+	db          *Database
+	store       *sessions.CookieStore
+	templates   map[string]*template.Template
+	mailer      Mailer
+	challenges  *challengeStore
+	bcryptSlots chan struct{}
+	providers   map[string]*OIDCProvider
+	media       MediaStore
+	video       *videoProcessor
+	stream      *streamHub
 }
 
 type PageData struct {
@@ -35,16 +44,75 @@ type PageData struct {
 	IsOwnProfile      bool
 	IsFollowing       bool
 	SuggestedUsers    []User
+	Thread            *Thread
+	Quote             *Post
+	Tag               string
+	TrendingTags      []TrendingTag
+	PrevPage          int
+	NextPage          int
+	Notifications     []Notification
+	NextCursor        int
+	UnreadCount       int
+	NotificationPrefs []NotificationSetting
 	Error             string
+	Message           string
+	Token             string
+	TOTPSecret        string
+	TOTPURI           string
+	RecoveryCodes     []string
+	Credentials       []Credential
+	Sessions          []Session
+	LoginHistory      []LoginEvent
+	Providers         []ProviderInfo
+	Identities        []Identity
+	Identity          *Identity
+	AccessTokens      []AccessToken
+	Scopes            []string
+	ExpiryDays        []int
+	OAuthRequest      *AuthorizeRequest
+	OAuthClients      []OAuthClient
+	AuthorizedApps    []AuthorizedApp
+	CSRFToken         string
 }
 
 func main() {
+	// サブコマンド
+	if len(os.Args) > 1 && os.Args[1] == "migrate-media" {
+		if err := runMigrateMedia(os.Args[2:]); err != nil {
+			log.Fatal("メディア移行エラー: ", err)
+		}
+		return
+	}
+
+	// 設定読み込み
+	config, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal("設定エラー:\n", err)
+	}
+	jwtSecret = []byte(config.JWTSecret)
+	baseURL = config.BaseURL
+
 	app := &App{
-		store: sessions.NewCookieStore([]byte("your-session-secret-change-this")),
+		config:      config,
+		store:       sessions.NewCookieStore([]byte(config.SessionSecret)),
+		mailer:      newMailer(config.SMTP),
+		challenges:  newChallengeStore(),
+		bcryptSlots: make(chan struct{}, runtime.NumCPU()),
+		providers:   loadOIDCProviders(config.OIDC),
+		stream:      newStreamHub(),
+	}
+
+	if err := os.MkdirAll(config.UploadDir, 0755); err != nil {
+		log.Fatal("アップロードディレクトリ作成エラー:", err)
+	}
+	app.media, err = newMediaStore(config)
+	if err != nil {
+		log.Fatal("メディア保存先の設定エラー:", err)
 	}
+	app.video = newVideoProcessor(config.Video)
 
 	// データベース初期化
-	db, err := sql.Open("sqlite3", "./gosns.db")
+	db, err := sql.Open("sqlite3", config.DatabasePath)
 	if err != nil {
 		log.Fatal("データベース接続エラー:", err)
 	}
@@ -54,61 +122,126 @@ func main() {
 	if err := app.db.CreateTables(); err != nil {
 		log.Fatal("テーブル作成エラー:", err)
 	}
+	app.startVideoWorker()
 
 	// テンプレート読み込み
-	app.templates = template.Must(template.ParseGlob("templates/*.html"))
+	app.templates = loadTemplates("templates")
 
-	// ルーター設定
+	// サーバー起動
+	fmt.Printf("サーバーを起動中... %s (%s)\n", config.BaseURL, config.Env)
+	log.Fatal(http.ListenAndServe(config.ListenAddr, app.routes()))
+}
+
+// ルーター設定
+func (app *App) routes() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(limitRequestBody)
+	r.Use(app.csrfMiddleware)
 
 	// 静的ファイル
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
-	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads/"))))
+	if app.config.Storage.Backend == storageLocal && !app.config.Storage.private() {
+		r.PathPrefix("/uploads/").Handler(uploadHeaders(http.StripPrefix("/uploads/", http.FileServer(http.Dir(app.config.UploadDir)))))
+	}
+	r.Handle("/media/{key}", uploadHeaders(http.HandlerFunc(app.signedMediaHandler))).Methods("GET")
 
 	// 認証不要ページ
 	r.HandleFunc("/", app.homeHandler).Methods("GET")
+	r.HandleFunc("/posts/{id:[0-9]+}", app.threadHandler).Methods("GET")
+	r.HandleFunc("/tags/{tag}", app.tagHandler).Methods("GET")
 	r.HandleFunc("/login", app.loginHandler).Methods("GET", "POST")
 	r.HandleFunc("/register", app.registerHandler).Methods("GET", "POST")
-	r.HandleFunc("/auth/google", app.googleOAuthHandler).Methods("GET")
-	r.HandleFunc("/auth/google/callback", app.googleCallbackHandler).Methods("GET")
+	r.HandleFunc("/verify", app.verifyEmailHandler).Methods("GET")
+	r.HandleFunc("/password/forgot", app.forgotPasswordHandler).Methods("GET", "POST")
+	r.HandleFunc("/password/reset", app.resetPasswordHandler).Methods("GET", "POST")
+	r.HandleFunc("/login/2fa", app.twoFactorLoginHandler).Methods("GET", "POST")
+	r.HandleFunc("/login/link", app.linkConfirmHandler).Methods("GET", "POST")
+	r.HandleFunc("/webauthn/login/begin", app.beginPasskeyLoginAPI).Methods("POST")
+	r.HandleFunc("/webauthn/login/finish", app.finishPasskeyLoginAPI).Methods("POST")
+	r.HandleFunc("/auth/refresh", app.refreshTokenAPI).Methods("POST")
+	r.HandleFunc("/oauth/authorize", app.oauthAuthorizeHandler).Methods("GET", "POST")
+	r.HandleFunc("/oauth/token", app.oauthTokenHandler).Methods("POST")
+	r.HandleFunc("/oauth/revoke", app.oauthRevokeHandler).Methods("POST")
+	r.HandleFunc("/auth/{provider}", app.oidcLoginHandler).Methods("GET")
+	r.HandleFunc("/auth/{provider}/callback", app.oidcCallbackHandler).Methods("GET")
 
 	// 認証必要ページ
-	r.HandleFunc("/logout", authMiddleware(app.logoutHandler)).Methods("GET")
-	r.HandleFunc("/profile", authMiddleware(app.profileHandler)).Methods("GET")
-	r.HandleFunc("/profile/{username}", authMiddleware(app.userProfileHandler)).Methods("GET")
-	r.HandleFunc("/profile/update", authMiddleware(app.updateProfileHandler)).Methods("POST")
-	r.HandleFunc("/posts", authMiddleware(app.createPostHandler)).Methods("POST")
+	r.HandleFunc("/logout", app.authMiddleware(app.logoutHandler)).Methods("POST")
+	r.HandleFunc("/logout/all", app.authMiddleware(app.logoutAllHandler)).Methods("POST")
+	r.HandleFunc("/profile", app.authMiddleware(app.profileHandler)).Methods("GET")
+	r.HandleFunc("/profile/{username}", app.authMiddleware(app.userProfileHandler)).Methods("GET")
+	r.HandleFunc("/profile/update", app.authMiddleware(app.updateProfileHandler)).Methods("POST")
+	r.HandleFunc("/posts", app.authMiddleware(app.requireVerified(app.createPostHandler))).Methods("POST")
+	r.HandleFunc("/verify/resend", app.authMiddleware(app.resendVerificationHandler)).Methods("POST")
+	r.HandleFunc("/notifications", app.authMiddleware(app.notificationsHandler)).Methods("GET")
+	r.HandleFunc("/settings/notifications", app.authMiddleware(app.notificationSettingsHandler)).Methods("GET")
+	r.HandleFunc("/settings/notifications", app.authMiddleware(app.updateNotificationSettingsHandler)).Methods("POST")
+	r.HandleFunc("/settings/2fa", app.authMiddleware(app.twoFactorSettingsHandler)).Methods("GET")
+	r.HandleFunc("/settings/2fa/enable", app.authMiddleware(app.enableTwoFactorHandler)).Methods("POST")
+	r.HandleFunc("/settings/2fa/disable", app.authMiddleware(app.disableTwoFactorHandler)).Methods("POST")
+	r.HandleFunc("/settings/2fa/recovery-codes", app.authMiddleware(app.regenerateRecoveryCodesHandler)).Methods("POST")
+	r.HandleFunc("/settings/devices", app.authMiddleware(app.devicesHandler)).Methods("GET")
+	r.HandleFunc("/settings/devices/{id}/revoke", app.authMiddleware(app.revokeDeviceHandler)).Methods("POST")
+	r.HandleFunc("/settings/passkeys", app.authMiddleware(app.passkeysHandler)).Methods("GET")
+	r.HandleFunc("/settings/passkeys/{id}/delete", app.authMiddleware(app.deletePasskeyHandler)).Methods("POST")
+	r.HandleFunc("/settings/connections", app.authMiddleware(app.connectionsHandler)).Methods("GET")
+	r.HandleFunc("/settings/connections/{provider}/link", app.authMiddleware(app.linkProviderHandler)).Methods("POST")
+	r.HandleFunc("/settings/connections/{provider}/unlink", app.authMiddleware(app.unlinkProviderHandler)).Methods("POST")
+	r.HandleFunc("/settings/tokens", app.authMiddleware(app.accessTokensHandler)).Methods("GET")
+	r.HandleFunc("/settings/tokens", app.authMiddleware(app.createAccessTokenHandler)).Methods("POST")
+	r.HandleFunc("/settings/tokens/{id}/delete", app.authMiddleware(app.deleteAccessTokenHandler)).Methods("POST")
+	r.HandleFunc("/settings/apps", app.authMiddleware(app.oauthAppsHandler)).Methods("GET")
+	r.HandleFunc("/settings/apps", app.authMiddleware(app.createOAuthClientHandler)).Methods("POST")
+	r.HandleFunc("/settings/apps/{client_id}/delete", app.authMiddleware(app.deleteOAuthClientHandler)).Methods("POST")
+	r.HandleFunc("/settings/apps/{client_id}/revoke", app.authMiddleware(app.revokeAuthorizedAppHandler)).Methods("POST")
+	r.HandleFunc("/webauthn/register/begin", app.authMiddleware(app.beginPasskeyRegistrationAPI)).Methods("POST")
+	r.HandleFunc("/webauthn/register/finish", app.authMiddleware(app.finishPasskeyRegistrationAPI)).Methods("POST")
 
 	// API エンドポイント
 	api := r.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/posts", authMiddleware(app.getPostsAPI)).Methods("GET")
-	api.HandleFunc("/posts/{id}/like", authMiddleware(app.likePostAPI)).Methods("POST")
-	api.HandleFunc("/posts/{id}/comments", authMiddleware(app.getCommentsAPI)).Methods("GET")
-	api.HandleFunc("/posts/{id}/comments", authMiddleware(app.createCommentAPI)).Methods("POST")
-	api.HandleFunc("/posts/{id}", authMiddleware(app.deletePostAPI)).Methods("DELETE")
-	api.HandleFunc("/users/{id}/follow", authMiddleware(app.followUserAPI)).Methods("POST")
-
-	// サーバー起動
-	fmt.Println("サーバーを起動中... http://podd.win:9090")
-	log.Fatal(http.ListenAndServe(":9090", r))
+	api.HandleFunc("/posts", app.authMiddleware(app.requireScope(scopeRead, app.getPostsAPI))).Methods("GET")
+	api.HandleFunc("/posts/{id}/like", app.authMiddleware(app.requireScope(scopeWrite, app.likePostAPI))).Methods("POST")
+	api.HandleFunc("/posts/{id}/repost", app.authMiddleware(app.requireScope(scopeWrite, app.repostPostAPI))).Methods("POST")
+	api.HandleFunc("/posts/{id}/comments", app.authMiddleware(app.requireScope(scopeRead, app.getCommentsAPI))).Methods("GET")
+	api.HandleFunc("/posts/{id}/comments", app.authMiddleware(app.requireScope(scopeWrite, app.requireVerified(app.createCommentAPI)))).Methods("POST")
+	api.HandleFunc("/posts/{id}", app.authMiddleware(app.requireScope(scopeWrite, app.deletePostAPI))).Methods("DELETE")
+	api.HandleFunc("/posts/{id}", app.authMiddleware(app.requireScope(scopeWrite, app.updatePostAPI))).Methods("PATCH")
+	api.HandleFunc("/posts/{id}/revisions", app.authMiddleware(app.requireScope(scopeRead, app.getPostRevisionsAPI))).Methods("GET")
+	api.HandleFunc("/posts/{id}/thread", app.authMiddleware(app.requireScope(scopeRead, app.getThreadAPI))).Methods("GET")
+	api.HandleFunc("/tags/{tag}/posts", app.authMiddleware(app.requireScope(scopeRead, app.getTagPostsAPI))).Methods("GET")
+	api.HandleFunc("/media/{id}", app.authMiddleware(app.requireScope(scopeRead, app.getMediaAPI))).Methods("GET")
+	api.HandleFunc("/users/{id}/follow", app.authMiddleware(app.requireScope(scopeFollow, app.followUserAPI))).Methods("POST")
+	api.HandleFunc("/notifications", app.authMiddleware(app.requireScope(scopeRead, app.getNotificationsAPI))).Methods("GET")
+	api.HandleFunc("/notifications/read", app.authMiddleware(app.requireScope(scopeWrite, app.readNotificationsAPI))).Methods("POST")
+	api.HandleFunc("/stream", app.authMiddleware(app.requireScope(scopeRead, app.streamAPI))).Methods("GET")
+	api.HandleFunc("/sessions", app.authMiddleware(app.requireScope(scopeAdmin, app.getSessionsAPI))).Methods("GET")
+	api.HandleFunc("/sessions/{id}", app.authMiddleware(app.requireScope(scopeAdmin, app.revokeSessionAPI))).Methods("DELETE")
+
+	return r
 }
 
 func (app *App) homeHandler(w http.ResponseWriter, r *http.Request) {
+	// 認証状態確認
+	userID := app.getCurrentUserID(w, r)
+	app.renderHome(w, r, userID, "")
+}
+
+func (app *App) renderHome(w http.ResponseWriter, r *http.Request, userID int, errMsg string) {
 	data := PageData{
 		Title: "ホーム",
+		Error: errMsg,
 	}
 
-	// 認証状態確認
-	userID := app.getCurrentUserID(r)
 	if userID > 0 {
 		data.IsAuthenticated = true
 		data.CurrentUserID = userID
 		
 		// 現在のユーザー情報取得
 		var user User
-		err := app.db.QueryRow("SELECT id, username, email, avatar, bio FROM users WHERE id = ?", userID).
-			Scan(&user.ID, &user.Username, &user.Email, &user.Avatar, &user.Bio)
+		err := app.db.QueryRow("SELECT id, username, email, avatar, bio, verified FROM users WHERE id = ?", userID).
+			Scan(&user.ID, &user.Username, &user.Email, &user.Avatar, &user.Bio, &user.Verified)
 		if err == nil {
+			user.Avatar = app.mediaURL(user.Avatar)
 			data.CurrentUser = &user
 		}
 
@@ -117,18 +250,26 @@ func (app *App) homeHandler(w http.ResponseWriter, r *http.Request) {
 
 		// おすすめユーザー取得
 		data.SuggestedUsers = app.getSuggestedUsers(userID, 5)
+
+		// 引用して投稿する場合は引用元を表示
+		if quoteOf, err := formPostID(r, "quote_of"); err == nil && quoteOf != 0 {
+			data.Quote = app.getPost(quoteOf)
+		}
 	} else {
 		// 未認証の場合は全体の最新投稿を表示
 		data.Posts = app.getLatestPosts(20)
 	}
 
-	app.renderTemplate(w, "home", data)
+	// トレンドのハッシュタグ
+	data.TrendingTags = app.getTrendingTags(5)
+
+	app.renderTemplate(w, r, "home", data)
 }
 
 func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		data := PageData{Title: "ログイン"}
-		app.renderTemplate(w, "login", data)
+		data := PageData{Title: "ログイン", Providers: app.providerInfos()}
+		app.renderTemplate(w, r, "login", data)
 		return
 	}
 
@@ -138,40 +279,47 @@ func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 	var user User
 	err := app.db.QueryRow("SELECT id, username, password FROM users WHERE email = ?", email).
 		Scan(&user.ID, &user.Username, &user.Password)
-	
-	if err != nil || !checkPasswordHash(password, user.Password) {
+
+	// 失敗が続いている場合はbcryptを実行する前に拒否
+	if wait := app.loginRetryAfter(r, user.ID, email); wait > 0 {
+		setRetryAfter(w, wait)
 		data := PageData{
-			Title: "ログイン",
-			Error: "メールアドレスまたはパスワードが正しくありません",
+			Title:     "ログイン",
+			Providers: app.providerInfos(),
+			Error: "ログインの試行回数が多すぎます。しばらく時間をおいてから再度お試しください",
 		}
-		app.renderTemplate(w, "login", data)
+		app.renderTemplate(w, r, "login", data)
 		return
 	}
 
-	// JWT生成
-	token, err := generateJWT(user.ID, user.Username)
-	if err != nil {
-		http.Error(w, "ログインに失敗しました", http.StatusInternalServerError)
+	valid := false
+	if err == nil {
+		valid, err = app.comparePassword(password, user.Password)
+		if err == errBcryptBusy {
+			http.Error(w, "サーバーが混雑しています。しばらくしてから再度お試しください", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	
+	if !valid {
+		app.recordLoginFailure(r, user.ID, email, loginMethodPassword)
+		data := PageData{
+			Title:     "ログイン",
+			Providers: app.providerInfos(),
+			Error: "メールアドレスまたはパスワードが正しくありません",
+		}
+		app.renderTemplate(w, r, "login", data)
 		return
 	}
 
-	// Cookieに保存
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		HttpOnly: true,
-		Secure:   false,
-		MaxAge:   86400,
-		Path:     "/",
-	})
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	app.recordLogin(r, user.ID, email, loginMethodPassword, true)
+	app.completeLogin(w, r, user.ID, user.Username)
 }
 
 func (app *App) registerHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		data := PageData{Title: "新規登録"}
-		app.renderTemplate(w, "register", data)
+		data := PageData{Title: "新規登録", Providers: app.providerInfos()}
+		app.renderTemplate(w, r, "register", data)
 		return
 	}
 
@@ -182,15 +330,16 @@ func (app *App) registerHandler(w http.ResponseWriter, r *http.Request) {
 
 	if password != confirmPassword {
 		data := PageData{
-			Title: "新規登録",
+			Title:     "新規登録",
+			Providers: app.providerInfos(),
 			Error: "パスワードが一致しません",
 		}
-		app.renderTemplate(w, "register", data)
+		app.renderTemplate(w, r, "register", data)
 		return
 	}
 
 	// パスワードハッシュ化
-	hashedPassword, err := hashPassword(password)
+	hashedPassword, err := app.hashPasswordLimited(password)
 	if err != nil {
 		http.Error(w, "登録に失敗しました", http.StatusInternalServerError)
 		return
@@ -201,10 +350,11 @@ func (app *App) registerHandler(w http.ResponseWriter, r *http.Request) {
 		username, email, hashedPassword)
 	if err != nil {
 		data := PageData{
-			Title: "新規登録",
+			Title:     "新規登録",
+			Providers: app.providerInfos(),
 			Error: "そのユーザー名またはメールアドレスは既に使用されています",
 		}
-		app.renderTemplate(w, "register", data)
+		app.renderTemplate(w, r, "register", data)
 		return
 	}
 
@@ -216,35 +366,24 @@ func (app *App) registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// JWT生成
-	token, err := generateJWT(userID, username)
-	if err != nil {
+	// 確認メール送信（失敗しても登録は継続し、再送信で対応）
+	if err := app.sendVerificationEmail(userID, email); err != nil {
+		log.Println("認証メール送信エラー:", err)
+	}
+
+	if err := app.startSession(w, r, userID, username); err != nil {
 		http.Error(w, "ログインに失敗しました", http.StatusInternalServerError)
 		return
 	}
 
-	// Cookieに保存
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		HttpOnly: true,
-		Secure:   false,
-		MaxAge:   86400,
-		Path:     "/",
-	})
-
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (app *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    "",
-		HttpOnly: true,
-		Secure:   false,
-		MaxAge:   -1,
-		Path:     "/",
-	})
+	sessionID := r.Context().Value("session_id").(string)
+	app.revokeSession(sessionID)
+
+	clearSessionCookies(w)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
@@ -258,7 +397,10 @@ func (app *App) userProfileHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
 	currentUserID := r.Context().Value("user_id").(int)
+	app.renderProfile(w, r, username, currentUserID, "")
+}
 
+func (app *App) renderProfile(w http.ResponseWriter, r *http.Request, username string, currentUserID int, errMsg string) {
 	// ユーザー情報取得
 	var user User
 	err := app.db.QueryRow("SELECT id, username, email, avatar, bio, created_at FROM users WHERE username = ?", username).
@@ -268,10 +410,11 @@ func (app *App) userProfileHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "ユーザーが見つかりません", http.StatusNotFound)
 		return
 	}
+	user.Avatar = app.mediaURL(user.Avatar)
 
 	// 統計情報取得
 	var postCount, followerCount, followingCount int
-	app.db.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = ?", user.ID).Scan(&postCount)
+	app.db.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = ? AND in_reply_to IS NULL", user.ID).Scan(&postCount)
 	app.db.QueryRow("SELECT COUNT(*) FROM follows WHERE following_id = ?", user.ID).Scan(&followerCount)
 	app.db.QueryRow("SELECT COUNT(*) FROM follows WHERE follower_id = ?", user.ID).Scan(&followingCount)
 
@@ -298,43 +441,38 @@ func (app *App) userProfileHandler(w http.ResponseWriter, r *http.Request) {
 		FollowingCount: followingCount,
 		IsOwnProfile:   currentUserID == user.ID,
 		IsFollowing:    isFollowing,
+		Error:          errMsg,
 	}
 
-	app.renderTemplate(w, "profile", data)
+	app.renderTemplate(w, r, "profile", data)
 }
 
 func (app *App) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(int)
+	username := r.Context().Value("username").(string)
 	bio := r.FormValue("bio")
 
 	// ファイルアップロード処理
-	file, header, err := r.FormFile("avatar")
-	avatarURL := ""
-	if err == nil {
-		defer file.Close()
-		
-		// ファイル保存
-		filename := fmt.Sprintf("%d_%s", userID, header.Filename)
-		filePath := filepath.Join("uploads", filename)
-		
-		dst, err := os.Create(filePath)
-		if err == nil {
-			defer dst.Close()
-			io.Copy(dst, file)
-			avatarURL = "/uploads/" + filename
-		}
+	avatar, err := app.saveUploadedImage(r, "avatar", maxAvatarSize, avatarImageVariants)
+	if err != nil {
+		log.Println("アバター画像アップロードエラー:", err)
+		w.WriteHeader(uploadErrorStatus(err))
+		app.renderProfile(w, r, username, userID, uploadErrorMessage(err))
+		return
 	}
 
 	// プロフィール更新
-	if avatarURL != "" {
+	if avatar != nil {
+		var oldAvatar string
+		app.db.QueryRow("SELECT avatar FROM users WHERE id = ?", userID).Scan(&oldAvatar)
 		app.db.Exec("UPDATE users SET bio = ?, avatar = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", 
-			bio, avatarURL, userID)
+			bio, avatar.refs["avatar"], userID)
+		app.deleteMedia(r.Context(), oldAvatar)
 	} else {
 		app.db.Exec("UPDATE users SET bio = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", 
 			bio, userID)
 	}
 
-	username := r.Context().Value("username").(string)
 	http.Redirect(w, r, "/profile/"+username, http.StatusSeeOther)
 }
 
@@ -342,55 +480,102 @@ func (app *App) createPostHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("user_id").(int)
 	content := r.FormValue("content")
 
-	// 画像アップロード処理
-	file, header, err := r.FormFile("image")
-	imageURL := ""
-	if err == nil {
-		defer file.Close()
-		
-		// ファイル保存
-		filename := fmt.Sprintf("%d_%s_%s", userID, uuid.New().String(), header.Filename)
-		filePath := filepath.Join("uploads", filename)
-		
-		dst, err := os.Create(filePath)
-		if err == nil {
-			defer dst.Close()
-			io.Copy(dst, file)
-			imageURL = "/uploads/" + filename
+	// スレッドページからの返信・引用投稿
+	replyTo, err1 := formPostID(r, "in_reply_to")
+	quoteOf, err2 := formPostID(r, "quote_of")
+	if err1 != nil || err2 != nil {
+		http.Error(w, "投稿が見つかりません", http.StatusNotFound)
+		return
+	}
+
+	// 添付ファイルの保存（画像4枚まで、または動画1本）
+	att, err := app.savePostMedia(r)
+	if err != nil {
+		log.Println("画像アップロードエラー:", err)
+		w.WriteHeader(uploadErrorStatus(err))
+		if replyTo != 0 {
+			app.renderThread(w, r, replyTo, userID, uploadErrorMessage(err))
+			return
 		}
+		app.renderHome(w, r, userID, uploadErrorMessage(err))
+		return
 	}
 
-	// 投稿作成
-	_, err = app.db.Exec("INSERT INTO posts (user_id, content, image_url) VALUES (?, ?, ?)",
-		userID, content, imageURL)
+	// 投稿と添付ファイルをまとめて作成
+	postID, err := app.createPost(userID, content, postRefs{replyTo: replyTo, quoteOf: quoteOf}, att)
 	if err != nil {
+		app.deletePostAttachments(r.Context(), att)
+		if err == errPostNotFound {
+			http.Error(w, "投稿が見つかりません", http.StatusNotFound)
+			return
+		}
+		log.Println("投稿作成エラー:", err)
 		http.Error(w, "投稿に失敗しました", http.StatusInternalServerError)
 		return
 	}
 
+	if replyTo != 0 {
+		http.Redirect(w, r, fmt.Sprintf("/posts/%d#post-%d", replyTo, postID), http.StatusSeeOther)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func (app *App) getCurrentUserID(r *http.Request) int {
-	tokenString := ""
-	if cookie, err := r.Cookie("token"); err == nil {
-		tokenString = cookie.Value
+// フォームで指定された投稿ID（未指定の場合は 0）
+func formPostID(r *http.Request, field string) (int, error) {
+	v := r.FormValue(field)
+	if v == "" {
+		return 0, nil
 	}
+	return strconv.Atoi(v)
+}
 
-	if tokenString == "" {
+func (app *App) getCurrentUserID(w http.ResponseWriter, r *http.Request) int {
+	claims, err := app.authenticate(w, r)
+	if err != nil {
 		return 0
 	}
 
-	claims, err := validateJWT(tokenString)
+	return claims.UserID
+}
+
+// レイアウトと各ページを組み合わせてテンプレートを読み込む
+func loadTemplates(dir string) map[string]*template.Template {
+	pages, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		log.Fatal("テンプレート読み込みエラー:", err)
+	}
+
+	// 複数のページで使う部品
+	partials, err := filepath.Glob(filepath.Join(dir, "partials", "*.html"))
 	if err != nil {
-		return 0
+		log.Fatal("テンプレート読み込みエラー:", err)
 	}
 
-	return claims.UserID
+	layout := filepath.Join(dir, "layout.html")
+	templates := make(map[string]*template.Template)
+	for _, page := range pages {
+		if page == layout {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(page), ".html")
+		files := append([]string{layout, page}, partials...)
+		templates[name] = template.Must(template.ParseFiles(files...))
+	}
+	return templates
 }
 
-func (app *App) renderTemplate(w http.ResponseWriter, name string, data PageData) {
-	err := app.templates.ExecuteTemplate(w, "layout.html", data)
+func (app *App) renderTemplate(w http.ResponseWriter, r *http.Request, name string, data PageData) {
+	tmpl, ok := app.templates[name]
+	if !ok {
+		http.Error(w, "template not found: "+name, http.StatusInternalServerError)
+		return
+	}
+	data.CSRFToken = csrfToken(r)
+	if data.IsAuthenticated {
+		data.UnreadCount = app.countUnreadNotifications(data.CurrentUserID)
+	}
+	err := tmpl.ExecuteTemplate(w, "layout.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
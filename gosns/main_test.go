@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// 一時ディレクトリのDBとメモリ上のメーラーを使うテスト用のアプリ
+func newTestApp(t *testing.T) (*App, *MemoryMailer) {
+	t.Helper()
+
+	jwtSecret = []byte("test-secret")
+	baseURL = "http://localhost:8080"
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mailer := &MemoryMailer{}
+	app := &App{
+		config:      &Config{},
+		db:          &Database{db},
+		store:       sessions.NewCookieStore([]byte("test-session-secret")),
+		templates:   loadTemplates("templates"),
+		mailer:      mailer,
+		challenges:  newChallengeStore(),
+		bcryptSlots: make(chan struct{}, runtime.NumCPU()),
+		providers:   map[string]*OIDCProvider{},
+		stream:      newStreamHub(),
+	}
+	if err := app.db.CreateTables(); err != nil {
+		t.Fatal(err)
+	}
+	return app, mailer
+}
+
+// テスト用のユーザーを作成してIDを返す
+func createTestUser(t *testing.T, app *App, username string, verified bool) int {
+	t.Helper()
+
+	res, err := app.db.Exec("INSERT INTO users (username, email, password, verified) VALUES (?, ?, '', ?)",
+		username, username+"@example.com", verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(id)
+}
+
+// authMiddleware を通過したあとのリクエストにする
+func withUser(r *http.Request, userID int) *http.Request {
+	ctx := context.WithValue(r.Context(), "user_id", userID)
+	ctx = context.WithValue(ctx, "username", "")
+	ctx = context.WithValue(ctx, "session_id", "")
+	return r.WithContext(ctx)
+}
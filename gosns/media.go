@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DBにはメディアを "/uploads/<key>" の形で保存し、表示時に保存先のURLへ変換する
+const mediaRefPrefix = "/uploads/"
+
+// 非公開メディアの署名付きURLの有効期間
+// ブラウザのキャッシュが効くよう、署名時刻を mediaURLWindow 単位で丸める
+const (
+	signedMediaURLTTL = time.Hour
+	mediaURLWindow    = 10 * time.Minute
+)
+
+var (
+	errMediaNotFound   = errors.New("media not found")
+	errInvalidMediaKey = errors.New("invalid media key")
+)
+
+// メディアファイルの保存先
+type MediaStore interface {
+	Put(ctx context.Context, key string, data io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// 配信用URL（ttl > 0 の場合は期限付きの署名付きURL）
+	URL(key string, ttl time.Duration) string
+}
+
+// 設定に応じた保存先を作成
+func newMediaStore(cfg *Config) (MediaStore, error) {
+	switch cfg.Storage.Backend {
+	case storageLocal:
+		return &LocalMediaStore{dir: cfg.UploadDir}, nil
+	case storageS3:
+		return newS3MediaStore(cfg.Storage.S3)
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", cfg.Storage.Backend)
+}
+
+// キーはサーバーで生成したファイル名のみ（ディレクトリ移動を防ぐ）
+func validMediaKey(key string) bool {
+	return key != "" && key == path.Base(key) && key != "." && key != ".." && !strings.Contains(key, "\\")
+}
+
+// 拡張子から配信時のContent-Typeを決める
+func mediaContentType(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// 保存済みの参照を配信用URLに変換（外部URLや静的ファイルはそのまま）
+func (app *App) mediaURL(ref string) string {
+	key, ok := strings.CutPrefix(ref, mediaRefPrefix)
+	if !ok || !validMediaKey(key) {
+		return ref
+	}
+	if app.config.Storage.private() {
+		return app.media.URL(key, signedMediaURLTTL)
+	}
+	return app.media.URL(key, 0)
+}
+
+// 保存済みの参照が指すメディアを削除
+func (app *App) deleteMedia(ctx context.Context, refs ...string) {
+	for _, ref := range refs {
+		key, ok := strings.CutPrefix(ref, mediaRefPrefix)
+		if !ok || !validMediaKey(key) {
+			continue
+		}
+		if err := app.media.Delete(ctx, key); err != nil {
+			log.Println("メディア削除エラー:", key, err)
+		}
+	}
+}
+
+// ローカルディスクへの保存
+type LocalMediaStore struct {
+	dir string
+}
+
+func (s *LocalMediaStore) Put(ctx context.Context, key string, data io.Reader, size int64, contentType string) error {
+	if !validMediaKey(key) {
+		return errInvalidMediaKey
+	}
+
+	// 一時ファイルに書き込んでから置き換える
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, key)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *LocalMediaStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !validMediaKey(key) {
+		return nil, errInvalidMediaKey
+	}
+	f, err := os.Open(filepath.Join(s.dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errMediaNotFound
+	}
+	return f, err
+}
+
+func (s *LocalMediaStore) Delete(ctx context.Context, key string) error {
+	if !validMediaKey(key) {
+		return errInvalidMediaKey
+	}
+	err := os.Remove(filepath.Join(s.dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalMediaStore) URL(key string, ttl time.Duration) string {
+	if ttl <= 0 {
+		return mediaRefPrefix + key
+	}
+	expires := strconv.FormatInt(time.Now().Truncate(mediaURLWindow).Add(ttl).Unix(), 10)
+	return "/media/" + key + "?expires=" + expires + "&sig=" + mediaSignature(key, expires)
+}
+
+func mediaSignature(key, expires string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("media." + key + "." + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 署名付きURLによるメディア配信
+func (app *App) signedMediaHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	expires := r.URL.Query().Get("expires")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !validMediaKey(key) || time.Now().Unix() > exp ||
+		!hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(mediaSignature(key, expires))) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	body, err := app.media.Get(r.Context(), key)
+	if err == errMediaNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println("メディア取得エラー:", key, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", mediaContentType(key))
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", exp-time.Now().Unix()))
+	// ローカルファイルはRangeリクエスト（動画のシーク）に対応する
+	if rs, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, time.Time{}, rs)
+		return
+	}
+	io.Copy(w, body)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// 1投稿で扱うメンションの上限（大量の通知を防ぐ）
+const maxMentionsPerPost = 10
+
+// 本文のメンションをユーザーに解決して登録し直す
+// まだ通知していないユーザー（投稿者本人を除く）には通知を作成する
+func savePostMentions(tx *sql.Tx, postID, authorID int, content string) error {
+	if _, err := tx.Exec("DELETE FROM post_mentions WHERE post_id = ?", postID); err != nil {
+		return err
+	}
+
+	names := extractMentions(content)
+	if len(names) > maxMentionsPerPost {
+		names = names[:maxMentionsPerPost]
+	}
+	for _, name := range names {
+		// 大文字・小文字が違うだけのユーザー名は完全に一致する方を優先する
+		var userID int
+		err := tx.QueryRow(`SELECT id FROM users WHERE username = ? COLLATE NOCASE
+			ORDER BY username = ? DESC LIMIT 1`, name, name).Scan(&userID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("INSERT OR IGNORE INTO post_mentions (post_id, user_id) VALUES (?, ?)", postID, userID); err != nil {
+			return err
+		}
+
+		// 編集で付け直されたメンションや、返信の通知を受け取ったユーザーには通知しない
+		var notified int
+		err = tx.QueryRow(`SELECT COUNT(*) FROM notifications
+			WHERE user_id = ? AND ((type = ? AND post_id = ?) OR source_id = ?)`,
+			userID, notificationMention, postID, postID).Scan(&notified)
+		if err != nil {
+			return err
+		}
+		if notified > 0 {
+			continue
+		}
+		if err := createNotification(tx, userID, authorID, notificationMention, postID, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 投稿一覧にメンションされたユーザー名をまとめて読み込む
+func (app *App) attachPostMentions(posts []Post) {
+	if len(posts) == 0 {
+		return
+	}
+
+	index := make(map[int][]int, len(posts))
+	ids := make([]interface{}, 0, len(posts))
+	placeholders := make([]string, 0, len(posts))
+	for i := range posts {
+		if _, ok := index[posts[i].ID]; !ok {
+			ids = append(ids, posts[i].ID)
+			placeholders = append(placeholders, "?")
+		}
+		index[posts[i].ID] = append(index[posts[i].ID], i)
+	}
+
+	rows, err := app.db.Query(`SELECT m.post_id, u.username
+		FROM post_mentions m JOIN users u ON m.user_id = u.id
+		WHERE m.post_id IN (`+strings.Join(placeholders, ",")+`)`, ids...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int
+		var username string
+		if err := rows.Scan(&postID, &username); err != nil {
+			continue
+		}
+		for _, i := range index[postID] {
+			posts[i].Mentions = append(posts[i].Mentions, username)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// ローカルの uploads ディレクトリのファイルを設定済みの保存先へ移行する
+//
+//	gosns migrate-media [-config gosns.toml] [-delete-local] [-dry-run]
+//
+// DBにはメディアの参照（/uploads/<key>）を保存しているため、ファイルの移動だけで切り替えられる
+func runMigrateMedia(args []string) error {
+	fs := flag.NewFlagSet("migrate-media", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("GOSNS_CONFIG"), "設定ファイル (.toml / .yaml)")
+	deleteLocal := fs.Bool("delete-local", false, "移行に成功したファイルをローカルから削除する")
+	dryRun := fs.Bool("dry-run", false, "移行対象のファイルを表示するだけで移行しない")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var configArgs []string
+	if *configPath != "" {
+		configArgs = []string{"-config", *configPath}
+	}
+	cfg, err := loadConfig(configArgs)
+	if err != nil {
+		return err
+	}
+	jwtSecret = []byte(cfg.JWTSecret)
+
+	if cfg.Storage.Backend == storageLocal {
+		return errors.New("storage.backend が local のため移行先がありません。移行先の保存先（s3 など）を設定してください")
+	}
+	dest, err := newMediaStore(cfg)
+	if err != nil {
+		return err
+	}
+	src := &LocalMediaStore{dir: cfg.UploadDir}
+
+	entries, err := os.ReadDir(cfg.UploadDir)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var moved, failed int
+	for _, e := range entries {
+		key := e.Name()
+		if e.IsDir() || strings.HasPrefix(key, ".") || !validMediaKey(key) {
+			continue
+		}
+		if *dryRun {
+			fmt.Println(key)
+			continue
+		}
+		if err := copyMedia(ctx, src, dest, key); err != nil {
+			log.Printf("%s の移行に失敗しました: %v", key, err)
+			failed++
+			continue
+		}
+		if *deleteLocal {
+			if err := src.Delete(ctx, key); err != nil {
+				log.Printf("%s の削除に失敗しました: %v", key, err)
+			}
+		}
+		moved++
+	}
+
+	if !*dryRun {
+		fmt.Printf("%d 件のファイルを移行しました（失敗 %d 件）\n", moved, failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d 件のファイルを移行できませんでした", failed)
+	}
+	return nil
+}
+
+func copyMedia(ctx context.Context, src, dest MediaStore, key string) error {
+	body, err := src.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return dest.Put(ctx, key, bytes.NewReader(data), int64(len(data)), mediaContentType(key))
+}
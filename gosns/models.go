@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 )
 
@@ -14,21 +15,78 @@ type User struct {
 	Bio         string    `json:"bio"`
 	GoogleID    string    `json:"google_id"`
 	Verified    bool      `json:"verified"`
+	TOTPEnabled bool      `json:"totp_enabled"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 type Post struct {
+	ID            int         `json:"id"`
+	UserID        int         `json:"user_id"`
+	Username      string      `json:"username"`
+	Avatar        string      `json:"avatar"`
+	Content       string      `json:"content"`
+	Mentions      []string    `json:"mentions,omitempty"`
+	InReplyTo     int         `json:"in_reply_to,omitempty"`
+	QuoteOf       int         `json:"quote_of,omitempty"`
+	Quote         *Post       `json:"quote,omitempty"`
+	ImageURL      string      `json:"image_url"`
+	ImageFeedURL  string      `json:"image_feed_url"`
+	ImageThumbURL string      `json:"image_thumb_url"`
+	Media         []PostMedia `json:"media"`
+	Likes         int         `json:"likes"`
+	Comments      int         `json:"comments"`
+	Reposts       int         `json:"reposts"`
+	RepostedBy    string      `json:"reposted_by,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+	EditedAt      *time.Time  `json:"edited_at"`
+}
+
+type PostMedia struct {
+	ID        int     `json:"id"`
+	PostID    int     `json:"post_id"`
+	Position  int     `json:"position"`
+	Type      string  `json:"type"`
+	Status    string  `json:"status"`
+	URL       string  `json:"url"`
+	FeedURL   string  `json:"feed_url"`
+	ThumbURL  string  `json:"thumb_url"`
+	PosterURL string  `json:"poster_url"`
+	Alt       string  `json:"alt"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	Duration  float64 `json:"duration"`
+	Blurhash  string  `json:"blurhash"`
+}
+
+type PostRevision struct {
 	ID        int       `json:"id"`
-	UserID    int       `json:"user_id"`
-	Username  string    `json:"username"`
-	Avatar    string    `json:"avatar"`
+	PostID    int       `json:"post_id"`
 	Content   string    `json:"content"`
-	ImageURL  string    `json:"image_url"`
-	Likes     int       `json:"likes"`
-	Comments  int       `json:"comments"`
 	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Current   bool      `json:"current"`
+}
+
+type TrendingTag struct {
+	Tag   string  `json:"tag"`
+	Count int     `json:"count"`
+	Score float64 `json:"score"`
+}
+
+// 通知（同じ種類・同じ投稿への通知をまとめたもの）
+type Notification struct {
+	ID          int       `json:"id"`
+	Type        string    `json:"type"`
+	Actor       string    `json:"actor"`
+	ActorAvatar string    `json:"actor_avatar"`
+	ActorCount  int       `json:"actor_count"`
+	PostID      int       `json:"post_id,omitempty"`
+	Post        *Post     `json:"post,omitempty"`
+	Message     string    `json:"message"`
+	URL         string    `json:"url"`
+	Read        bool      `json:"read"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
 type Follow struct {
@@ -51,14 +109,90 @@ type Comment struct {
 	Username  string    `json:"username"`
 	Avatar    string    `json:"avatar"`
 	Content   string    `json:"content"`
+	Replies   int       `json:"replies"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Credential struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id"`
+	CredentialID string     `json:"credential_id"`
+	PublicKey    []byte     `json:"-"`
+	SignCount    uint32     `json:"sign_count"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+type LoginEvent struct {
+	ID        int       `json:"id"`
+	Method    string    `json:"method"`
+	Success   bool      `json:"success"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+type Identity struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	Provider    string    `json:"provider"`
+	Subject     string    `json:"-"`
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"created_at"`
+	DisplayName string    `json:"display_name"`
+}
+
+type AccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type OAuthClient struct {
+	ID           int       `json:"id"`
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	UserID       int       `json:"user_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type AuthorizedApp struct {
+	ClientID     string     `json:"client_id"`
+	Name         string     `json:"name"`
+	Scopes       []string   `json:"scopes"`
+	AuthorizedAt time.Time  `json:"authorized_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
 type Database struct {
 	*sql.DB
 }
 
 func (db *Database) CreateTables() error {
+	// メール確認の導入前のDBかどうか（既存ユーザーを確認済みにするため）
+	verificationMissing, err := db.tableMissing("email_verifications")
+	if err != nil {
+		return err
+	}
+
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS users (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -77,10 +211,17 @@ func (db *Database) CreateTables() error {
 			user_id INTEGER NOT NULL,
 			content TEXT NOT NULL,
 			image_url TEXT DEFAULT '',
+			image_feed_url TEXT DEFAULT '',
+			image_thumb_url TEXT DEFAULT '',
 			likes INTEGER DEFAULT 0,
 			comments INTEGER DEFAULT 0,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			edited_at DATETIME,
+			in_reply_to INTEGER,
+			root_id INTEGER,
+			quote_of INTEGER,
+			reposts INTEGER DEFAULT 0,
 			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
 		)`,
 		`CREATE TABLE IF NOT EXISTS follows (
@@ -100,6 +241,48 @@ func (db *Database) CreateTables() error {
 			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
 			FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE IF NOT EXISTS reposts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			post_id INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(user_id, post_id),
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+			FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS post_tags (
+			post_id INTEGER NOT NULL,
+			tag TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (post_id, tag),
+			FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS post_mentions (
+			post_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			PRIMARY KEY (post_id, user_id),
+			FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			actor_id INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			post_id INTEGER,
+			source_id INTEGER,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			read_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+			FOREIGN KEY (actor_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS notification_preferences (
+			user_id INTEGER NOT NULL,
+			type TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			PRIMARY KEY (user_id, type),
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
 		`CREATE TABLE IF NOT EXISTS comments (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			user_id INTEGER NOT NULL,
@@ -109,12 +292,189 @@ func (db *Database) CreateTables() error {
 			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
 			FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE IF NOT EXISTS email_verifications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			expires_at DATETIME NOT NULL,
+			used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS password_resets (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			expires_at DATETIME NOT NULL,
+			used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS credentials (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			credential_id TEXT UNIQUE NOT NULL,
+			public_key BLOB NOT NULL,
+			sign_count INTEGER NOT NULL DEFAULT 0,
+			name TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_used_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_seen_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			revoked_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS login_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER,
+			email TEXT NOT NULL DEFAULT '',
+			method TEXT NOT NULL,
+			success BOOLEAN NOT NULL,
+			ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS identities (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			email TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(provider, subject),
+			UNIQUE(user_id, provider),
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS access_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			scopes TEXT NOT NULL,
+			expires_at DATETIME,
+			last_used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS oauth_clients (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			client_id TEXT UNIQUE NOT NULL,
+			secret_hash TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL,
+			redirect_uris TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS oauth_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			code_hash TEXT UNIQUE NOT NULL,
+			client_id TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			redirect_uri TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			code_challenge TEXT NOT NULL,
+			expires_at DATETIME NOT NULL,
+			used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS oauth_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			client_id TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			code_id INTEGER,
+			scopes TEXT NOT NULL,
+			access_token_hash TEXT UNIQUE NOT NULL,
+			refresh_token_hash TEXT UNIQUE NOT NULL,
+			expires_at DATETIME NOT NULL,
+			refresh_expires_at DATETIME NOT NULL,
+			revoked_at DATETIME,
+			last_used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS oauth_used_refresh_tokens (
+			token_hash TEXT PRIMARY KEY,
+			token_id INTEGER NOT NULL,
+			used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (token_id) REFERENCES oauth_tokens (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS post_media (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			post_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			type TEXT NOT NULL DEFAULT 'image',
+			status TEXT NOT NULL DEFAULT 'ready',
+			url TEXT NOT NULL,
+			feed_url TEXT NOT NULL DEFAULT '',
+			thumb_url TEXT NOT NULL DEFAULT '',
+			poster_url TEXT NOT NULL DEFAULT '',
+			alt TEXT NOT NULL DEFAULT '',
+			width INTEGER NOT NULL DEFAULT 0,
+			height INTEGER NOT NULL DEFAULT 0,
+			duration REAL NOT NULL DEFAULT 0,
+			blurhash TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(post_id, position),
+			FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS post_revisions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			post_id INTEGER NOT NULL,
+			content TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE
+		)`,
 		`CREATE INDEX IF NOT EXISTS idx_posts_user_id ON posts(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_posts_created_at ON posts(created_at DESC)`,
 		`CREATE INDEX IF NOT EXISTS idx_follows_follower ON follows(follower_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_follows_following ON follows(following_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_likes_post ON likes(post_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_reposts_post ON reposts(post_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_reposts_user ON reposts(user_id, created_at DESC)`,
 		`CREATE INDEX IF NOT EXISTS idx_comments_post ON comments(post_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_post_tags_tag ON post_tags(tag, created_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_post_tags_created_at ON post_tags(created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_post_mentions_user ON post_mentions(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(user_id, created_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_post ON notifications(post_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_email_verifications_user ON email_verifications(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_password_resets_user ON password_resets(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_totp_recovery_codes_user ON totp_recovery_codes(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_credentials_user ON credentials(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session ON refresh_tokens(session_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_login_events_user ON login_events(user_id, created_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_access_tokens_user ON access_tokens(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_oauth_clients_user ON oauth_clients(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_oauth_tokens_user ON oauth_tokens(user_id, client_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_post_revisions_post ON post_revisions(post_id, created_at DESC)`,
 	}
 
 	for _, query := range queries {
@@ -122,5 +482,133 @@ func (db *Database) CreateTables() error {
 			return err
 		}
 	}
-	return nil
+
+	// 既存DB向けのカラム追加
+	columns := []struct{ table, name, definition string }{
+		{"users", "totp_secret", "TEXT"},
+		{"users", "totp_enabled", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"posts", "image_feed_url", "TEXT DEFAULT ''"},
+		{"posts", "image_thumb_url", "TEXT DEFAULT ''"},
+		{"post_media", "status", "TEXT NOT NULL DEFAULT 'ready'"},
+		{"post_media", "poster_url", "TEXT NOT NULL DEFAULT ''"},
+		{"post_media", "duration", "REAL NOT NULL DEFAULT 0"},
+		{"posts", "edited_at", "DATETIME"},
+		{"posts", "in_reply_to", "INTEGER"},
+		{"posts", "root_id", "INTEGER"},
+		{"posts", "quote_of", "INTEGER"},
+		{"posts", "reposts", "INTEGER DEFAULT 0"},
+		{"notifications", "source_id", "INTEGER"},
+	}
+	for _, c := range columns {
+		if err := db.addColumnIfMissing(c.table, c.name, c.definition); err != nil {
+			return err
+		}
+	}
+
+	// 追加したカラムのインデックス
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS idx_posts_in_reply_to ON posts(in_reply_to)`,
+		`CREATE INDEX IF NOT EXISTS idx_posts_root_id ON posts(root_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_source ON notifications(source_id)`,
+	}
+	for _, query := range indexes {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	// メール確認の導入前から登録済みのユーザーは確認済みとして扱う（再確認を求めない）
+	if verificationMissing {
+		if _, err := db.Exec("UPDATE users SET verified = TRUE WHERE verified = FALSE"); err != nil {
+			return err
+		}
+	}
+
+	// 旧google_idカラムを外部IDテーブルへ移行
+	_, err = db.Exec(`INSERT OR IGNORE INTO identities (user_id, provider, subject, email)
+		SELECT id, 'google', google_id, email FROM users WHERE google_id IS NOT NULL AND google_id != ''`)
+	if err != nil {
+		return err
+	}
+
+	// 旧image_urlカラムの画像を添付メディアへ移行
+	_, err = db.Exec(`INSERT OR IGNORE INTO post_media (post_id, position, url, feed_url, thumb_url)
+		SELECT id, 0, image_url, image_feed_url, image_thumb_url FROM posts WHERE image_url IS NOT NULL AND image_url != ''`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE posts SET image_url = '', image_feed_url = '', image_thumb_url = '' WHERE image_url != ''`)
+	if err != nil {
+		return err
+	}
+
+	// 旧commentsテーブルのコメントを返信の投稿へ移行
+	if err := db.migrateComments(); err != nil {
+		return err
+	}
+
+	// 既存の投稿のハッシュタグを登録
+	return db.backfillPostTags()
+}
+
+// コメントを返信として投稿に移す（コメント数は返信数としてそのまま使う）
+func (db *Database) migrateComments() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO posts (user_id, content, in_reply_to, root_id, created_at, updated_at)
+		SELECT c.user_id, c.content, c.post_id, COALESCE(p.root_id, p.id), c.created_at, c.created_at
+		FROM comments c JOIN posts p ON c.post_id = p.id
+		ORDER BY c.id`)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM comments"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// テーブルが存在しないかどうか
+func (db *Database) tableMissing(table string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count == 0, err
+}
+
+// カラムが存在しない場合のみ追加
+func (db *Database) addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// CURRENT_TIMESTAMPと比較できる形式に変換
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
 }
\ No newline at end of file
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 通知の種類
+const (
+	notificationLike    = "like"
+	notificationFollow  = "follow"
+	notificationComment = "comment"
+	notificationMention = "mention"
+)
+
+// 通知一覧で1ページに表示する件数
+const notificationPageSize = 20
+
+// 通知設定に表示する種類（この順に並べる）
+var notificationTypes = []struct {
+	Type  string
+	Label string
+}{
+	{notificationLike, "いいね"},
+	{notificationComment, "返信"},
+	{notificationMention, "メンション"},
+	{notificationFollow, "フォロー"},
+}
+
+// 通知の種類ごとの受け取り設定
+type NotificationSetting struct {
+	Type    string
+	Label   string
+	Enabled bool
+}
+
+// 通知を作成する（自分自身の操作や、受け取らない設定にした種類は通知しない）
+// postID は通知の対象の投稿、sourceID は通知のきっかけになった投稿（返信など）で、なければ 0
+func createNotification(db execer, userID, actorID int, kind string, postID, sourceID int) error {
+	if userID == actorID {
+		return nil
+	}
+	var post, source sql.NullInt64
+	if postID != 0 {
+		post = sql.NullInt64{Int64: int64(postID), Valid: true}
+	}
+	if sourceID != 0 {
+		source = sql.NullInt64{Int64: int64(sourceID), Valid: true}
+	}
+	_, err := db.Exec(`INSERT INTO notifications (user_id, actor_id, type, post_id, source_id)
+		SELECT ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM notification_preferences WHERE user_id = ? AND type = ? AND enabled = 0
+		)`, userID, actorID, kind, post, source, userID, kind)
+	return err
+}
+
+// 取り消された操作（いいね解除・フォロー解除）の通知を削除する
+func deleteNotification(db execer, actorID int, kind string, userID, postID int) error {
+	_, err := db.Exec("DELETE FROM notifications WHERE actor_id = ? AND type = ? AND user_id = ? AND COALESCE(post_id, 0) = ?",
+		actorID, kind, userID, postID)
+	return err
+}
+
+// 投稿の作成者を取得
+func postAuthor(db rowQueryer, postID int) (int, error) {
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM posts WHERE id = ?", postID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errPostNotFound
+	}
+	return userID, err
+}
+
+// 通知を新しい順に取得する
+// 同じ種類・同じ投稿への通知は既読にしたタイミングごとに1件にまとめる（「Aさん他3人が…」）
+// before は前のページのカーソル（0 なら最新から）で、次のページのカーソル（続きがなければ 0）も返す
+func (app *App) getNotifications(userID, before, limit int) ([]Notification, int, error) {
+	if before <= 0 {
+		before = int(^uint(0) >> 1)
+	}
+	rows, err := app.db.Query(`
+		SELECT MAX(id), COUNT(DISTINCT actor_id), read_at IS NULL
+		FROM notifications
+		WHERE user_id = ?
+		GROUP BY type, post_id, read_at
+		HAVING MAX(id) < ?
+		ORDER BY MAX(id) DESC
+		LIMIT ?
+	`, userID, before, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	type group struct {
+		latestID, actors int
+		unread           bool
+	}
+	var groups []group
+	for rows.Next() {
+		var g group
+		if err := rows.Scan(&g.latestID, &g.actors, &g.unread); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// 投稿が削除された通知は表示しないため、カーソルは表示した件数ではなく読み込んだまとまりから決める
+	next := 0
+	if len(groups) == limit {
+		next = groups[len(groups)-1].latestID
+	}
+
+	notifications := []Notification{}
+	if len(groups) == 0 {
+		return notifications, next, nil
+	}
+
+	// まとめた通知ごとに、最新の通知の内容と操作したユーザーを読み込む
+	args := make([]interface{}, len(groups))
+	placeholders := make([]string, len(groups))
+	for i, g := range groups {
+		args[i] = g.latestID
+		placeholders[i] = "?"
+	}
+	rows, err = app.db.Query(`
+		SELECT n.id, n.type, COALESCE(n.post_id, 0), COALESCE(n.source_id, 0), n.created_at, u.username, u.avatar
+		FROM notifications n
+		JOIN users u ON n.actor_id = u.id
+		WHERE n.id IN (`+strings.Join(placeholders, ",")+`)`, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	latest := make(map[int]Notification, len(groups))
+	var postIDs []int
+	for rows.Next() {
+		var n Notification
+		var sourceID int
+		if err := rows.Scan(&n.ID, &n.Type, &n.PostID, &sourceID, &n.CreatedAt, &n.Actor, &n.ActorAvatar); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		n.URL = notificationURL(n.Type, n.Actor, n.PostID, sourceID)
+		latest[n.ID] = n
+		if n.PostID != 0 {
+			postIDs = append(postIDs, n.PostID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var posts map[int]Post
+	if len(postIDs) > 0 {
+		posts = app.getPostsByID(postIDs)
+	}
+
+	for _, g := range groups {
+		n, ok := latest[g.latestID]
+		if !ok {
+			continue
+		}
+		if n.PostID != 0 {
+			post, ok := posts[n.PostID]
+			if !ok {
+				continue
+			}
+			n.Post = &post
+		}
+		n.ActorCount = g.actors
+		n.Read = !g.unread
+		n.Message = notificationMessage(n.Type, n.Actor, n.ActorCount)
+		notifications = append(notifications, n)
+	}
+	return notifications, next, nil
+}
+
+// 通知の文面
+func notificationMessage(kind, actor string, actors int) string {
+	who := actor + "さん"
+	if actors > 1 {
+		who += fmt.Sprintf("他%d人", actors-1)
+	}
+	switch kind {
+	case notificationLike:
+		return who + "があなたの投稿にいいねしました"
+	case notificationComment:
+		return who + "があなたの投稿に返信しました"
+	case notificationMention:
+		return who + "があなたをメンションしました"
+	case notificationFollow:
+		return who + "があなたをフォローしました"
+	}
+	return who + "からの通知があります"
+}
+
+// 通知を開いたときの移動先
+func notificationURL(kind, actor string, postID, sourceID int) string {
+	switch {
+	case kind == notificationFollow:
+		return "/profile/" + actor
+	case sourceID != 0:
+		return fmt.Sprintf("/posts/%d#post-%d", postID, sourceID)
+	case postID != 0:
+		return fmt.Sprintf("/posts/%d", postID)
+	}
+	return "/notifications"
+}
+
+// 未読の通知の数（まとめた単位で数える）
+func (app *App) countUnreadNotifications(userID int) int {
+	var count int
+	app.db.QueryRow(`SELECT COUNT(*) FROM (
+		SELECT 1 FROM notifications WHERE user_id = ? AND read_at IS NULL GROUP BY type, post_id
+	)`, userID).Scan(&count)
+	return count
+}
+
+// 通知を既読にする（notificationID を指定した場合はその通知とまとめられている、それ以前の通知だけ）
+func (app *App) markNotificationsRead(userID, notificationID int) error {
+	now := sqlTime(time.Now())
+	if notificationID == 0 {
+		_, err := app.db.Exec("UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL", now, userID)
+		return err
+	}
+	_, err := app.db.Exec(`UPDATE notifications SET read_at = ?
+		WHERE user_id = ? AND read_at IS NULL AND id <= ?
+		AND type = (SELECT type FROM notifications WHERE id = ? AND user_id = ?)
+		AND post_id IS (SELECT post_id FROM notifications WHERE id = ? AND user_id = ?)`,
+		now, userID, notificationID, notificationID, userID, notificationID, userID)
+	return err
+}
+
+// 通知の受け取り設定（未設定の種類は受け取る）
+func (app *App) getNotificationSettings(userID int) []NotificationSetting {
+	disabled := make(map[string]bool)
+	rows, err := app.db.Query("SELECT type FROM notification_preferences WHERE user_id = ? AND enabled = 0", userID)
+	if err == nil {
+		for rows.Next() {
+			var kind string
+			if rows.Scan(&kind) == nil {
+				disabled[kind] = true
+			}
+		}
+		rows.Close()
+	}
+
+	settings := make([]NotificationSetting, 0, len(notificationTypes))
+	for _, t := range notificationTypes {
+		settings = append(settings, NotificationSetting{Type: t.Type, Label: t.Label, Enabled: !disabled[t.Type]})
+	}
+	return settings
+}
+
+// 通知の受け取り設定を保存する
+func (app *App) saveNotificationSettings(userID int, enabled map[string]bool) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM notification_preferences WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, t := range notificationTypes {
+		_, err := tx.Exec("INSERT INTO notification_preferences (user_id, type, enabled) VALUES (?, ?, ?)",
+			userID, t.Type, enabled[t.Type])
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 前のページのカーソル
+func cursorParam(r *http.Request) int {
+	if c, err := strconv.Atoi(r.URL.Query().Get("before")); err == nil && c > 0 {
+		return c
+	}
+	return 0
+}
+
+// 通知ページ（表示した未読の通知を既読にする）
+func (app *App) notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	notifications, next, err := app.getNotifications(userID, cursorParam(r), notificationPageSize)
+	if err != nil {
+		http.Error(w, "通知の取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	// 他のページの通知や表示後に届いた通知は未読のまま残す
+	marked := false
+	for _, n := range notifications {
+		if !n.Read {
+			app.markNotificationsRead(userID, n.ID)
+			marked = true
+		}
+	}
+	if marked {
+		app.publishNotifications(userID)
+	}
+
+	app.renderTemplate(w, r, "notifications", PageData{
+		Title:           "通知",
+		IsAuthenticated: true,
+		CurrentUserID:   userID,
+		Notifications:   notifications,
+		NextCursor:      next,
+	})
+}
+
+// 通知設定ページ
+func (app *App) notificationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	app.renderNotificationSettings(w, r, userID, "", "")
+}
+
+func (app *App) renderNotificationSettings(w http.ResponseWriter, r *http.Request, userID int, message, errMsg string) {
+	app.renderTemplate(w, r, "notification_settings", PageData{
+		Title:             "通知設定",
+		IsAuthenticated:   true,
+		CurrentUserID:     userID,
+		NotificationPrefs: app.getNotificationSettings(userID),
+		Message:           message,
+		Error:             errMsg,
+	})
+}
+
+// 通知設定の保存
+func (app *App) updateNotificationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	r.ParseForm()
+
+	enabled := make(map[string]bool)
+	for _, kind := range r.Form["types"] {
+		enabled[kind] = true
+	}
+	if err := app.saveNotificationSettings(userID, enabled); err != nil {
+		app.renderNotificationSettings(w, r, userID, "", "通知設定の保存に失敗しました")
+		return
+	}
+	app.renderNotificationSettings(w, r, userID, "通知設定を保存しました", "")
+}
+
+// 通知一覧API（?before= に next_cursor を渡すと続きを取得する）
+func (app *App) getNotificationsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := r.Context().Value("user_id").(int)
+
+	notifications, next, err := app.getNotifications(userID, cursorParam(r), notificationPageSize)
+	if err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Failed to load notifications",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(APIResponse{
+		Success:       true,
+		Notifications: notifications,
+		NextCursor:    next,
+		Unread:        app.countUnreadNotifications(userID),
+	})
+}
+
+// 通知の既読API（id を省略するとすべて既読にする）
+func (app *App) readNotificationsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := r.Context().Value("user_id").(int)
+
+	var req struct {
+		ID int `json:"id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: false,
+				Message: "Invalid request",
+			})
+			return
+		}
+	}
+
+	if err := app.markNotificationsRead(userID, req.ID); err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Failed to update notifications",
+		})
+		return
+	}
+
+	app.publishNotifications(userID)
+
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Unread:  app.countUnreadNotifications(userID),
+	})
+}
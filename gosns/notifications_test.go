@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// alice の投稿を n 件作り、それぞれに bob がいいねした通知を作る（古い順）
+func likedPosts(t *testing.T, app *App, n int) (alice, bob int, posts []int) {
+	t.Helper()
+
+	alice = createTestUser(t, app, "alice", true)
+	bob = createTestUser(t, app, "bob", true)
+	for i := 0; i < n; i++ {
+		postID, err := app.createPost(alice, "投稿"+strconv.Itoa(i), postRefs{}, &postAttachments{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := createNotification(app.db, alice, bob, notificationLike, postID, 0); err != nil {
+			t.Fatal(err)
+		}
+		posts = append(posts, postID)
+	}
+	return alice, bob, posts
+}
+
+func TestNotificationCursorSkipsMissingPosts(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice, _, posts := likedPosts(t, app, 3)
+
+	// 通知が残ったまま投稿だけが消えた場合
+	if _, err := app.db.Exec("DELETE FROM posts WHERE id = ?", posts[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	page, next, err := app.getNotifications(alice, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].PostID != posts[1] {
+		t.Fatalf("first page = %+v, want only post %d", page, posts[1])
+	}
+	if next == 0 {
+		t.Fatal("next cursor is 0 although older notifications remain")
+	}
+
+	page, next, err = app.getNotifications(alice, next, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].PostID != posts[0] {
+		t.Fatalf("second page = %+v, want only post %d", page, posts[0])
+	}
+	if next != 0 {
+		t.Fatalf("next cursor = %d on last page, want 0", next)
+	}
+}
+
+func unreadNotifications(t *testing.T, app *App, userID int) map[int]bool {
+	t.Helper()
+
+	rows, err := app.db.Query("SELECT post_id FROM notifications WHERE user_id = ? AND read_at IS NULL", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	unread := make(map[int]bool)
+	for rows.Next() {
+		var postID int
+		if err := rows.Scan(&postID); err != nil {
+			t.Fatal(err)
+		}
+		unread[postID] = true
+	}
+	return unread
+}
+
+func TestNotificationsPageMarksOnlyRenderedRead(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice, _, posts := likedPosts(t, app, 3)
+
+	// 最新の通知より前のページだけを表示する
+	latest, _, err := app.getNotifications(alice, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/notifications?before="+strconv.Itoa(latest[0].ID), nil)
+	w := httptest.NewRecorder()
+	app.notificationsHandler(w, withUser(r, alice))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	unread := unreadNotifications(t, app, alice)
+	if len(unread) != 1 || !unread[posts[2]] {
+		t.Fatalf("unread posts = %v, want only %d", unread, posts[2])
+	}
+	if n := app.countUnreadNotifications(alice); n != 1 {
+		t.Fatalf("unread count = %d, want 1", n)
+	}
+}
+
+func TestMarkNotificationReadKeepsNewerInGroup(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice, _, posts := likedPosts(t, app, 1)
+	carol := createTestUser(t, app, "carol", true)
+
+	shown, _, err := app.getNotifications(alice, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 表示した後に同じ投稿へのいいねが届く
+	if err := createNotification(app.db, alice, carol, notificationLike, posts[0], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.markNotificationsRead(alice, shown[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var unread int
+	app.db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", alice).Scan(&unread)
+	if unread != 1 {
+		t.Fatalf("unread rows = %d, want 1 (the notification that arrived later)", unread)
+	}
+}
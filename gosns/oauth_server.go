@@ -0,0 +1,636 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// サードパーティアプリ向けアクセストークンの接頭辞
+const oauthAccessTokenPrefix = "gosns_oat_"
+
+const (
+	oauthCodeTTL         = 10 * time.Minute
+	oauthAccessTokenTTL  = time.Hour
+	oauthRefreshTokenTTL = 30 * 24 * time.Hour
+	oauthConsentTTL      = 10 * time.Minute
+)
+
+var errInvalidOAuthToken = errors.New("invalid oauth access token")
+
+// 認可リクエスト
+type AuthorizeRequest struct {
+	Client              *OAuthClient
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	Scopes              []string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	ConsentToken        string
+}
+
+// トークンエンドポイントの応答
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// クライアント取得
+func (app *App) getOAuthClient(clientID string) (*OAuthClient, string, error) {
+	var c OAuthClient
+	var secretHash, redirectURIs string
+	err := app.db.QueryRow(`SELECT id, client_id, secret_hash, name, redirect_uris, user_id, created_at
+		FROM oauth_clients WHERE client_id = ?`, clientID).
+		Scan(&c.ID, &c.ClientID, &secretHash, &c.Name, &redirectURIs, &c.UserID, &c.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	c.RedirectURIs = strings.Fields(redirectURIs)
+	c.Confidential = secretHash != ""
+	return &c, secretHash, nil
+}
+
+// リダイレクトURIの形式確認（フラグメント・スクリプト系スキームは不可）
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "javascript", "data", "vbscript", "file":
+		return false
+	case "http", "https":
+		return u.Host != ""
+	}
+	return true
+}
+
+// 登録済みのリダイレクトURIと完全一致するものだけ許可
+func (c *OAuthClient) allowsRedirect(redirectURI string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+// クライアント認証（Basic認証またはフォーム）
+// 公開クライアントはPKCEで保護するためシークレット不要
+func (app *App) authenticateOAuthClient(r *http.Request) (*OAuthClient, bool) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	if clientID == "" {
+		return nil, false
+	}
+
+	client, secretHash, err := app.getOAuthClient(clientID)
+	if err != nil {
+		return nil, false
+	}
+	if client.Confidential && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(secretHash)) != 1 {
+		return nil, false
+	}
+	return client, true
+}
+
+// 認可リクエストの解析
+// クライアントまたはリダイレクトURIが不正な場合はリダイレクトせずにエラーを表示する
+func (app *App) parseAuthorizeRequest(r *http.Request) (*AuthorizeRequest, string, error) {
+	req := &AuthorizeRequest{
+		ClientID:            r.FormValue("client_id"),
+		RedirectURI:         r.FormValue("redirect_uri"),
+		Scope:               r.FormValue("scope"),
+		State:               r.FormValue("state"),
+		CodeChallenge:       r.FormValue("code_challenge"),
+		CodeChallengeMethod: r.FormValue("code_challenge_method"),
+	}
+
+	client, _, err := app.getOAuthClient(req.ClientID)
+	if err != nil {
+		return nil, "", errors.New("不明なアプリケーションです")
+	}
+	req.Client = client
+
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !client.allowsRedirect(req.RedirectURI) {
+		return nil, "", errors.New("リダイレクトURIが登録されていません")
+	}
+
+	if r.FormValue("response_type") != "code" {
+		return req, "unsupported_response_type", nil
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return req, "invalid_request", nil
+	}
+
+	if req.Scope == "" {
+		req.Scope = scopeRead
+	}
+	req.Scopes = strings.Fields(req.Scope)
+	if len(normalizeScopes(req.Scopes)) != len(req.Scopes) {
+		return req, "invalid_scope", nil
+	}
+	req.Scopes = normalizeScopes(req.Scopes)
+	req.Scope = strings.Join(req.Scopes, " ")
+	return req, "", nil
+}
+
+// クライアントのリダイレクトURIへ結果を返す
+func redirectToClient(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect URI", http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// 同意画面の改ざん防止用トークン（ユーザーとリクエスト内容に紐づける）
+func consentToken(userID int, req *AuthorizeRequest, expires int64) string {
+	digest := hashToken(strings.Join([]string{req.ClientID, req.RedirectURI, req.Scope, req.State, req.CodeChallenge}, "\n"))
+	return signToken(strconv.Itoa(userID) + "." + digest + "." + strconv.FormatInt(expires, 10))
+}
+
+func validConsentToken(token string, userID int, req *AuthorizeRequest) bool {
+	payload, ok := verifySignedToken(token)
+	if !ok {
+		return false
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(consentToken(userID, req, expires)), []byte(token)) == 1
+}
+
+// 認可エンドポイント（同意画面）
+func (app *App) oauthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Frame-Options", "DENY")
+
+	req, errCode, err := app.parseAuthorizeRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		app.renderTemplate(w, r, "oauth_authorize", PageData{
+			Title: "アプリの認可",
+			Error: err.Error(),
+		})
+		return
+	}
+	if errCode != "" {
+		redirectToClient(w, r, req.RedirectURI, url.Values{"error": {errCode}, "state": {req.State}})
+		return
+	}
+
+	userID := app.getCurrentUserID(w, r)
+	if userID == 0 {
+		setLoginNext(w, r.URL.RequestURI())
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == "GET" {
+		req.ConsentToken = consentToken(userID, req, time.Now().Add(oauthConsentTTL).Unix())
+		app.renderTemplate(w, r, "oauth_authorize", PageData{
+			Title:           "アプリの認可",
+			IsAuthenticated: true,
+			CurrentUserID:   userID,
+			OAuthRequest:    req,
+		})
+		return
+	}
+
+	if !validConsentToken(r.FormValue("consent_token"), userID, req) {
+		http.Error(w, "Invalid consent token", http.StatusBadRequest)
+		return
+	}
+
+	if r.FormValue("action") != "approve" {
+		redirectToClient(w, r, req.RedirectURI, url.Values{"error": {"access_denied"}, "state": {req.State}})
+		return
+	}
+
+	code := randomToken(32)
+	_, err = app.db.Exec(`INSERT INTO oauth_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(code), req.ClientID, userID, req.RedirectURI, req.Scope, req.CodeChallenge,
+		sqlTime(time.Now().Add(oauthCodeTTL)))
+	if err != nil {
+		log.Println("認可コード作成エラー:", err)
+		redirectToClient(w, r, req.RedirectURI, url.Values{"error": {"server_error"}, "state": {req.State}})
+		return
+	}
+
+	redirectToClient(w, r, req.RedirectURI, url.Values{"code": {code}, "state": {req.State}})
+}
+
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gosns"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// トークンエンドポイント
+func (app *App) oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	client, ok := app.authenticateOAuthClient(r)
+	if !ok {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		app.exchangeAuthorizationCode(w, r, client)
+	case "refresh_token":
+		app.refreshOAuthToken(w, r, client)
+	default:
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+func verifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// 認可コードをトークンに交換
+func (app *App) exchangeAuthorizationCode(w http.ResponseWriter, r *http.Request, client *OAuthClient) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	defer tx.Rollback()
+
+	var codeID, userID int
+	var clientID, redirectURI, scopes, challenge string
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRow(`SELECT id, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at, used_at
+		FROM oauth_codes WHERE code_hash = ?`, hashToken(r.PostForm.Get("code"))).
+		Scan(&codeID, &clientID, &userID, &redirectURI, &scopes, &challenge, &expiresAt, &usedAt)
+	if err != nil || clientID != client.ClientID {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+		return
+	}
+
+	// 使用済みコードの再送は漏洩とみなし、そのコードで発行したトークンを失効させる
+	if usedAt.Valid {
+		tx.Exec("UPDATE oauth_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE code_id = ? AND revoked_at IS NULL", codeID)
+		tx.Commit()
+		log.Printf("認可コードの再利用を検出: client=%s user=%d", clientID, userID)
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "Authorization code already used")
+		return
+	}
+	if time.Now().After(expiresAt) {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "Authorization code expired")
+		return
+	}
+	if r.PostForm.Get("redirect_uri") != redirectURI {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri mismatch")
+		return
+	}
+	if !verifyPKCE(r.PostForm.Get("code_verifier"), challenge) {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+		return
+	}
+
+	// 同時に交換された場合は先に使用済みにしたリクエストだけが成功する
+	res, err := tx.Exec("UPDATE oauth_codes SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL", codeID)
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "Authorization code already used")
+		return
+	}
+
+	accessToken := oauthAccessTokenPrefix + randomToken(32)
+	refreshToken := randomToken(32)
+	_, err = tx.Exec(`INSERT INTO oauth_tokens (client_id, user_id, code_id, scopes, access_token_hash, refresh_token_hash, expires_at, refresh_expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		clientID, userID, codeID, scopes, hashToken(accessToken), hashToken(refreshToken),
+		sqlTime(time.Now().Add(oauthAccessTokenTTL)), sqlTime(time.Now().Add(oauthRefreshTokenTTL)))
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	writeOAuthTokens(w, accessToken, refreshToken, scopes)
+}
+
+// リフレッシュトークンによる再発行（リフレッシュトークンもローテーション）
+// ローテーション済みのトークンが再送された場合は漏洩とみなし、同じ認可で発行したトークンを失効させる
+func (app *App) refreshOAuthToken(w http.ResponseWriter, r *http.Request, client *OAuthClient) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	defer tx.Rollback()
+
+	hash := hashToken(r.PostForm.Get("refresh_token"))
+
+	var id int
+	var scopes string
+	err = tx.QueryRow(`SELECT id, scopes FROM oauth_tokens
+		WHERE refresh_token_hash = ? AND client_id = ? AND revoked_at IS NULL AND refresh_expires_at > ?`,
+		hash, client.ClientID, sqlTime(time.Now())).Scan(&id, &scopes)
+	if err == sql.ErrNoRows {
+		var tokenID, userID int
+		err := tx.QueryRow(`SELECT t.id, t.user_id FROM oauth_used_refresh_tokens u
+			JOIN oauth_tokens t ON u.token_id = t.id
+			WHERE u.token_hash = ? AND t.client_id = ?`, hash, client.ClientID).Scan(&tokenID, &userID)
+		if err == nil {
+			tx.Exec("UPDATE oauth_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL", tokenID)
+			tx.Commit()
+			log.Printf("OAuthリフレッシュトークンの再利用を検出: client=%s user=%d", client.ClientID, userID)
+		}
+	}
+	if err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+		return
+	}
+
+	// スコープの縮小のみ許可
+	if requested := r.PostForm.Get("scope"); requested != "" {
+		granted := strings.Fields(scopes)
+		for _, s := range strings.Fields(requested) {
+			if !hasScope(granted, s) {
+				oauthError(w, http.StatusBadRequest, "invalid_scope", "")
+				return
+			}
+		}
+		scopes = strings.Join(normalizeScopes(strings.Fields(requested)), " ")
+	}
+
+	accessToken := oauthAccessTokenPrefix + randomToken(32)
+	refreshToken := randomToken(32)
+	res, err := tx.Exec(`UPDATE oauth_tokens
+		SET access_token_hash = ?, refresh_token_hash = ?, scopes = ?, expires_at = ?, refresh_expires_at = ?
+		WHERE id = ? AND refresh_token_hash = ?`,
+		hashToken(accessToken), hashToken(refreshToken), scopes,
+		sqlTime(time.Now().Add(oauthAccessTokenTTL)), sqlTime(time.Now().Add(oauthRefreshTokenTTL)),
+		id, hash)
+	if err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+		return
+	}
+	if _, err := tx.Exec("INSERT INTO oauth_used_refresh_tokens (token_hash, token_id) VALUES (?, ?)", hash, id); err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	writeOAuthTokens(w, accessToken, refreshToken, scopes)
+}
+
+func writeOAuthTokens(w http.ResponseWriter, accessToken, refreshToken, scopes string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(oauthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(oauthAccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        scopes,
+	})
+}
+
+// トークン失効エンドポイント（RFC 7009: 不明なトークンでも200を返す）
+func (app *App) oauthRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	client, ok := app.authenticateOAuthClient(r)
+	if !ok {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	hash := hashToken(r.PostForm.Get("token"))
+	app.db.Exec(`UPDATE oauth_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE client_id = ? AND (access_token_hash = ? OR refresh_token_hash = ?) AND revoked_at IS NULL`,
+		client.ClientID, hash, hash)
+	w.WriteHeader(http.StatusOK)
+}
+
+// APIリクエストのアクセストークン検証
+func (app *App) authenticateOAuthToken(token string) (*Claims, error) {
+	var id, userID int
+	var username, scopes string
+	err := app.db.QueryRow(`SELECT t.id, t.user_id, u.username, t.scopes
+		FROM oauth_tokens t
+		JOIN users u ON t.user_id = u.id
+		WHERE t.access_token_hash = ? AND t.revoked_at IS NULL AND t.expires_at > ?`,
+		hashToken(token), sqlTime(time.Now())).Scan(&id, &userID, &username, &scopes)
+	if err != nil {
+		return nil, errInvalidOAuthToken
+	}
+
+	app.db.Exec("UPDATE oauth_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)",
+		id, sqlTime(time.Now().Add(-lastSeenResolution)))
+
+	return &Claims{UserID: userID, Username: username, Scopes: strings.Fields(scopes)}, nil
+}
+
+// 登録したアプリ一覧
+func (app *App) getOAuthClients(userID int) []OAuthClient {
+	rows, err := app.db.Query(`SELECT id, client_id, secret_hash, name, redirect_uris, user_id, created_at
+		FROM oauth_clients WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return []OAuthClient{}
+	}
+	defer rows.Close()
+
+	var clients []OAuthClient
+	for rows.Next() {
+		var c OAuthClient
+		var secretHash, redirectURIs string
+		if err := rows.Scan(&c.ID, &c.ClientID, &secretHash, &c.Name, &redirectURIs, &c.UserID, &c.CreatedAt); err != nil {
+			continue
+		}
+		c.RedirectURIs = strings.Fields(redirectURIs)
+		c.Confidential = secretHash != ""
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// アクセスを許可したアプリ一覧
+func (app *App) getAuthorizedApps(userID int) []AuthorizedApp {
+	rows, err := app.db.Query(`SELECT c.client_id, c.name, GROUP_CONCAT(t.scopes, ' '), MIN(t.created_at), MAX(t.last_used_at)
+		FROM oauth_tokens t
+		JOIN oauth_clients c ON t.client_id = c.client_id
+		WHERE t.user_id = ? AND t.revoked_at IS NULL AND t.refresh_expires_at > ?
+		GROUP BY c.client_id, c.name
+		ORDER BY MIN(t.created_at) DESC`, userID, sqlTime(time.Now()))
+	if err != nil {
+		return []AuthorizedApp{}
+	}
+	defer rows.Close()
+
+	var apps []AuthorizedApp
+	for rows.Next() {
+		var a AuthorizedApp
+		var scopes, authorizedAt string
+		var lastUsedAt sql.NullString
+		if err := rows.Scan(&a.ClientID, &a.Name, &scopes, &authorizedAt, &lastUsedAt); err != nil {
+			continue
+		}
+		a.Scopes = normalizeScopes(strings.Fields(scopes))
+		a.AuthorizedAt = parseSQLTime(authorizedAt)
+		if lastUsedAt.Valid {
+			t := parseSQLTime(lastUsedAt.String)
+			a.LastUsedAt = &t
+		}
+		apps = append(apps, a)
+	}
+	return apps
+}
+
+// 集計関数の結果は文字列で返るため自前で解析
+func parseSQLTime(s string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05", time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07:00"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// アプリ設定ページ
+func (app *App) oauthAppsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	app.renderOAuthApps(w, r, userID, PageData{})
+}
+
+func (app *App) renderOAuthApps(w http.ResponseWriter, r *http.Request, userID int, data PageData) {
+	data.Title = "連携アプリ"
+	data.IsAuthenticated = true
+	data.CurrentUserID = userID
+	data.OAuthClients = app.getOAuthClients(userID)
+	data.AuthorizedApps = app.getAuthorizedApps(userID)
+	app.renderTemplate(w, r, "oauth_apps", data)
+}
+
+// アプリ登録
+func (app *App) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		app.renderOAuthApps(w, r, userID, PageData{Error: "アプリ名を入力してください"})
+		return
+	}
+
+	redirectURIs := strings.Fields(r.FormValue("redirect_uris"))
+	if len(redirectURIs) == 0 {
+		app.renderOAuthApps(w, r, userID, PageData{Error: "リダイレクトURIを1つ以上入力してください"})
+		return
+	}
+	for _, u := range redirectURIs {
+		if !validRedirectURI(u) {
+			app.renderOAuthApps(w, r, userID, PageData{Error: "リダイレクトURIが正しくありません: " + u})
+			return
+		}
+	}
+
+	clientID := randomToken(16)
+	secret, secretHash := "", ""
+	if r.FormValue("confidential") != "" {
+		secret = randomToken(32)
+		secretHash = hashToken(secret)
+	}
+
+	_, err := app.db.Exec("INSERT INTO oauth_clients (client_id, secret_hash, name, redirect_uris, user_id) VALUES (?, ?, ?, ?, ?)",
+		clientID, secretHash, name, strings.Join(redirectURIs, "\n"), userID)
+	if err != nil {
+		log.Println("OAuthクライアント登録エラー:", err)
+		app.renderOAuthApps(w, r, userID, PageData{Error: "アプリの登録に失敗しました"})
+		return
+	}
+
+	// クライアントシークレットはこの画面でのみ表示する
+	app.renderOAuthApps(w, r, userID, PageData{
+		Message: "アプリを登録しました。クライアントID: " + clientID,
+		Token:   secret,
+	})
+}
+
+// アプリ削除（発行済みのトークンも失効）
+func (app *App) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	clientID := mux.Vars(r)["client_id"]
+
+	res, err := app.db.Exec("DELETE FROM oauth_clients WHERE client_id = ? AND user_id = ?", clientID, userID)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n > 0 {
+			app.db.Exec("DELETE FROM oauth_codes WHERE client_id = ?", clientID)
+			app.db.Exec("UPDATE oauth_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE client_id = ? AND revoked_at IS NULL", clientID)
+		}
+	}
+	http.Redirect(w, r, "/settings/apps", http.StatusSeeOther)
+}
+
+// アプリへのアクセス許可を取り消す
+func (app *App) revokeAuthorizedAppHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	app.db.Exec("UPDATE oauth_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND client_id = ? AND revoked_at IS NULL",
+		userID, mux.Vars(r)["client_id"])
+	http.Redirect(w, r, "/settings/apps", http.StatusSeeOther)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testRedirectURI = "https://client.example/callback"
+
+// 公開クライアント（シークレットなし）を登録する
+func createTestOAuthClient(t *testing.T, app *App, owner int) string {
+	t.Helper()
+
+	clientID := randomToken(16)
+	_, err := app.db.Exec("INSERT INTO oauth_clients (client_id, secret_hash, name, redirect_uris, user_id) VALUES (?, '', 'Test App', ?, ?)",
+		clientID, testRedirectURI, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientID
+}
+
+// ログイン済みのブラウザのCookie
+func loginCookie(t *testing.T, app *App, userID int) *http.Cookie {
+	t.Helper()
+
+	sessionID, _, err := app.createSession(httptest.NewRequest("GET", "/", nil), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := generateJWT(userID, "", sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: "token", Value: token}
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// 同意画面で許可し、リダイレクト先に渡された認可コードを返す
+func authorizeTestClient(t *testing.T, app *App, userID int, clientID, verifier string) string {
+	t.Helper()
+
+	form := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {"read write"},
+		"state":                 {"xyz"},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+		"action":                {"approve"},
+	}
+	req, errCode, err := app.parseAuthorizeRequest(formRequest("/oauth/authorize", form))
+	if err != nil || errCode != "" {
+		t.Fatalf("authorize request: %v %s", err, errCode)
+	}
+	form.Set("consent_token", consentToken(userID, req, time.Now().Add(oauthConsentTTL).Unix()))
+
+	r := formRequest("/oauth/authorize", form)
+	r.AddCookie(loginCookie(t, app, userID))
+	w := httptest.NewRecorder()
+	app.oauthAuthorizeHandler(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("authorize: status %d", w.Code)
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("state") != "xyz" || u.Query().Get("code") == "" {
+		t.Fatalf("redirect = %s", u)
+	}
+	return u.Query().Get("code")
+}
+
+type oauthTokenResult struct {
+	oauthTokenResponse
+	Error string `json:"error"`
+}
+
+func oauthTokenRequest(t *testing.T, app *App, form url.Values) (int, oauthTokenResult) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	app.oauthTokenHandler(w, formRequest("/oauth/token", form))
+	var res oauthTokenResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("token response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, res
+}
+
+func exchangeCode(t *testing.T, app *App, clientID, code, verifier, redirectURI string) (int, oauthTokenResult) {
+	t.Helper()
+
+	return oauthTokenRequest(t, app, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"code":          {code},
+		"code_verifier": {verifier},
+		"redirect_uri":  {redirectURI},
+	})
+}
+
+func refreshToken(t *testing.T, app *App, clientID, token string) (int, oauthTokenResult) {
+	t.Helper()
+
+	return oauthTokenRequest(t, app, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {clientID},
+		"refresh_token": {token},
+	})
+}
+
+func oauthTokenValid(app *App, token string) bool {
+	_, err := app.authenticateOAuthToken(token)
+	return err == nil
+}
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func TestOAuthAuthorizationCodeWithPKCE(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	clientID := createTestOAuthClient(t, app, alice)
+
+	code := authorizeTestClient(t, app, alice, clientID, testVerifier)
+	status, res := exchangeCode(t, app, clientID, code, testVerifier, testRedirectURI)
+	if status != http.StatusOK {
+		t.Fatalf("exchange: status %d error %q", status, res.Error)
+	}
+	if res.Scope != "read write" || res.TokenType != "Bearer" || res.RefreshToken == "" {
+		t.Fatalf("token response %+v", res)
+	}
+
+	claims, err := app.authenticateOAuthToken(res.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != alice || !hasScope(claims.Scopes, scopeWrite) {
+		t.Fatalf("claims %+v", claims)
+	}
+}
+
+func TestOAuthRejectsPKCEMismatch(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	clientID := createTestOAuthClient(t, app, alice)
+
+	code := authorizeTestClient(t, app, alice, clientID, testVerifier)
+	other := testVerifier[:len(testVerifier)-1] + "A"
+	if status, res := exchangeCode(t, app, clientID, code, other, testRedirectURI); status != http.StatusBadRequest || res.Error != "invalid_grant" {
+		t.Fatalf("status %d error %q, want invalid_grant", status, res.Error)
+	}
+}
+
+func TestOAuthRejectsRedirectURIMismatch(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	clientID := createTestOAuthClient(t, app, alice)
+
+	code := authorizeTestClient(t, app, alice, clientID, testVerifier)
+	if status, res := exchangeCode(t, app, clientID, code, testVerifier, "https://evil.example/callback"); status != http.StatusBadRequest || res.Error != "invalid_grant" {
+		t.Fatalf("status %d error %q, want invalid_grant", status, res.Error)
+	}
+}
+
+// 使用済みの認可コードは拒否し、そのコードで発行したトークンも失効させる
+func TestOAuthCodeReplay(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	clientID := createTestOAuthClient(t, app, alice)
+
+	code := authorizeTestClient(t, app, alice, clientID, testVerifier)
+	status, first := exchangeCode(t, app, clientID, code, testVerifier, testRedirectURI)
+	if status != http.StatusOK {
+		t.Fatalf("first exchange: status %d", status)
+	}
+	if status, res := exchangeCode(t, app, clientID, code, testVerifier, testRedirectURI); status != http.StatusBadRequest || res.Error != "invalid_grant" {
+		t.Fatalf("replay: status %d error %q, want invalid_grant", status, res.Error)
+	}
+	if oauthTokenValid(app, first.AccessToken) {
+		t.Fatal("token issued from a replayed code is still valid")
+	}
+}
+
+func TestOAuthRefreshRotation(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	clientID := createTestOAuthClient(t, app, alice)
+
+	code := authorizeTestClient(t, app, alice, clientID, testVerifier)
+	_, first := exchangeCode(t, app, clientID, code, testVerifier, testRedirectURI)
+
+	status, second := refreshToken(t, app, clientID, first.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("refresh: status %d error %q", status, second.Error)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == first.AccessToken {
+		t.Fatal("tokens were not rotated")
+	}
+	if oauthTokenValid(app, first.AccessToken) {
+		t.Fatal("old access token still valid after refresh")
+	}
+	if !oauthTokenValid(app, second.AccessToken) {
+		t.Fatal("new access token rejected")
+	}
+
+	// ローテーション済みのトークンの再送は漏洩とみなして認可ごと失効させる
+	if status, res := refreshToken(t, app, clientID, first.RefreshToken); status != http.StatusBadRequest || res.Error != "invalid_grant" {
+		t.Fatalf("reuse: status %d error %q, want invalid_grant", status, res.Error)
+	}
+	if oauthTokenValid(app, second.AccessToken) {
+		t.Fatal("access token still valid after refresh token reuse")
+	}
+	if status, _ := refreshToken(t, app, clientID, second.RefreshToken); status != http.StatusBadRequest {
+		t.Fatalf("refresh after reuse: status %d, want 400", status)
+	}
+}
+
+func TestOAuthRevoke(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	clientID := createTestOAuthClient(t, app, alice)
+	otherClient := createTestOAuthClient(t, app, alice)
+
+	code := authorizeTestClient(t, app, alice, clientID, testVerifier)
+	_, tokens := exchangeCode(t, app, clientID, code, testVerifier, testRedirectURI)
+
+	revoke := func(clientID, token string) int {
+		w := httptest.NewRecorder()
+		app.oauthRevokeHandler(w, formRequest("/oauth/revoke", url.Values{"client_id": {clientID}, "token": {token}}))
+		return w.Code
+	}
+
+	// 他のクライアントからは失効できない（RFC 7009 に従い200は返す）
+	if status := revoke(otherClient, tokens.RefreshToken); status != http.StatusOK {
+		t.Fatalf("revoke from other client: status %d", status)
+	}
+	if !oauthTokenValid(app, tokens.AccessToken) {
+		t.Fatal("token revoked by another client")
+	}
+
+	if status := revoke(clientID, tokens.RefreshToken); status != http.StatusOK {
+		t.Fatalf("revoke: status %d", status)
+	}
+	if oauthTokenValid(app, tokens.AccessToken) {
+		t.Fatal("access token valid after revoking its refresh token")
+	}
+	if status, _ := refreshToken(t, app, clientID, tokens.RefreshToken); status != http.StatusBadRequest {
+		t.Fatalf("refresh after revoke: status %d, want 400", status)
+	}
+}
+
+func TestOAuthConfidentialClientAuthentication(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	clientID := createTestOAuthClient(t, app, alice)
+	secret := randomToken(32)
+	if _, err := app.db.Exec("UPDATE oauth_clients SET secret_hash = ? WHERE client_id = ?", hashToken(secret), clientID); err != nil {
+		t.Fatal(err)
+	}
+
+	code := authorizeTestClient(t, app, alice, clientID, testVerifier)
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"code_verifier": {testVerifier},
+		"redirect_uri":  {testRedirectURI},
+	}
+
+	r := formRequest("/oauth/token", form)
+	r.SetBasicAuth(clientID, "wrong-secret")
+	w := httptest.NewRecorder()
+	app.oauthTokenHandler(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret: status %d, want 401", w.Code)
+	}
+
+	r = formRequest("/oauth/token", form)
+	r.SetBasicAuth(clientID, secret)
+	w = httptest.NewRecorder()
+	app.oauthTokenHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("correct secret: status %d %s", w.Code, w.Body.String())
+	}
+}
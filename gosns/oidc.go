@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookie     = "oidc_state"
+	oidcStateTTL        = 10 * time.Minute
+	oidcJWKSMinInterval = time.Minute
+	oidcHTTPTimeout     = 10 * time.Second
+)
+
+// OpenID Connect プロバイダー
+type OIDCProvider struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	HTTPClient   *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// IDトークンのクレーム
+type OIDCClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Picture           string `json:"picture"`
+	AuthorizedParty   string `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// ログイン画面に表示するプロバイダー情報
+type ProviderInfo struct {
+	Name        string
+	DisplayName string
+}
+
+// 設定からプロバイダーを生成
+func loadOIDCProviders(configs map[string]OIDCProviderConfig) map[string]*OIDCProvider {
+	providers := make(map[string]*OIDCProvider)
+	for name, c := range configs {
+		displayName := c.DisplayName
+		if displayName == "" {
+			displayName = name
+		}
+		providers[name] = &OIDCProvider{
+			Name:         name,
+			DisplayName:  displayName,
+			Issuer:       c.Issuer,
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+		}
+	}
+	return providers
+}
+
+// ログイン画面用のプロバイダー一覧
+func (app *App) providerInfos() []ProviderInfo {
+	infos := make([]ProviderInfo, 0, len(app.providers))
+	for _, p := range app.providers {
+		infos = append(infos, ProviderInfo{Name: p.Name, DisplayName: p.DisplayName})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (p *OIDCProvider) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return &http.Client{Timeout: oidcHTTPTimeout}
+}
+
+func (p *OIDCProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.httpClient().Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// ディスカバリードキュメント取得（初回のみ）
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("discovery for %s: %w", p.Name, err)
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery for %s: issuer mismatch %q", p.Name, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery for %s: missing endpoints", p.Name)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *OIDCProvider) oauth2Config() (*oauth2.Config, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  baseURL + "/auth/" + p.Name + "/callback",
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  d.AuthorizationEndpoint,
+			TokenURL: d.TokenEndpoint,
+		},
+	}, nil
+}
+
+// 署名検証用の公開鍵を取得（未知のkidの場合は再取得）
+func (p *OIDCProvider) signingKey(kid string) (interface{}, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcJWKSMinInterval && p.keys != nil {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URL(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		exp := 0
+		for _, b := range e {
+			exp = exp<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := decodeBase64URL(k.X)
+		y, err2 := decodeBase64URL(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC point not on curve")
+		}
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// IDトークンの署名・発行者・対象者・有効期限・nonceを検証
+func (p *OIDCProvider) verifyIDToken(raw, nonce string) (*OIDCClaims, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &OIDCClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.signingKey(kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, errors.New("azp does not match client id")
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing subject")
+	}
+	return claims, nil
+}
+
+// ログイン開始
+func (app *App) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	app.startOIDCFlow(w, r, provider, 0)
+}
+
+// 認可エンドポイントへリダイレクト（linkUserID が 0 以外の場合はアカウント連携）
+func (app *App) startOIDCFlow(w http.ResponseWriter, r *http.Request, provider *OIDCProvider, linkUserID int) {
+	config, err := provider.oauth2Config()
+	if err != nil {
+		log.Println("OIDC設定取得エラー:", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := randomToken(24)
+	nonce := randomToken(24)
+	verifier := oauth2.GenerateVerifier()
+	expires := time.Now().Add(oidcStateTTL).Unix()
+
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcStateCookie,
+		Value: signToken(strings.Join([]string{provider.Name, state, nonce, verifier,
+			strconv.Itoa(linkUserID), strconv.FormatInt(expires, 10)}, ".")),
+		HttpOnly: true,
+		Secure:   false,
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		Path:     "/auth/" + provider.Name,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	url := config.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+// state Cookie の検証
+func readOIDCState(r *http.Request, providerName string) (state, nonce, verifier string, linkUserID int, ok bool) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return "", "", "", 0, false
+	}
+	payload, valid := verifySignedToken(cookie.Value)
+	if !valid {
+		return "", "", "", 0, false
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 6 || parts[0] != providerName {
+		return "", "", "", 0, false
+	}
+	linkUserID, err = strconv.Atoi(parts[4])
+	if err != nil {
+		return "", "", "", 0, false
+	}
+	expires, err := strconv.ParseInt(parts[5], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", "", "", 0, false
+	}
+	return parts[1], parts[2], parts[3], linkUserID, true
+}
+
+// コールバック
+func (app *App) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := app.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, nonce, verifier, linkUserID, ok := readOIDCState(r, provider.Name)
+	if !ok || state != r.URL.Query().Get("state") {
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/auth/" + provider.Name,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// 連携はフロー開始時と同じユーザーでログインしている場合のみ
+	if linkUserID > 0 {
+		if app.getCurrentUserID(w, r) != linkUserID {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+	}
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		if linkUserID > 0 {
+			http.Redirect(w, r, "/settings/connections", http.StatusSeeOther)
+			return
+		}
+		app.recordLogin(r, 0, "", provider.Name, false)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	config, err := provider.oauth2Config()
+	if err != nil {
+		log.Println("OIDC設定取得エラー:", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, provider.httpClient())
+	token, err := config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		app.recordLogin(r, 0, "", provider.Name, false)
+		http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
+		return
+	}
+
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		app.recordLogin(r, 0, "", provider.Name, false)
+		http.Error(w, "Missing ID token", http.StatusBadGateway)
+		return
+	}
+
+	claims, err := provider.verifyIDToken(rawIDToken, nonce)
+	if err != nil {
+		log.Printf("IDトークン検証エラー (%s): %v", provider.Name, err)
+		app.recordLogin(r, 0, "", provider.Name, false)
+		http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+
+	if linkUserID > 0 {
+		app.finishIdentityLink(w, r, provider, claims, linkUserID)
+		return
+	}
+
+	userID, username, err := app.findIdentityUser(provider.Name, claims.Subject)
+	if err == sql.ErrNoRows {
+		// 同じメールアドレスの既存アカウントには自動でログインさせず、確認を求める
+		var existingID int
+		if claims.Email != "" && app.db.QueryRow("SELECT id FROM users WHERE email = ?", claims.Email).Scan(&existingID) == nil {
+			setPendingLink(w, provider.Name, claims.Subject, claims.Email, existingID)
+			http.Redirect(w, r, "/login/link", http.StatusSeeOther)
+			return
+		}
+		userID, username, err = app.createExternalUser(provider.Name, claims)
+	}
+	if err != nil {
+		log.Printf("外部ユーザー取得エラー (%s): %v", provider.Name, err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+
+	app.recordLogin(r, userID, claims.Email, provider.Name, true)
+	app.completeLogin(w, r, userID, username)
+}
+
+// 外部IDから作るユーザー名の最大文字数（重複時に付ける番号を含む）
+const maxExternalUsernameLen = 30
+
+// 既存ユーザーと重複しないユーザー名を生成
+// プロバイダーから渡された名前はメンションとして使える文字だけを残し、長さを制限する
+func (app *App) uniqueUsername(base string) string {
+	base = cleanUsername(base)
+	if base == "" {
+		base = "user"
+	}
+
+	username := base
+	for i := 2; ; i++ {
+		var count int
+		app.db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username).Scan(&count)
+		if count == 0 {
+			return username
+		}
+		suffix := strconv.Itoa(i)
+		username = truncateUsername(base, maxExternalUsernameLen-len(suffix)) + suffix
+	}
+}
+
+// 英数字（各言語の文字を含む）と「_」「.」「-」以外を除き、先頭・末尾の「.」「-」を取り除く
+func cleanUsername(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_' || r == '.' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	return truncateUsername(b.String(), maxExternalUsernameLen)
+}
+
+func truncateUsername(name string, n int) string {
+	if runes := []rune(name); len(runes) > n {
+		name = string(runes[:n])
+	}
+	return strings.Trim(name, ".-")
+}
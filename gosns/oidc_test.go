@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// ディスカバリー・JWKS・トークンエンドポイントを持つテスト用のIDプロバイダー
+type fakeIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu        sync.Mutex
+	kid       string
+	key       *rsa.PrivateKey
+	codes     map[string]fakeAuthCode
+	jwksHits  int
+	editToken func(claims jwt.MapClaims)
+}
+
+type fakeAuthCode struct {
+	nonce     string
+	challenge string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	idp := &fakeIdP{t: t, codes: make(map[string]fakeAuthCode)}
+	idp.rotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// 署名鍵を新しいkidで作り直す
+func (idp *fakeIdP) rotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.key = key
+	idp.kid = randomToken(8)
+}
+
+func (idp *fakeIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.jwksHits++
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+// 認可エンドポイントでの同意を省略してコードを発行する
+func (idp *fakeIdP) authorize(nonce, challenge string) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	code := randomToken(16)
+	idp.codes[code] = fakeAuthCode{nonce: nonce, challenge: challenge}
+	return code
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	idp.mu.Lock()
+	code, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	// PKCE の code_verifier を確認
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"sub":            "subject-1",
+		"aud":            "gosns",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          code.nonce,
+		"email":          "alice@idp.example",
+		"email_verified": true,
+	}
+	if idp.editToken != nil {
+		idp.editToken(claims)
+	}
+
+	idp.mu.Lock()
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = idp.kid
+	idToken, err := tok.SignedString(idp.key)
+	idp.mu.Unlock()
+	if err != nil {
+		idp.t.Error(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// テスト用のアプリとプロバイダー、ログイン・コールバックのルーター
+func newOIDCTestApp(t *testing.T) (*App, *fakeIdP, *OIDCProvider, http.Handler) {
+	app, _ := newTestApp(t)
+	idp := newFakeIdP(t)
+	provider := &OIDCProvider{
+		Name:         "test",
+		DisplayName:  "Test",
+		Issuer:       idp.server.URL,
+		ClientID:     "gosns",
+		ClientSecret: "secret",
+		HTTPClient:   idp.server.Client(),
+	}
+	app.providers["test"] = provider
+
+	r := mux.NewRouter()
+	r.HandleFunc("/auth/{provider}", app.oidcLoginHandler)
+	r.HandleFunc("/auth/{provider}/callback", app.oidcCallbackHandler)
+	return app, idp, provider, r
+}
+
+// ログイン開始から認可エンドポイントへのリダイレクトまで
+type oidcFlow struct {
+	state     string
+	nonce     string
+	challenge string
+	cookie    *http.Cookie
+}
+
+func startTestOIDCFlow(t *testing.T, h http.Handler) oidcFlow {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/auth/test", nil))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("login: status %d", w.Code)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := loc.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "gosns" {
+		t.Fatalf("unexpected authorization request %s", loc)
+	}
+
+	flow := oidcFlow{state: q.Get("state"), nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			flow.cookie = c
+		}
+	}
+	if flow.cookie == nil || flow.state == "" || flow.nonce == "" {
+		t.Fatalf("incomplete flow %+v", flow)
+	}
+	return flow
+}
+
+func oidcCallback(h http.Handler, cookie *http.Cookie, state, code string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/auth/test/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// 正常なフローを最後まで進める
+func completeTestOIDCFlow(t *testing.T, h http.Handler, idp *fakeIdP) *httptest.ResponseRecorder {
+	t.Helper()
+	flow := startTestOIDCFlow(t, h)
+	return oidcCallback(h, flow.cookie, flow.state, idp.authorize(flow.nonce, flow.challenge))
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	app, idp, _, h := newOIDCTestApp(t)
+
+	w := completeTestOIDCFlow(t, h, idp)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("callback: status %d location %q body %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+
+	userID, _, err := app.findIdentityUser("test", "subject-1")
+	if err != nil {
+		t.Fatalf("identity not created: %v", err)
+	}
+	if !app.isVerified(userID) {
+		t.Fatal("user with verified email from provider is not verified")
+	}
+
+	// 2回目は同じユーザーでログインする
+	if w := completeTestOIDCFlow(t, h, idp); w.Code != http.StatusSeeOther {
+		t.Fatalf("second login: status %d", w.Code)
+	}
+	var count int
+	app.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	if count != 1 {
+		t.Fatalf("users = %d, want 1", count)
+	}
+}
+
+// プロバイダーが渡すユーザー名は整形してから使う
+func TestOIDCCleansPreferredUsername(t *testing.T) {
+	app, idp, _, h := newOIDCTestApp(t)
+	idp.editToken = func(claims jwt.MapClaims) {
+		claims["preferred_username"] = "<b>" + strings.Repeat("太郎", 20) + "</b>"
+	}
+
+	if w := completeTestOIDCFlow(t, h, idp); w.Code != http.StatusSeeOther {
+		t.Fatalf("callback: status %d", w.Code)
+	}
+	_, username, err := app.findIdentityUser("test", "subject-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "b" + strings.Repeat("太郎", 14) + "太"; username != want {
+		t.Fatalf("username = %q, want %q", username, want)
+	}
+}
+
+func TestUniqueUsername(t *testing.T) {
+	app, _ := newTestApp(t)
+	createTestUser(t, app, "alice", true)
+	createTestUser(t, app, "alice2", true)
+	long := strings.Repeat("x", maxExternalUsernameLen)
+	createTestUser(t, app, long, true)
+
+	tests := []struct {
+		base, want string
+	}{
+		{"bob", "bob"},
+		{"alice", "alice3"},
+		{"  bob smith ", "bobsmith"},
+		{"-.bob.-", "bob"},
+		{"山田_taro", "山田_taro"},
+		{"<script>", "script"},
+		{"!!!", "user"},
+		{"", "user"},
+		{long + "yyy", long[:maxExternalUsernameLen-1] + "2"},
+	}
+	for _, tc := range tests {
+		if got := app.uniqueUsername(tc.base); got != tc.want {
+			t.Errorf("uniqueUsername(%q) = %q, want %q", tc.base, got, tc.want)
+		}
+	}
+}
+
+func TestOIDCRejectsInvalidIDToken(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(jwt.MapClaims)
+	}{
+		{"issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }},
+		{"audience", func(c jwt.MapClaims) { c["aud"] = "other-client" }},
+		{"azp", func(c jwt.MapClaims) { c["aud"] = []string{"gosns", "other-client"}; c["azp"] = "other-client" }},
+		{"nonce", func(c jwt.MapClaims) { c["nonce"] = "wrong" }},
+		{"missing nonce", func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"missing exp", func(c jwt.MapClaims) { delete(c, "exp") }},
+		{"missing subject", func(c jwt.MapClaims) { delete(c, "sub") }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app, idp, _, h := newOIDCTestApp(t)
+			idp.editToken = tc.edit
+
+			w := completeTestOIDCFlow(t, h, idp)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("status %d, want 401", w.Code)
+			}
+			var count int
+			app.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+			if count != 0 {
+				t.Fatalf("user created from invalid token")
+			}
+		})
+	}
+}
+
+func TestOIDCRefetchesJWKSForUnknownKeyID(t *testing.T) {
+	_, idp, provider, h := newOIDCTestApp(t)
+
+	if w := completeTestOIDCFlow(t, h, idp); w.Code != http.StatusSeeOther {
+		t.Fatalf("first login: status %d", w.Code)
+	}
+	if idp.jwksHits != 1 {
+		t.Fatalf("jwks fetched %d times, want 1", idp.jwksHits)
+	}
+
+	// 直前に取得したばかりなら未知のkidでも再取得しない
+	idp.rotateKey()
+	if w := completeTestOIDCFlow(t, h, idp); w.Code != http.StatusUnauthorized {
+		t.Fatalf("login right after rotation: status %d, want 401", w.Code)
+	}
+	if idp.jwksHits != 1 {
+		t.Fatalf("jwks fetched %d times within min interval, want 1", idp.jwksHits)
+	}
+
+	provider.mu.Lock()
+	provider.keysFetched = time.Now().Add(-2 * oidcJWKSMinInterval)
+	provider.mu.Unlock()
+
+	if w := completeTestOIDCFlow(t, h, idp); w.Code != http.StatusSeeOther {
+		t.Fatalf("login after rotation: status %d body %s", w.Code, w.Body)
+	}
+	if idp.jwksHits != 2 {
+		t.Fatalf("jwks fetched %d times, want 2", idp.jwksHits)
+	}
+}
+
+func TestOIDCRejectsStateMismatch(t *testing.T) {
+	_, idp, _, h := newOIDCTestApp(t)
+	flow := startTestOIDCFlow(t, h)
+	code := idp.authorize(flow.nonce, flow.challenge)
+
+	if w := oidcCallback(h, flow.cookie, "forged-state", code); w.Code != http.StatusBadRequest {
+		t.Fatalf("forged state: status %d, want 400", w.Code)
+	}
+	if w := oidcCallback(h, nil, flow.state, code); w.Code != http.StatusBadRequest {
+		t.Fatalf("missing cookie: status %d, want 400", w.Code)
+	}
+
+	tampered := *flow.cookie
+	tampered.Value = "x" + tampered.Value
+	if w := oidcCallback(h, &tampered, flow.state, code); w.Code != http.StatusBadRequest {
+		t.Fatalf("tampered cookie: status %d, want 400", w.Code)
+	}
+}
+
+func TestOIDCRejectsPKCEMismatch(t *testing.T) {
+	app, idp, _, h := newOIDCTestApp(t)
+
+	// 別のフローのコードチャレンジに対して発行されたコードは交換できない
+	first := startTestOIDCFlow(t, h)
+	second := startTestOIDCFlow(t, h)
+	code := idp.authorize(second.nonce, first.challenge)
+
+	w := oidcCallback(h, second.cookie, second.state, code)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500", w.Code)
+	}
+	var count int
+	app.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	if count != 0 {
+		t.Fatal("user created despite PKCE mismatch")
+	}
+}
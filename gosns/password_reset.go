@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	passwordResetTTL  = time.Hour
+	passwordResetWait = time.Minute
+)
+
+// リセット申請後は登録有無に関わらず同じメッセージを返す
+const passwordResetSentMessage = "入力されたメールアドレスが登録されている場合、パスワード再設定用のメールを送信しました"
+
+// パスワード再設定メール送信
+func (app *App) sendPasswordResetEmail(userID int, email string) error {
+	var recent int
+	app.db.QueryRow("SELECT COUNT(*) FROM password_resets WHERE user_id = ? AND created_at > ?",
+		userID, sqlTime(time.Now().Add(-passwordResetWait))).Scan(&recent)
+	if recent > 0 {
+		return nil
+	}
+
+	token := randomToken(32)
+	_, err := app.db.Exec("INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, ?)",
+		userID, hashToken(token), sqlTime(time.Now().Add(passwordResetTTL)))
+	if err != nil {
+		return err
+	}
+
+	link := baseURL + "/password/reset?token=" + url.QueryEscape(token)
+	return app.mailer.Send(Message{
+		To:      email,
+		Subject: "【GoSNS】パスワードの再設定",
+		Body: "パスワード再設定のリクエストを受け付けました。\n\n" +
+			"以下のリンクから新しいパスワードを設定してください（1時間有効）。\n\n" +
+			link + "\n\n" +
+			"心当たりがない場合はこのメールを破棄してください。\n",
+	})
+}
+
+// 有効なリセットトークンからユーザーIDを取得
+func (app *App) lookupPasswordReset(token string) (int, error) {
+	var userID int
+	err := app.db.QueryRow(`SELECT user_id FROM password_resets
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`,
+		hashToken(token), sqlTime(time.Now())).Scan(&userID)
+	if err != nil {
+		return 0, fmt.Errorf("reset token not found or expired")
+	}
+	return userID, nil
+}
+
+// パスワード更新と既存のセッション・アクセストークン・連携アプリのトークンの失効
+func (app *App) resetPassword(token, password string) error {
+	hashedPassword, err := app.hashPasswordLimited(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(`SELECT user_id FROM password_resets
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`,
+		hashToken(token), sqlTime(time.Now())).Scan(&userID)
+	if err != nil {
+		return fmt.Errorf("reset token not found or expired")
+	}
+
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND used_at IS NULL",
+		userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		hashedPassword, userID); err != nil {
+		return err
+	}
+
+	// 既存のセッションをすべて失効させる
+	if _, err := tx.Exec("UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND revoked_at IS NULL",
+		userID); err != nil {
+		return err
+	}
+
+	// 乗っ取られたアカウントの復旧に使われるため、APIのトークンも失効させる
+	if _, err := tx.Exec("DELETE FROM access_tokens WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE oauth_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND revoked_at IS NULL",
+		userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// パスワード再設定申請ページ
+func (app *App) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	data := PageData{Title: "パスワードの再設定"}
+	if r.Method == "GET" {
+		app.renderTemplate(w, r, "forgot_password", data)
+		return
+	}
+
+	email := r.FormValue("email")
+
+	var userID int
+	err := app.db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	if err == nil {
+		// 応答時間からアカウントの有無を推測されないよう非同期で送信
+		go func() {
+			if err := app.sendPasswordResetEmail(userID, email); err != nil {
+				log.Println("パスワード再設定メール送信エラー:", err)
+			}
+		}()
+	}
+
+	data.Message = passwordResetSentMessage
+	app.renderTemplate(w, r, "forgot_password", data)
+}
+
+// パスワード再設定ページ
+func (app *App) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	data := PageData{
+		Title: "パスワードの再設定",
+		Token: token,
+	}
+
+	if _, err := app.lookupPasswordReset(token); err != nil {
+		data.Error = "再設定リンクが無効か、有効期限が切れています"
+		data.Token = ""
+		app.renderTemplate(w, r, "reset_password", data)
+		return
+	}
+
+	if r.Method == "GET" {
+		app.renderTemplate(w, r, "reset_password", data)
+		return
+	}
+
+	password := r.FormValue("password")
+	if password != r.FormValue("confirm_password") {
+		data.Error = "パスワードが一致しません"
+		app.renderTemplate(w, r, "reset_password", data)
+		return
+	}
+
+	if err := app.resetPassword(token, password); err != nil {
+		log.Println("パスワード再設定エラー:", err)
+		data.Error = "パスワードの再設定に失敗しました"
+		data.Token = ""
+		app.renderTemplate(w, r, "reset_password", data)
+		return
+	}
+
+	// 現在のCookieも無効になっているため削除してログインし直してもらう
+	clearSessionCookies(w)
+
+	app.renderTemplate(w, r, "login", PageData{
+		Title:     "ログイン",
+		Message:   "パスワードを再設定しました。新しいパスワードでログインしてください（アクセストークンと連携アプリの許可も取り消しました）",
+		Providers: app.providerInfos(),
+	})
+}
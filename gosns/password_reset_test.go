@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPasswordResetRevokesAPITokens(t *testing.T) {
+	app, mailer := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	bob := createTestUser(t, app, "bob", true)
+
+	loginCookie(t, app, alice)
+	pat, err := app.createAccessToken(alice, "attacker", []string{scopeWrite}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientID := createTestOAuthClient(t, app, bob)
+	_, oauth := exchangeCode(t, app, clientID, authorizeTestClient(t, app, alice, clientID, testVerifier), testVerifier, testRedirectURI)
+	bobPAT, err := app.createAccessToken(bob, "bob", []string{scopeRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.sendPasswordResetEmail(alice, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := mailer.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("%d messages, want 1", len(msgs))
+	}
+	i := strings.Index(msgs[0].Body, "/password/reset?")
+	if i < 0 {
+		t.Fatalf("reset link not found in %q", msgs[0].Body)
+	}
+	link, err := url.Parse(strings.Fields(msgs[0].Body[i:])[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.resetPassword(link.Query().Get("token"), "new password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(app.getActiveSessions(alice, "")); n != 0 {
+		t.Errorf("%d sessions still active", n)
+	}
+	if _, err := app.authenticateAccessToken(pat); err == nil {
+		t.Error("personal access token still valid")
+	}
+	if oauthTokenValid(app, oauth.AccessToken) {
+		t.Error("OAuth access token still valid")
+	}
+	if status, _ := refreshToken(t, app, clientID, oauth.RefreshToken); status == http.StatusOK {
+		t.Error("OAuth refresh token still usable")
+	}
+
+	// 他のユーザーのトークンには影響しない
+	if _, err := app.authenticateAccessToken(bobPAT); err != nil {
+		t.Error("another user's token was revoked")
+	}
+}
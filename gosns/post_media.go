@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const postMediaColumns = `id, post_id, position, type, status, url, feed_url, thumb_url, poster_url,
+	alt, width, height, duration, blurhash`
+
+// 投稿に添付するファイル（画像4枚まで、または動画1本）
+type postAttachments struct {
+	images []*savedImage
+	video  *savedVideo
+	alts   []string
+}
+
+func (a *postAttachments) alt(i int) string {
+	if i < len(a.alts) {
+		return strings.TrimSpace(a.alts[i])
+	}
+	return ""
+}
+
+// 添付ファイルを投稿に登録する（送信された順に並べる）
+// 動画の場合は変換ジョブに渡すメディアIDを返す
+func insertPostMedia(db execer, postID int, att *postAttachments) (int, error) {
+	for i, img := range att.images {
+		size := img.sizes["full"]
+		_, err := db.Exec(`INSERT INTO post_media (post_id, position, type, url, feed_url, thumb_url, alt, width, height, blurhash)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			postID, i, mediaTypeImage, img.refs["full"], img.refs["feed"], img.refs["thumb"], att.alt(i), size.X, size.Y, img.blurhash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if att.video == nil {
+		return 0, nil
+	}
+	// 変換が終わるまでは元ファイルを url に保持する
+	v := att.video
+	result, err := db.Exec(`INSERT INTO post_media (post_id, position, type, status, url, alt, width, height, duration)
+		VALUES (?, 0, ?, ?, ?, ?, ?, ?, ?)`,
+		postID, v.kind, mediaStatusProcessing, v.ref, att.alt(0), v.info.width, v.info.height, v.info.duration)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (app *App) scanPostMedia(row rowScanner) (PostMedia, error) {
+	var m PostMedia
+	err := row.Scan(&m.ID, &m.PostID, &m.Position, &m.Type, &m.Status, &m.URL, &m.FeedURL, &m.ThumbURL, &m.PosterURL,
+		&m.Alt, &m.Width, &m.Height, &m.Duration, &m.Blurhash)
+	if err != nil {
+		return m, err
+	}
+	// 処理中の元ファイルは配信しない
+	if m.Status != mediaStatusReady {
+		m.URL = ""
+	}
+	m.URL = app.mediaURL(m.URL)
+	m.FeedURL = app.mediaURL(m.FeedURL)
+	m.ThumbURL = app.mediaURL(m.ThumbURL)
+	m.PosterURL = app.mediaURL(m.PosterURL)
+	return m, nil
+}
+
+// 投稿一覧に添付メディアをまとめて読み込む
+func (app *App) attachPostMedia(posts []Post) {
+	if len(posts) == 0 {
+		return
+	}
+
+	index := make(map[int]int, len(posts))
+	ids := make([]interface{}, len(posts))
+	placeholders := make([]string, len(posts))
+	for i := range posts {
+		index[posts[i].ID] = i
+		ids[i] = posts[i].ID
+		placeholders[i] = "?"
+		posts[i].Media = []PostMedia{}
+	}
+
+	rows, err := app.db.Query(`SELECT `+postMediaColumns+`
+		FROM post_media WHERE post_id IN (`+strings.Join(placeholders, ",")+`)
+		ORDER BY post_id, position`, ids...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m, err := app.scanPostMedia(rows)
+		if err != nil {
+			continue
+		}
+
+		post := &posts[index[m.PostID]]
+		// 1枚目の画像は従来の image_url 系フィールドにも設定する
+		if len(post.Media) == 0 && m.Type == mediaTypeImage {
+			post.ImageURL = m.URL
+			post.ImageFeedURL = m.FeedURL
+			post.ImageThumbURL = m.ThumbURL
+		}
+		post.Media = append(post.Media, m)
+	}
+}
+
+// 投稿に添付されたファイルの参照（削除用）
+func (app *App) postMediaRefs(postID int) []string {
+	rows, err := app.db.Query("SELECT url, feed_url, thumb_url, poster_url FROM post_media WHERE post_id = ?", postID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var refs []string
+	for rows.Next() {
+		var url, feedURL, thumbURL, posterURL string
+		if err := rows.Scan(&url, &feedURL, &thumbURL, &posterURL); err != nil {
+			continue
+		}
+		refs = append(refs, url, feedURL, thumbURL, posterURL)
+	}
+	return refs
+}
+
+// フォームで送信された添付ファイルと代替テキストを保存する
+func (app *App) savePostMedia(r *http.Request) (*postAttachments, error) {
+	files := uploadedFiles(r, "images")
+	// 旧フォームの単一画像フィールドにも対応
+	files = append(files, uploadedFiles(r, "image")...)
+	if len(files) > maxPostImages {
+		return nil, errTooManyImages
+	}
+
+	alts := r.Form["alt"]
+	for _, alt := range alts {
+		if utf8.RuneCountInString(strings.TrimSpace(alt)) > maxAltTextLength {
+			return nil, errAltTooLong
+		}
+	}
+
+	att := &postAttachments{alts: alts}
+	for _, header := range files {
+		kind, err := app.videoKind(header)
+		if err == nil && kind != "" && len(files) > 1 {
+			err = errMixedMedia
+		}
+		if err != nil {
+			app.deletePostAttachments(r.Context(), att)
+			return nil, err
+		}
+
+		if kind != "" {
+			if att.video, err = app.saveVideo(r.Context(), header, kind); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		img, err := app.saveImage(r.Context(), header, maxPostImageSize, postImageVariants)
+		if err != nil {
+			app.deletePostAttachments(r.Context(), att)
+			return nil, err
+		}
+		att.images = append(att.images, img)
+	}
+	return att, nil
+}
+
+// 保存済みの添付ファイルを削除（投稿の作成に失敗した場合）
+func (app *App) deletePostAttachments(ctx context.Context, att *postAttachments) {
+	app.deleteSavedImages(ctx, att.images...)
+	if att.video != nil {
+		app.deleteMedia(ctx, att.video.ref)
+	}
+}
+
+// 返信先・引用元の投稿（0 の場合はなし）
+type postRefs struct {
+	replyTo int
+	quoteOf int
+}
+
+// 投稿と添付ファイルを作成し、動画があれば変換ジョブに登録する
+func (app *App) createPost(userID int, content string, refs postRefs, att *postAttachments) (int, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var inReplyTo, rootID, quoteOf sql.NullInt64
+	if refs.replyTo != 0 {
+		root, err := threadRoot(tx, refs.replyTo)
+		if err != nil {
+			return 0, err
+		}
+		inReplyTo = sql.NullInt64{Int64: int64(refs.replyTo), Valid: true}
+		rootID = sql.NullInt64{Int64: int64(root), Valid: true}
+		if _, err := tx.Exec("UPDATE posts SET comments = comments + 1 WHERE id = ?", refs.replyTo); err != nil {
+			return 0, err
+		}
+	}
+	if refs.quoteOf != 0 {
+		if err := requirePost(tx, refs.quoteOf); err != nil {
+			return 0, err
+		}
+		quoteOf = sql.NullInt64{Int64: int64(refs.quoteOf), Valid: true}
+	}
+
+	result, err := tx.Exec("INSERT INTO posts (user_id, content, in_reply_to, root_id, quote_of) VALUES (?, ?, ?, ?, ?)",
+		userID, content, inReplyTo, rootID, quoteOf)
+	if err != nil {
+		return 0, err
+	}
+	postID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := savePostTags(tx, int(postID), content); err != nil {
+		return 0, err
+	}
+	if refs.replyTo != 0 {
+		authorID, err := postAuthor(tx, refs.replyTo)
+		if err != nil {
+			return 0, err
+		}
+		if err := createNotification(tx, authorID, userID, notificationComment, refs.replyTo, int(postID)); err != nil {
+			return 0, err
+		}
+	}
+	if err := savePostMentions(tx, int(postID), userID, content); err != nil {
+		return 0, err
+	}
+	videoID, err := insertPostMedia(tx, int(postID), att)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if videoID != 0 {
+		app.enqueueVideo(videoID)
+	}
+
+	// 接続中のクライアントへ配信する
+	if refs.replyTo != 0 {
+		app.publishCounts(refs.replyTo)
+	} else {
+		app.publishPost(int(postID))
+	}
+	app.publishNotifications(app.notificationRecipients(int(postID))...)
+	return int(postID), nil
+}
+
+// 投稿を削除し、返信先の投稿ID（返信でなければ 0）を返す
+// SQLite の外部キー制約は有効にしていないため、関連する行も同じトランザクションで削除する
+func (app *App) deletePost(postID, userID int) (int, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var parentID int
+	err = tx.QueryRow("SELECT COALESCE(in_reply_to, 0) FROM posts WHERE id = ? AND user_id = ?", postID, userID).
+		Scan(&parentID)
+	if err == sql.ErrNoRows {
+		return 0, errPostNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("DELETE FROM posts WHERE id = ? AND user_id = ?", postID, userID)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return 0, err
+	} else if n != 1 {
+		return 0, errPostNotFound
+	}
+
+	// 返信の場合は返信先の返信数を減らす
+	if parentID != 0 {
+		if _, err := tx.Exec("UPDATE posts SET comments = comments - 1 WHERE id = ?", parentID); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, table := range []string{"likes", "post_media", "post_revisions", "reposts", "post_tags", "post_mentions"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE post_id = ?", postID); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM notifications WHERE post_id = ? OR source_id = ?", postID, postID); err != nil {
+		return 0, err
+	}
+	return parentID, tx.Commit()
+}
+
+// 添付メディアの状態取得API（動画の変換完了の確認に使う）
+func (app *App) getMediaAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid media ID",
+		})
+		return
+	}
+
+	m, err := app.scanPostMedia(app.db.QueryRow("SELECT "+postMediaColumns+" FROM post_media WHERE id = ?", id))
+	if err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Media not found",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Data:    m,
+	})
+}
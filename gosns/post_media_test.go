@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func deletePostRequest(t *testing.T, app *App, postID, userID int) APIResponse {
+	t.Helper()
+
+	r := httptest.NewRequest("DELETE", "/api/posts/"+strconv.Itoa(postID), nil)
+	r = mux.SetURLVars(withUser(r, userID), map[string]string{"id": strconv.Itoa(postID)})
+	w := httptest.NewRecorder()
+	app.deletePostAPI(w, r)
+
+	var resp APIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestDeleteReplyRemovesRelatedRows(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	bob := createTestUser(t, app, "bob", true)
+
+	parent, err := app.createPost(alice, "親の投稿", postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := app.createPost(bob, "@alice 返信 #golang", postRefs{replyTo: parent}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.db.Exec("INSERT INTO likes (user_id, post_id) VALUES (?, ?)", alice, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := deletePostRequest(t, app, reply, alice); resp.Success {
+		t.Fatal("deleted another user's post")
+	}
+	if resp := deletePostRequest(t, app, reply, bob); !resp.Success {
+		t.Fatalf("delete failed: %s", resp.Message)
+	}
+	// 削除済みの投稿を再度削除しても返信数は変わらない
+	if _, err := app.deletePost(reply, bob); err != errPostNotFound {
+		t.Fatalf("second delete: err = %v, want errPostNotFound", err)
+	}
+
+	var comments int
+	app.db.QueryRow("SELECT comments FROM posts WHERE id = ?", parent).Scan(&comments)
+	if comments != 0 {
+		t.Fatalf("parent comments = %d, want 0", comments)
+	}
+
+	for _, q := range []string{
+		"SELECT COUNT(*) FROM posts WHERE id = ?",
+		"SELECT COUNT(*) FROM likes WHERE post_id = ?",
+		"SELECT COUNT(*) FROM post_tags WHERE post_id = ?",
+		"SELECT COUNT(*) FROM post_mentions WHERE post_id = ?",
+		"SELECT COUNT(*) FROM notifications WHERE source_id = ?",
+	} {
+		var n int
+		if err := app.db.QueryRow(q, reply).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%s: %d rows left", q, n)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// リポスト・リポスト解除API（いいねと同じく、もう一度送ると取り消す）
+func (app *App) repostPostAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid post ID",
+		})
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+
+	reposted, err := app.toggleRepost(userID, postID)
+	if err == errPostNotFound {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Post not found",
+		})
+		return
+	}
+	if err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Failed to repost",
+		})
+		return
+	}
+
+	var reposts int
+	app.db.QueryRow("SELECT reposts FROM posts WHERE id = ?", postID).Scan(&reposts)
+	app.publishCounts(postID)
+
+	json.NewEncoder(w).Encode(APIResponse{
+		Success:  true,
+		Reposts:  reposts,
+		Reposted: reposted,
+	})
+}
+
+// リポストを切り替え、リポストした状態になったかどうかを返す
+func (app *App) toggleRepost(userID, postID int) (bool, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := requirePost(tx, postID); err != nil {
+		return false, err
+	}
+
+	result, err := tx.Exec("DELETE FROM reposts WHERE user_id = ? AND post_id = ?", userID, postID)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if removed > 0 {
+		_, err = tx.Exec("UPDATE posts SET reposts = reposts - 1 WHERE id = ?", postID)
+	} else {
+		if _, err := tx.Exec("INSERT INTO reposts (user_id, post_id) VALUES (?, ?)", userID, postID); err != nil {
+			return false, err
+		}
+		_, err = tx.Exec("UPDATE posts SET reposts = reposts + 1 WHERE id = ?", postID)
+	}
+	if err != nil {
+		return false, err
+	}
+	return removed == 0, tx.Commit()
+}
+
+// 引用元の投稿を埋め込む（引用の引用は展開しない）
+func (app *App) attachQuotedPosts(posts []Post) {
+	var ids []int
+	for _, post := range posts {
+		if post.QuoteOf != 0 {
+			ids = append(ids, post.QuoteOf)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	query, args := postsByIDQuery(ids)
+	quoted := make(map[int]*Post, len(ids))
+	for _, post := range app.queryPostRows(query, args...) {
+		post := post
+		quoted[post.ID] = &post
+	}
+	for i := range posts {
+		posts[i].Quote = quoted[posts[i].QuoteOf]
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func follow(t *testing.T, app *App, follower, following int) {
+	t.Helper()
+
+	if _, err := app.db.Exec("INSERT INTO follows (follower_id, following_id) VALUES (?, ?)", follower, following); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 指定した時刻に投稿する（created_at は秒精度なので順序を明示する）
+func createPostAt(t *testing.T, app *App, userID int, content string, at time.Time) int {
+	t.Helper()
+
+	postID, err := app.createPost(userID, content, postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.db.Exec("UPDATE posts SET created_at = ? WHERE id = ?", sqlTime(at), postID); err != nil {
+		t.Fatal(err)
+	}
+	return postID
+}
+
+func repostRequest(t *testing.T, app *App, userID, postID int) APIResponse {
+	t.Helper()
+
+	r := httptest.NewRequest("POST", "/api/posts/"+strconv.Itoa(postID)+"/repost", nil)
+	r = mux.SetURLVars(withUser(r, userID), map[string]string{"id": strconv.Itoa(postID)})
+	w := httptest.NewRecorder()
+	app.repostPostAPI(w, r)
+
+	var resp APIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Success {
+		t.Fatalf("repost: %s", resp.Message)
+	}
+	return resp
+}
+
+func setRepostTime(t *testing.T, app *App, userID, postID int, at time.Time) {
+	t.Helper()
+
+	if _, err := app.db.Exec("UPDATE reposts SET created_at = ? WHERE user_id = ? AND post_id = ?", sqlTime(at), userID, postID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type timelineEntry struct {
+	id         int
+	repostedBy string
+}
+
+func timelineEntries(app *App, userID int) []timelineEntry {
+	var entries []timelineEntry
+	for _, post := range app.getTimelinePostsPaginated(userID, 20, 0) {
+		entries = append(entries, timelineEntry{post.ID, post.RepostedBy})
+	}
+	return entries
+}
+
+func TestRepostMovesPostToTop(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	bob := createTestUser(t, app, "bob", true)
+	carol := createTestUser(t, app, "carol", true)
+	follow(t, app, alice, bob)
+	follow(t, app, alice, carol)
+
+	now := time.Now()
+	older := createPostAt(t, app, bob, "古い投稿", now.Add(-2*time.Hour))
+	newer := createPostAt(t, app, bob, "新しい投稿", now.Add(-time.Hour))
+
+	resp := repostRequest(t, app, carol, older)
+	if !resp.Reposted || resp.Reposts != 1 {
+		t.Fatalf("repost response %+v, want reposted with 1 repost", resp)
+	}
+	got := timelineEntries(app, alice)
+	want := []timelineEntry{{older, "carol"}, {newer, ""}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("timeline = %v, want %v", got, want)
+	}
+
+	// もう一度送るとリポストを取り消し、元の位置に戻る
+	resp = repostRequest(t, app, carol, older)
+	if resp.Reposted || resp.Reposts != 0 {
+		t.Fatalf("undo response %+v, want not reposted with 0 reposts", resp)
+	}
+	got = timelineEntries(app, alice)
+	want = []timelineEntry{{newer, ""}, {older, ""}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("timeline after undo = %v, want %v", got, want)
+	}
+}
+
+// 同じ投稿が複数回リポストされても1件にまとめ、最後にリポストしたユーザーを表示する。
+// reposted_by は MAX(activity_at) と同じ行から取る SQLite の挙動に依存している。
+func TestTimelineCollapsesDuplicateReposts(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	bob := createTestUser(t, app, "bob", true)
+	carol := createTestUser(t, app, "carol", true)
+	dave := createTestUser(t, app, "dave", true)
+	follow(t, app, alice, bob)
+	follow(t, app, alice, carol)
+	follow(t, app, alice, dave)
+
+	now := time.Now()
+	postID := createPostAt(t, app, bob, "人気の投稿", now.Add(-3*time.Hour))
+	other := createPostAt(t, app, bob, "別の投稿", now.Add(-2*time.Hour))
+
+	// IDの順とリポスト時刻の順をずらす
+	for _, r := range []struct {
+		user int
+		at   time.Time
+	}{
+		{carol, now.Add(-30 * time.Minute)},
+		{dave, now.Add(-10 * time.Minute)},
+		{alice, now.Add(-20 * time.Minute)},
+	} {
+		repostRequest(t, app, r.user, postID)
+		setRepostTime(t, app, r.user, postID, r.at)
+	}
+
+	got := timelineEntries(app, alice)
+	want := []timelineEntry{{postID, "dave"}, {other, ""}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("timeline = %v, want %v", got, want)
+	}
+
+	// 最新のリポストを取り消すと次に新しいリポストの位置になる
+	repostRequest(t, app, dave, postID)
+	got = timelineEntries(app, alice)
+	if len(got) != 2 || got[0] != (timelineEntry{postID, "alice"}) {
+		t.Fatalf("timeline after undo = %v, want alice's repost first", got)
+	}
+	var reposts int
+	app.db.QueryRow("SELECT reposts FROM posts WHERE id = ?", postID).Scan(&reposts)
+	if reposts != 2 {
+		t.Fatalf("reposts = %d, want 2", reposts)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// 投稿後に編集できる期間
+const postEditWindow = time.Hour
+
+// 編集期間内かどうか（テンプレートから編集ボタンの表示判定に使う）
+func (p Post) Editable() bool {
+	return time.Since(p.CreatedAt) < postEditWindow
+}
+
+// 投稿編集API
+// 編集前の内容は post_revisions に保存する
+func (app *App) updatePostAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid post ID",
+		})
+		return
+	}
+
+	userID := r.Context().Value("user_id").(int)
+
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Content is required",
+		})
+		return
+	}
+
+	// 投稿の所有者と編集期間の確認
+	var ownerID int
+	var content string
+	var createdAt time.Time
+	err = app.db.QueryRow("SELECT user_id, content, created_at FROM posts WHERE id = ?", postID).
+		Scan(&ownerID, &content, &createdAt)
+	if err != nil || ownerID != userID {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Unauthorized",
+		})
+		return
+	}
+	if time.Since(createdAt) >= postEditWindow {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Edit window has expired",
+		})
+		return
+	}
+
+	if req.Content != content {
+		if err := app.updatePostContent(postID, userID, req.Content); err != nil {
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: false,
+				Message: "Failed to update post",
+			})
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Message: "Post updated successfully",
+		Post:    app.getPost(postID),
+	})
+}
+
+// 現在の内容を履歴に残してから投稿を更新する
+func (app *App) updatePostContent(postID, userID int, content string) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 履歴の日時はその版が書かれた日時（初版は投稿日時、以降は前回の編集日時）
+	_, err = tx.Exec(`INSERT INTO post_revisions (post_id, content, created_at)
+		SELECT id, content, COALESCE(edited_at, created_at) FROM posts WHERE id = ?`, postID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE posts SET content = ?, edited_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		content, postID)
+	if err != nil {
+		return err
+	}
+	if err := savePostTags(tx, postID, content); err != nil {
+		return err
+	}
+	if err := savePostMentions(tx, postID, userID, content); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// 編集で追加されたメンションを通知する
+	app.publishNotifications(app.notificationRecipients(postID)...)
+	return nil
+}
+
+// 編集履歴API（現在の版から新しい順）
+func (app *App) getPostRevisionsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid post ID",
+		})
+		return
+	}
+
+	revisions, err := app.getPostRevisions(postID)
+	if err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Post not found",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(APIResponse{
+		Success:   true,
+		Revisions: revisions,
+	})
+}
+
+func (app *App) getPostRevisions(postID int) ([]PostRevision, error) {
+	current := PostRevision{PostID: postID, Current: true}
+	var editedAt sql.NullTime
+	err := app.db.QueryRow("SELECT content, created_at, edited_at FROM posts WHERE id = ?", postID).
+		Scan(&current.Content, &current.CreatedAt, &editedAt)
+	if err != nil {
+		return nil, err
+	}
+	if editedAt.Valid {
+		current.CreatedAt = editedAt.Time
+	}
+
+	revisions := []PostRevision{current}
+	rows, err := app.db.Query(`SELECT id, post_id, content, created_at FROM post_revisions
+		WHERE post_id = ? ORDER BY created_at DESC, id DESC`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rev PostRevision
+		if err := rows.Scan(&rev.ID, &rev.PostID, &rev.Content, &rev.CreatedAt); err != nil {
+			continue
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func updatePostRequest(t *testing.T, app *App, postID, userID int, content string) APIResponse {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]string{"content": content})
+	r := httptest.NewRequest("PATCH", "/api/posts/"+strconv.Itoa(postID), strings.NewReader(string(body)))
+	r = mux.SetURLVars(withUser(r, userID), map[string]string{"id": strconv.Itoa(postID)})
+	w := httptest.NewRecorder()
+	app.updatePostAPI(w, r)
+
+	var resp APIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func postContent(t *testing.T, app *App, postID int) string {
+	t.Helper()
+
+	var content string
+	if err := app.db.QueryRow("SELECT content FROM posts WHERE id = ?", postID).Scan(&content); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestUpdatePostOwnerOnly(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	bob := createTestUser(t, app, "bob", true)
+	postID, err := app.createPost(alice, "元の投稿", postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := updatePostRequest(t, app, postID, bob, "書き換え"); resp.Success {
+		t.Fatal("another user edited the post")
+	}
+	if got := postContent(t, app, postID); got != "元の投稿" {
+		t.Fatalf("content = %q after rejected edit", got)
+	}
+	if revs, _ := app.getPostRevisions(postID); len(revs) != 1 {
+		t.Fatalf("%d revisions after rejected edit, want 1", len(revs))
+	}
+}
+
+func TestUpdatePostEditWindow(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	postID, err := app.createPost(alice, "元の投稿", postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := sqlTime(time.Now().Add(-postEditWindow - time.Minute))
+	if _, err := app.db.Exec("UPDATE posts SET created_at = ? WHERE id = ?", old, postID); err != nil {
+		t.Fatal(err)
+	}
+	resp := updatePostRequest(t, app, postID, alice, "期限切れの編集")
+	if resp.Success || resp.Message != "Edit window has expired" {
+		t.Fatalf("response %+v, want edit window error", resp)
+	}
+	if got := postContent(t, app, postID); got != "元の投稿" {
+		t.Fatalf("content = %q after expired edit", got)
+	}
+}
+
+func TestPostRevisionsNewestFirst(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	postID, err := app.createPost(alice, "v1", postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, content := range []string{"v2", "v3"} {
+		if resp := updatePostRequest(t, app, postID, alice, content); !resp.Success {
+			t.Fatalf("edit to %s: %s", content, resp.Message)
+		}
+	}
+	// 同じ内容での更新は履歴を増やさない
+	if resp := updatePostRequest(t, app, postID, alice, "v3"); !resp.Success {
+		t.Fatalf("no-op edit: %s", resp.Message)
+	}
+
+	revs, err := app.getPostRevisions(postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, rev := range revs {
+		contents = append(contents, rev.Content)
+	}
+	if want := []string{"v3", "v2", "v1"}; !reflect.DeepEqual(contents, want) {
+		t.Fatalf("revisions = %v, want %v", contents, want)
+	}
+	if !revs[0].Current || revs[1].Current {
+		t.Fatal("only the first revision should be current")
+	}
+}
+
+func TestUpdatePostReparsesTagsAndMentions(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	bob := createTestUser(t, app, "bob", true)
+	carol := createTestUser(t, app, "carol", true)
+	postID, err := app.createPost(alice, "#golang @bob", postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := updatePostRequest(t, app, postID, alice, "#rust @carol @bob"); !resp.Success {
+		t.Fatalf("edit: %s", resp.Message)
+	}
+
+	var tags []string
+	rows, err := app.db.Query("SELECT tag FROM post_tags WHERE post_id = ? ORDER BY tag", postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var tag string
+		rows.Scan(&tag)
+		tags = append(tags, tag)
+	}
+	rows.Close()
+	if !reflect.DeepEqual(tags, []string{"rust"}) {
+		t.Fatalf("tags = %v, want [rust]", tags)
+	}
+
+	mentioned := func(userID int) bool {
+		var n int
+		app.db.QueryRow("SELECT COUNT(*) FROM post_mentions WHERE post_id = ? AND user_id = ?", postID, userID).Scan(&n)
+		return n == 1
+	}
+	if !mentioned(bob) || !mentioned(carol) {
+		t.Fatal("mentions were not re-parsed")
+	}
+
+	// 新しくメンションされたユーザーにだけ通知する
+	notifications := func(userID int) int {
+		var n int
+		app.db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND type = ? AND post_id = ?",
+			userID, notificationMention, postID).Scan(&n)
+		return n
+	}
+	if n := notifications(carol); n != 1 {
+		t.Fatalf("carol has %d mention notifications, want 1", n)
+	}
+	if n := notifications(bob); n != 1 {
+		t.Fatalf("bob has %d mention notifications, want 1 (not notified again)", n)
+	}
+
+	if resp := updatePostRequest(t, app, postID, alice, "メンションなし"); !resp.Success {
+		t.Fatalf("edit: %s", resp.Message)
+	}
+	if mentioned(bob) || mentioned(carol) {
+		t.Fatal("removed mentions are still stored")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3互換ストレージ（AWS S3・MinIO・Cloudflare R2 など）への保存
+// リクエストは AWS Signature Version 4 で署名する
+type S3MediaStore struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	publicURL  string
+	pathStyle  bool
+	HTTPClient *http.Client
+}
+
+const (
+	s3Algorithm        = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	s3MaxPresignExpiry = 7 * 24 * time.Hour
+)
+
+func newS3MediaStore(cfg S3Config) (*S3MediaStore, error) {
+	endpoint, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %q", cfg.Endpoint)
+	}
+	return &S3MediaStore{
+		endpoint:   endpoint,
+		region:     cfg.Region,
+		bucket:     cfg.Bucket,
+		accessKey:  cfg.AccessKey,
+		secretKey:  cfg.SecretKey,
+		publicURL:  strings.TrimRight(cfg.PublicURL, "/"),
+		pathStyle:  cfg.pathStyle(),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// オブジェクトのURL（パス形式: endpoint/bucket/key、仮想ホスト形式: bucket.endpoint/key）
+func (s *S3MediaStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimRight(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimRight(u.Path, "/") + "/" + key
+	}
+	u.RawPath = s3EncodePath(u.Path)
+	return &u
+}
+
+func (s *S3MediaStore) Put(ctx context.Context, key string, data io.Reader, size int64, contentType string) error {
+	if !validMediaKey(key) {
+		return errInvalidMediaKey
+	}
+	body, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", s.objectURL(key).String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := s.do(req, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3MediaStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if !validMediaKey(key) {
+		return nil, errInvalidMediaKey
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3MediaStore) Delete(ctx context.Context, key string) error {
+	if !validMediaKey(key) {
+		return errInvalidMediaKey
+	}
+	req, err := http.NewRequestWithContext(ctx, "DELETE", s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, nil)
+	if err == errMediaNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3MediaStore) URL(key string, ttl time.Duration) string {
+	if ttl <= 0 {
+		if s.publicURL != "" {
+			return s.publicURL + "/" + s3EncodePath(key)
+		}
+		return s.objectURL(key).String()
+	}
+	if ttl > s3MaxPresignExpiry {
+		ttl = s3MaxPresignExpiry
+	}
+	return s.presign("GET", key, time.Now().Truncate(mediaURLWindow), ttl)
+}
+
+// 署名してリクエストを送信（2xx 以外はエラー）
+func (s *S3MediaStore) do(req *http.Request, body []byte) (*http.Response, error) {
+	s.sign(req, body, time.Now())
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errMediaNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(msg))
+}
+
+// Authorizationヘッダーによる署名
+func (s *S3MediaStore) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		headers["content-type"] = ct
+	}
+
+	scope, signedHeaders, signature := s.signature(req.Method, req.URL, headers, payloadHash, now)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+// クエリパラメータによる署名付きURL
+func (s *S3MediaStore) presign(method, key string, now time.Time, ttl time.Duration) string {
+	now = now.UTC()
+	u := s.objectURL(key)
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", s3Algorithm)
+	q.Set("X-Amz-Credential", s.accessKey+"/"+s.credentialScope(now))
+	q.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = s3CanonicalQuery(q)
+
+	_, _, signature := s.signature(method, u, map[string]string{"host": u.Host}, s3UnsignedPayload, now)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+func (s *S3MediaStore) credentialScope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// 正規リクエストから署名を計算（スコープ・署名対象ヘッダー・署名を返す）
+func (s *S3MediaStore) signature(method string, u *url.URL, headers map[string]string, payloadHash string, now time.Time) (string, string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		s3CanonicalQuery(u.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := s.credentialScope(now)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// SigV4 の URI エンコード（非予約文字以外をすべてエンコード）
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EncodePath(p string) string {
+	return s3Escape(p, true)
+}
+
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
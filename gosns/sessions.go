@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	accessTokenTTL     = 15 * time.Minute
+	sessionTTL         = 30 * 24 * time.Hour
+	refreshReuseGrace  = 10 * time.Second
+	lastSeenResolution = time.Minute
+	refreshCookieName  = "refresh_token"
+	loginNextCookie    = "login_next"
+	loginNextTTL       = 10 * time.Minute
+)
+
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+// 接続元IPアドレス
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// セッション作成（リフレッシュトークンを返す）
+func (app *App) createSession(r *http.Request, userID int) (string, string, error) {
+	sessionID := uuid.New().String()
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO sessions (id, user_id, ip, user_agent, expires_at) VALUES (?, ?, ?, ?, ?)",
+		sessionID, userID, clientIP(r), r.UserAgent(), sqlTime(time.Now().Add(sessionTTL)))
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err := issueRefreshToken(tx, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+	return sessionID, refreshToken, tx.Commit()
+}
+
+func issueRefreshToken(tx *sql.Tx, sessionID string) (string, error) {
+	token := randomToken(32)
+	_, err := tx.Exec("INSERT INTO refresh_tokens (session_id, token_hash) VALUES (?, ?)",
+		sessionID, hashToken(token))
+	return token, err
+}
+
+// リフレッシュトークンのローテーション
+// 使用済みトークンが再送された場合は漏洩とみなしてセッションごと失効させる
+func (app *App) rotateRefreshToken(refreshToken string) (*Claims, string, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	var tokenID, userID int
+	var sessionID, username string
+	var usedAt sql.NullTime
+	err = tx.QueryRow(`SELECT t.id, t.session_id, t.used_at, s.user_id, u.username
+		FROM refresh_tokens t
+		JOIN sessions s ON t.session_id = s.id
+		JOIN users u ON s.user_id = u.id
+		WHERE t.token_hash = ? AND s.revoked_at IS NULL AND s.expires_at > ?`,
+		hashToken(refreshToken), sqlTime(time.Now())).
+		Scan(&tokenID, &sessionID, &usedAt, &userID, &username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	claims := &Claims{UserID: userID, Username: username, SessionID: sessionID}
+
+	if usedAt.Valid {
+		// 同時リクエストによる二重送信は猶予期間内なら許容（新しいトークンは発行しない）
+		if time.Since(usedAt.Time) < refreshReuseGrace {
+			return claims, "", nil
+		}
+		tx.Exec("UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = ?", sessionID)
+		tx.Commit()
+		log.Printf("リフレッシュトークンの再利用を検出: session=%s user=%d", sessionID, userID)
+		return nil, "", errRefreshTokenReused
+	}
+
+	res, err := tx.Exec("UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL", tokenID)
+	if err != nil {
+		return nil, "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return claims, "", nil
+	}
+	newToken, err := issueRefreshToken(tx, sessionID)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := tx.Exec("UPDATE sessions SET expires_at = ?, last_seen_at = CURRENT_TIMESTAMP WHERE id = ?",
+		sqlTime(time.Now().Add(sessionTTL)), sessionID); err != nil {
+		return nil, "", err
+	}
+	return claims, newToken, tx.Commit()
+}
+
+// セッションが有効か確認し、最終アクセス日時を更新
+func (app *App) sessionActive(sessionID string, userID int) bool {
+	var count int
+	app.db.QueryRow("SELECT COUNT(*) FROM sessions WHERE id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?",
+		sessionID, userID, sqlTime(time.Now())).Scan(&count)
+	if count == 0 {
+		return false
+	}
+
+	app.db.Exec("UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP WHERE id = ? AND last_seen_at < ?",
+		sessionID, sqlTime(time.Now().Add(-lastSeenResolution)))
+	return true
+}
+
+func (app *App) revokeSession(sessionID string) error {
+	_, err := app.db.Exec("UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL", sessionID)
+	return err
+}
+
+func (app *App) revokeUserSessions(userID int) error {
+	_, err := app.db.Exec("UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND revoked_at IS NULL", userID)
+	return err
+}
+
+func setSessionCookies(w http.ResponseWriter, accessToken, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    accessToken,
+		HttpOnly: true,
+		Secure:   false,
+		MaxAge:   int(sessionTTL.Seconds()),
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+	if refreshToken != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     refreshCookieName,
+			Value:    refreshToken,
+			HttpOnly: true,
+			Secure:   false,
+			MaxAge:   int(sessionTTL.Seconds()),
+			Path:     "/",
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{"token", refreshCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			HttpOnly: true,
+			Secure:   false,
+			MaxAge:   -1,
+			Path:     "/",
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// ログイン成功時にセッションを開始してCookieに保存
+func (app *App) startSession(w http.ResponseWriter, r *http.Request, userID int, username string) error {
+	sessionID, refreshToken, err := app.createSession(r, userID)
+	if err != nil {
+		return err
+	}
+
+	accessToken, err := generateJWT(userID, username, sessionID)
+	if err != nil {
+		return err
+	}
+
+	setSessionCookies(w, accessToken, refreshToken)
+	return nil
+}
+
+// ログイン後の遷移先を保存（サイト内のパスのみ）
+func setLoginNext(w http.ResponseWriter, path string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginNextCookie,
+		Value:    url.QueryEscape(path),
+		HttpOnly: true,
+		Secure:   false,
+		MaxAge:   int(loginNextTTL.Seconds()),
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ログイン後の遷移先を取り出す（未設定・不正な場合は "/"）
+func popLoginNext(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(loginNextCookie)
+	if err != nil {
+		return "/"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginNextCookie,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	next, err := url.QueryUnescape(cookie.Value)
+	if err != nil || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// リクエストの認証
+// アクセストークンが期限切れの場合はリフレッシュトークンCookieで自動更新する
+func (app *App) authenticate(w http.ResponseWriter, r *http.Request) (*Claims, error) {
+	// パーソナルアクセストークン・OAuthアクセストークンはAPIでのみ受け付ける
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if strings.HasPrefix(token, accessTokenPrefix) || strings.HasPrefix(token, oauthAccessTokenPrefix) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			return nil, errInvalidAccessToken
+		}
+		if strings.HasPrefix(token, oauthAccessTokenPrefix) {
+			return app.authenticateOAuthToken(token)
+		}
+		return app.authenticateAccessToken(token)
+	}
+
+	tokenString := ""
+
+	// Cookie から取得
+	if cookie, err := r.Cookie("token"); err == nil {
+		tokenString = cookie.Value
+	}
+
+	// Authorization ヘッダーから取得
+	if tokenString == "" {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
+			tokenString = strings.TrimPrefix(authHeader, "Bearer ")
+		}
+	}
+
+	if tokenString != "" {
+		claims, err := validateJWT(tokenString)
+		if err == nil {
+			if !app.sessionActive(claims.SessionID, claims.UserID) {
+				return nil, errors.New("session revoked")
+			}
+			return claims, nil
+		}
+	}
+
+	cookie, err := r.Cookie(refreshCookieName)
+	if err != nil {
+		return nil, errors.New("not authenticated")
+	}
+
+	claims, newRefreshToken, err := app.rotateRefreshToken(cookie.Value)
+	if err != nil {
+		clearSessionCookies(w)
+		return nil, err
+	}
+
+	accessToken, err := generateJWT(claims.UserID, claims.Username, claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	setSessionCookies(w, accessToken, newRefreshToken)
+	return claims, nil
+}
+
+// トークン更新API（Cookieを使わないクライアント向け）
+func (app *App) refreshTokenAPI(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	claims, newRefreshToken, err := app.rotateRefreshToken(req.RefreshToken)
+	if err != nil || newRefreshToken == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid refresh token",
+		})
+		return
+	}
+
+	accessToken, err := generateJWT(claims.UserID, claims.Username, claims.SessionID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Failed to issue token",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"access_token":  accessToken,
+			"refresh_token": newRefreshToken,
+			"token_type":    "Bearer",
+			"expires_in":    int(accessTokenTTL.Seconds()),
+		},
+	})
+}
+
+// 全端末からログアウト
+func (app *App) logoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	if err := app.revokeUserSessions(userID); err != nil {
+		http.Error(w, "ログアウトに失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	clearSessionCookies(w)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
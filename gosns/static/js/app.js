@@ -1,3 +1,9 @@
+// CSRFトークン（layout.html の meta タグから取得）
+function csrfToken() {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    return meta ? meta.content : '';
+}
+
 document.addEventListener('DOMContentLoaded', function() {
     // いいねボタンの処理
     document.addEventListener('click', function(e) {
@@ -10,6 +16,7 @@ document.addEventListener('DOMContentLoaded', function() {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
+                    'X-CSRF-Token': csrfToken(),
                 }
             })
             .then(response => response.json())
@@ -24,6 +31,29 @@ document.addEventListener('DOMContentLoaded', function() {
         }
     });
 
+    // リポストボタンの処理（もう一度押すと取り消す）
+    document.addEventListener('click', function(e) {
+        const btn = e.target.closest('.repost-btn');
+        if (!btn) return;
+        e.preventDefault();
+
+        fetch(`/api/posts/${btn.dataset.postId}/repost`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': csrfToken(),
+            }
+        })
+        .then(response => response.json())
+        .then(data => {
+            if (data.success) {
+                btn.querySelector('.repost-count').textContent = data.reposts || 0;
+                btn.style.color = data.reposted ? '#17bf63' : '#657786';
+            }
+        })
+        .catch(error => console.error('Error:', error));
+    });
+
     // コメントボタンの処理
     document.addEventListener('click', function(e) {
         if (e.target.classList.contains('comment-btn') || e.target.closest('.comment-btn')) {
@@ -53,6 +83,7 @@ document.addEventListener('DOMContentLoaded', function() {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
+                    'X-CSRF-Token': csrfToken(),
                 },
                 body: JSON.stringify({ content: content })
             })
@@ -79,7 +110,10 @@ document.addEventListener('DOMContentLoaded', function() {
             
             if (confirm('この投稿を削除しますか？')) {
                 fetch(`/api/posts/${postId}`, {
-                    method: 'DELETE'
+                    method: 'DELETE',
+                    headers: {
+                        'X-CSRF-Token': csrfToken(),
+                    }
                 })
                 .then(response => response.json())
                 .then(data => {
@@ -93,6 +127,114 @@ document.addEventListener('DOMContentLoaded', function() {
         }
     });
 
+    // スレッドの続きの返信を読み込む
+    document.addEventListener('click', function(e) {
+        if (!e.target.classList.contains('load-replies')) return;
+        e.preventDefault();
+        const btn = e.target;
+        fetch(`/api/posts/${btn.dataset.postId}/thread?page=${btn.dataset.page}`)
+            .then(response => response.json())
+            .then(data => {
+                if (!data.success) {
+                    // APIを使えない場合はページ遷移で表示する
+                    window.location.href = btn.href;
+                    return;
+                }
+                const container = document.querySelector('.thread-replies');
+                data.thread.replies.forEach(reply => {
+                    const postDiv = createReplyElement(reply);
+                    container.appendChild(postDiv);
+                    applyBlurhashes(postDiv);
+                    watchProcessingMedia(postDiv);
+                });
+                if (data.thread.has_more) {
+                    btn.dataset.page = data.thread.page + 1;
+                    btn.href = `/posts/${btn.dataset.postId}?page=${btn.dataset.page}`;
+                } else {
+                    btn.remove();
+                }
+            })
+            .catch(error => console.error('Error:', error));
+    });
+
+    // 投稿編集
+    document.addEventListener('click', function(e) {
+        if (!e.target.classList.contains('edit-btn')) return;
+        e.preventDefault();
+        const postElement = e.target.closest('.post');
+        const text = postElement.querySelector('.post-text');
+        if (postElement.querySelector('.post-edit-form')) return;
+
+        const form = document.createElement('form');
+        form.className = 'post-edit-form';
+        form.innerHTML = `
+            <textarea rows="3" required></textarea>
+            <button type="submit" class="btn btn-sm btn-primary">保存</button>
+            <button type="button" class="btn btn-sm edit-cancel">キャンセル</button>
+        `;
+        form.querySelector('textarea').value = text.textContent;
+        text.style.display = 'none';
+        text.after(form);
+
+        form.querySelector('.edit-cancel').addEventListener('click', function() {
+            form.remove();
+            text.style.display = '';
+        });
+        form.addEventListener('submit', function(ev) {
+            ev.preventDefault();
+            fetch(`/api/posts/${e.target.dataset.postId}`, {
+                method: 'PATCH',
+                headers: {
+                    'Content-Type': 'application/json',
+                    'X-CSRF-Token': csrfToken(),
+                },
+                body: JSON.stringify({ content: form.querySelector('textarea').value })
+            })
+            .then(response => response.json())
+            .then(data => {
+                if (!data.success) {
+                    alert(data.message === 'Edit window has expired' ? '編集できる期間を過ぎています' : '投稿を更新できませんでした');
+                    return;
+                }
+                text.innerHTML = renderContent(data.post.content, data.post.mentions);
+                form.remove();
+                text.style.display = '';
+                if (data.post.edited_at) markEdited(postElement, data.post);
+            })
+            .catch(error => console.error('Error:', error));
+        });
+    });
+
+    // 編集履歴の表示
+    document.addEventListener('click', function(e) {
+        if (!e.target.classList.contains('post-edited')) return;
+        e.preventDefault();
+        const postId = e.target.dataset.postId;
+        const history = document.getElementById(`history-${postId}`);
+        if (history.style.display !== 'none') {
+            history.style.display = 'none';
+            return;
+        }
+
+        fetch(`/api/posts/${postId}/revisions`)
+            .then(response => response.json())
+            .then(data => {
+                if (!data.success) return;
+                history.innerHTML = '<h5>編集履歴</h5>';
+                data.revisions.forEach(rev => {
+                    const item = document.createElement('div');
+                    item.className = 'revision';
+                    item.innerHTML = `<span class="revision-time"></span><p></p>`;
+                    item.querySelector('.revision-time').textContent =
+                        new Date(rev.created_at).toLocaleString('ja-JP') + (rev.current ? '（現在）' : '');
+                    item.querySelector('p').textContent = rev.content;
+                    history.appendChild(item);
+                });
+                history.style.display = 'block';
+            })
+            .catch(error => console.error('Error:', error));
+    });
+
     // フォローボタンの処理
     document.addEventListener('click', function(e) {
         if (e.target.classList.contains('follow-btn')) {
@@ -104,6 +246,7 @@ document.addEventListener('DOMContentLoaded', function() {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
+                    'X-CSRF-Token': csrfToken(),
                 }
             })
             .then(response => response.json())
@@ -118,34 +261,61 @@ document.addEventListener('DOMContentLoaded', function() {
         }
     });
 
-    // 投稿フォーム送信時の画像プレビュー
-    const imageInput = document.querySelector('input[type="file"][name="image"]');
+    // 投稿フォームの画像プレビューと代替テキスト入力
+    const imageInput = document.querySelector('input[type="file"][name="images"]');
     if (imageInput) {
-        imageInput.addEventListener('change', function(e) {
-            const file = e.target.files[0];
-            if (file) {
-                const reader = new FileReader();
-                reader.onload = function(e) {
-                    let preview = document.getElementById('image-preview');
-                    if (!preview) {
-                        preview = document.createElement('div');
-                        preview.id = 'image-preview';
-                        preview.innerHTML = '<img id="preview-img" style="max-width: 200px; border-radius: 8px; margin-top: 1rem;"><button type="button" id="remove-preview" style="margin-left: 1rem;">削除</button>';
-                        imageInput.parentNode.appendChild(preview);
-                    }
-                    document.getElementById('preview-img').src = e.target.result;
-                };
-                reader.readAsDataURL(file);
-            }
-        });
+        const maxFiles = parseInt(imageInput.dataset.maxFiles || '4');
+        const preview = document.getElementById('mediaPreview');
 
-        document.addEventListener('click', function(e) {
-            if (e.target.id === 'remove-preview') {
+        imageInput.addEventListener('change', function() {
+            const files = Array.from(imageInput.files);
+            const hasVideo = files.some(file => file.type.startsWith('video/'));
+            if (hasVideo && files.length > 1) {
+                alert('動画は1投稿に1本だけ、画像と同時には添付できません');
                 imageInput.value = '';
-                document.getElementById('image-preview').remove();
+            } else if (files.length > maxFiles) {
+                alert(`画像は${maxFiles}枚まで添付できます`);
+                const kept = new DataTransfer();
+                files.slice(0, maxFiles).forEach(file => kept.items.add(file));
+                imageInput.files = kept.files;
             }
+            renderMediaPreview();
         });
+
+        preview.addEventListener('click', function(e) {
+            if (!e.target.classList.contains('remove-media')) return;
+            const index = parseInt(e.target.dataset.index);
+            const kept = new DataTransfer();
+            Array.from(imageInput.files).forEach((file, i) => {
+                if (i !== index) kept.items.add(file);
+            });
+            imageInput.files = kept.files;
+            renderMediaPreview();
+        });
+
+        function renderMediaPreview() {
+            // 入力済みの代替テキストは並び順に合わせて引き継ぐ
+            const alts = Array.from(preview.querySelectorAll('textarea')).map(t => t.value);
+            preview.innerHTML = '';
+            Array.from(imageInput.files).forEach((file, i) => {
+                const item = document.createElement('div');
+                item.className = 'media-preview-item';
+                const isVideo = file.type.startsWith('video/');
+                item.innerHTML = `
+                    ${isVideo ? '<video muted playsinline></video>' : '<img alt="">'}
+                    <textarea name="alt" rows="2" maxlength="1000" placeholder="代替テキスト（内容の説明）"></textarea>
+                    <button type="button" class="btn btn-sm remove-media" data-index="${i}">削除</button>
+                `;
+                item.querySelector(isVideo ? 'video' : 'img').src = URL.createObjectURL(file);
+                item.querySelector('textarea').value = alts[i] || '';
+                preview.appendChild(item);
+            });
+        }
     }
+
+    applyBlurhashes(document);
+    watchProcessingMedia(document);
+    connectStream();
 });
 
 // コメント読み込み
@@ -162,12 +332,13 @@ function loadComments(postId) {
                 commentDiv.innerHTML = `
                     <div style="display: flex; align-items: center; margin-bottom: 0.5rem;">
                         <img src="${comment.avatar}" alt="${comment.username}" class="avatar-sm" style="margin-right: 0.5rem;">
-                        <strong>${comment.username}</strong>
+                        <strong>${escapeHTML(comment.username)}</strong>
                         <span style="color: #657786; font-size: 0.875rem; margin-left: 0.5rem;">
                             ${new Date(comment.created_at).toLocaleString('ja-JP')}
                         </span>
                     </div>
-                    <p style="margin-left: 2.5rem;">${comment.content}</p>
+                    <p style="margin-left: 2.5rem;">${escapeHTML(comment.content)}</p>
+                    <a href="/posts/${comment.id}#reply" class="comment-thread-link">${comment.replies > 0 ? `${comment.replies}件の返信を表示` : '返信する'}</a>
                 `;
                 commentList.appendChild(commentDiv);
             });
@@ -180,7 +351,7 @@ let loading = false;
 let page = 1;
 
 window.addEventListener('scroll', function() {
-    if (loading) return;
+    if (loading || !document.querySelector('.posts')) return;
     
     if (window.innerHeight + window.scrollY >= document.body.offsetHeight - 1000) {
         loading = true;
@@ -196,8 +367,13 @@ function loadMorePosts() {
             if (data.posts && data.posts.length > 0) {
                 const postsContainer = document.querySelector('.posts');
                 data.posts.forEach(post => {
+                    // リアルタイムで追加済みの投稿は飛ばす
+                    if (postsContainer.querySelector(`.post[data-post-id="${post.id}"]`)) return;
                     const postDiv = createPostElement(post);
+                    if (post.edited_at) markEdited(postDiv, post);
                     postsContainer.appendChild(postDiv);
+                    applyBlurhashes(postDiv);
+                    watchProcessingMedia(postDiv);
                 });
             }
             loading = false;
@@ -208,22 +384,90 @@ function loadMorePosts() {
         });
 }
 
+// リアルタイム更新（Server-Sent Events、切断時は Last-Event-ID 付きで自動的に再接続する）
+function connectStream() {
+    // ログイン中のみ（ナビゲーションに通知のリンクがある）
+    if (!document.querySelector('.nav-links a[href="/notifications"]') || !window.EventSource) return;
+
+    const source = new EventSource('/api/stream');
+
+    // タイムラインに新しい投稿を追加
+    source.addEventListener('post', function(e) {
+        const post = JSON.parse(e.data);
+        const postsContainer = document.querySelector('.posts');
+        if (!postsContainer || postsContainer.querySelector(`.post[data-post-id="${post.id}"]`)) return;
+        const postDiv = createPostElement(post);
+        postsContainer.insertBefore(postDiv, postsContainer.querySelector('.post'));
+        applyBlurhashes(postDiv);
+        watchProcessingMedia(postDiv);
+    });
+
+    // いいね・返信・リポストの数を更新
+    source.addEventListener('counts', function(e) {
+        const counts = JSON.parse(e.data);
+        document.querySelectorAll(`.post[data-post-id="${counts.post_id}"] > .post-actions`).forEach(actions => {
+            const likeCount = actions.querySelector('.like-count');
+            const commentCount = actions.querySelector('.comment-count');
+            const replyCount = actions.querySelector('.reply-count');
+            const repostCount = actions.querySelector('.repost-count');
+            if (likeCount) likeCount.textContent = counts.likes;
+            if (commentCount) commentCount.textContent = counts.comments;
+            if (replyCount) replyCount.textContent = `💬 ${counts.comments}件の返信`;
+            if (repostCount) repostCount.textContent = counts.reposts;
+        });
+    });
+
+    // 未読の通知数を更新
+    source.addEventListener('notification', function(e) {
+        updateNotificationBadge(JSON.parse(e.data).unread);
+    });
+
+    // 再送できないほど切断が長かった場合は未読数を取り直す
+    source.addEventListener('resync', function() {
+        fetch('/api/notifications')
+            .then(response => response.json())
+            .then(data => {
+                if (data.success) updateNotificationBadge(data.unread || 0);
+            })
+            .catch(error => console.error('Error:', error));
+    });
+}
+
+function updateNotificationBadge(unread) {
+    const link = document.querySelector('.nav-links a[href="/notifications"]');
+    if (!link) return;
+    let badge = link.querySelector('.notification-badge');
+    if (!unread) {
+        if (badge) badge.remove();
+        return;
+    }
+    if (!badge) {
+        badge = document.createElement('span');
+        badge.className = 'notification-badge';
+        link.appendChild(badge);
+    }
+    badge.textContent = unread;
+}
+
 function createPostElement(post) {
     const postDiv = document.createElement('div');
     postDiv.className = 'post';
     postDiv.dataset.postId = post.id;
     
     postDiv.innerHTML = `
+        ${post.reposted_by ? `<div class="post-reposted">🔁 ${escapeHTML(post.reposted_by)}さんがリポスト</div>` : ''}
         <div class="post-header">
             <img src="${post.avatar}" alt="${post.username}" class="avatar">
             <div class="post-info">
-                <strong>${post.username}</strong>
-                <span class="post-time">${new Date(post.created_at).toLocaleString('ja-JP')}</span>
+                <strong>${escapeHTML(post.username)}</strong>
+                <a href="/posts/${post.id}" class="post-time">${new Date(post.created_at).toLocaleString('ja-JP')}</a>
             </div>
         </div>
         <div class="post-content">
-            <p>${post.content}</p>
-            ${post.image_url ? `<img src="${post.image_url}" alt="投稿画像" class="post-image">` : ''}
+            <p class="post-text">${renderContent(post.content, post.mentions)}</p>
+            <div class="post-history" id="history-${post.id}" style="display:none;"></div>
+            ${renderPostMedia(post.media)}
+            ${renderPostQuote(post)}
         </div>
         <div class="post-actions">
             <button class="btn btn-sm like-btn" data-post-id="${post.id}">
@@ -232,8 +476,239 @@ function createPostElement(post) {
             <button class="btn btn-sm comment-btn" data-post-id="${post.id}">
                 💬 <span class="comment-count">${post.comments}</span>
             </button>
+            <button class="btn btn-sm repost-btn" data-post-id="${post.id}">
+                🔁 <span class="repost-count">${post.reposts}</span>
+            </button>
+            <a href="/?quote_of=${post.id}" class="btn btn-sm quote-btn">引用</a>
         </div>
     `;
     
     return postDiv;
+}
+
+// スレッドの返信（thread.html と同じ構造）
+function createReplyElement(reply) {
+    if (reply.deleted) {
+        const deletedDiv = document.createElement('div');
+        deletedDiv.id = `post-${reply.id}`;
+        deletedDiv.className = `thread-reply thread-deleted thread-indent-${Math.min(reply.depth, 5) - 1}`;
+        deletedDiv.textContent = 'この投稿は削除されました';
+        return deletedDiv;
+    }
+    const postDiv = createPostElement(reply);
+    postDiv.id = `post-${reply.id}`;
+    postDiv.classList.add('thread-reply', `thread-indent-${Math.min(reply.depth, 5) - 1}`);
+    const commentBtn = postDiv.querySelector('.comment-btn');
+    const replyLink = document.createElement('a');
+    replyLink.href = `/posts/${reply.id}#reply`;
+    replyLink.className = 'btn btn-sm reply-btn';
+    replyLink.innerHTML = `💬 <span class="comment-count">${reply.comments}</span>`;
+    commentBtn.replaceWith(replyLink);
+    if (reply.edited_at) markEdited(postDiv, reply);
+    return postDiv;
+}
+
+// 「編集済み」の表示
+function markEdited(postElement, post) {
+    if (postElement.querySelector('.post-edited')) return;
+    const marker = document.createElement('button');
+    marker.type = 'button';
+    marker.className = 'post-edited';
+    marker.dataset.postId = post.id;
+    marker.title = new Date(post.edited_at).toLocaleString('ja-JP');
+    marker.textContent = '編集済み';
+    postElement.querySelector('.post-info').appendChild(marker);
+}
+
+// 引用元の投稿（partials/post_quote.html と同じ構造）
+function renderPostQuote(post) {
+    if (post.quote) {
+        const q = post.quote;
+        return `
+        <div class="post-quote">
+            <div class="post-quote-header">
+                <img src="${q.avatar}" alt="${escapeHTML(q.username)}" class="avatar-sm">
+                <strong>${escapeHTML(q.username)}</strong>
+                <a href="/posts/${q.id}" class="post-time">${new Date(q.created_at).toLocaleString('ja-JP')}</a>
+            </div>
+            <p class="post-quote-text">${renderContent(q.content, q.mentions)}</p>
+            ${renderPostMedia(q.media)}
+        </div>`;
+    }
+    if (post.quote_of) {
+        return '<div class="post-quote post-quote-deleted">引用元の投稿は削除されました</div>';
+    }
+    return '';
+}
+
+// 添付メディアのグリッド（partials/post_media.html と同じ構造）
+function renderPostMedia(media) {
+    if (!media || media.length === 0) return '';
+    return `<div class="post-media post-media-${media.length}">${media.map(renderMediaItem).join('')}</div>`;
+}
+
+function renderMediaItem(m) {
+    if (m.status === 'processing') {
+        return `<div class="post-media-item post-media-processing" data-media-id="${m.id}">動画を処理しています…</div>`;
+    }
+    if (m.status === 'failed') {
+        return '<div class="post-media-item post-media-failed">動画を処理できませんでした</div>';
+    }
+    const blurhash = m.blurhash ? ` data-blurhash="${escapeHTML(m.blurhash)}"` : '';
+    if (m.type === 'video' || m.type === 'gif') {
+        const playback = m.type === 'gif' ? 'autoplay loop muted' : 'controls preload="none"';
+        const label = m.alt ? ` aria-label="${escapeHTML(m.alt)}"` : '';
+        return `
+        <div class="post-media-item"${blurhash}>
+            <video src="${m.url}" poster="${m.poster_url}" width="${m.width}" height="${m.height}" ${playback} playsinline${label}></video>
+        </div>`;
+    }
+    return `
+        <a href="${m.url}" target="_blank" rel="noopener" class="post-media-item"${blurhash}>
+            <img src="${m.feed_url || m.url}" alt="${escapeHTML(m.alt || '投稿画像')}"${m.width ? ` width="${m.width}" height="${m.height}"` : ''} class="post-image" loading="lazy">
+        </a>`;
+}
+
+// 変換中の動画を定期的に確認し、完了したら表示を差し替える
+function watchProcessingMedia(root) {
+    root.querySelectorAll('.post-media-processing[data-media-id]').forEach(el => {
+        const mediaId = el.dataset.mediaId;
+        const timer = setInterval(function() {
+            fetch(`/api/media/${mediaId}`)
+                .then(response => response.json())
+                .then(data => {
+                    if (!data.success) {
+                        clearInterval(timer);
+                        return;
+                    }
+                    if (data.data.status === 'processing') return;
+                    clearInterval(timer);
+                    const wrapper = document.createElement('div');
+                    wrapper.innerHTML = renderMediaItem(data.data);
+                    const item = wrapper.firstElementChild;
+                    el.replaceWith(item);
+                    applyBlurhashes(item.parentNode);
+                })
+                .catch(() => clearInterval(timer));
+        }, 5000);
+    });
+}
+
+// 本文をエスケープし、ハッシュタグとメンションをリンクにする（content.go の renderContent と同じ規則）
+// mentions は解決済みのユーザー名（存在しないユーザーへのメンションはリンクにしない）
+const HASHTAG_PATTERN = /(^|[^\p{L}\p{N}_&\/#])#([\p{L}\p{N}_]+)/gu;
+const MENTION_PATTERN = /(^|[^\p{L}\p{N}_@.])@([\p{L}\p{N}_][\p{L}\p{N}_.\-]*)/gu;
+
+function renderContent(content, mentions) {
+    const links = [];
+    for (const m of content.matchAll(HASHTAG_PATTERN)) {
+        const tag = m[2];
+        if (/^\p{N}+$/u.test(tag) || Array.from(tag).length > 50) continue;
+        const start = m.index + m[1].length;
+        links.push({ start, end: start + 1 + tag.length, href: `/tags/${encodeURIComponent(tag.toLowerCase())}`, className: 'hashtag' });
+    }
+    const resolved = new Map((mentions || []).map(name => [name.toLowerCase(), name]));
+    for (const m of content.matchAll(MENTION_PATTERN)) {
+        const name = m[2].replace(/[.\-]+$/, '');
+        const username = resolved.get(name.toLowerCase());
+        if (!username) continue;
+        const start = m.index + m[1].length;
+        links.push({ start, end: start + 1 + name.length, href: `/profile/${encodeURIComponent(username)}`, className: 'mention' });
+    }
+    links.sort((a, b) => a.start - b.start);
+
+    let html = '';
+    let last = 0;
+    for (const link of links) {
+        if (link.start < last) continue;
+        html += escapeHTML(content.slice(last, link.start));
+        html += `<a href="${escapeHTML(link.href)}" class="${link.className}">${escapeHTML(content.slice(link.start, link.end))}</a>`;
+        last = link.end;
+    }
+    return html + escapeHTML(content.slice(last));
+}
+
+function escapeHTML(value) {
+    const div = document.createElement('div');
+    div.textContent = value;
+    return div.innerHTML.replace(/"/g, '&quot;');
+}
+
+// BlurHash のデコード（画像の読み込み中に表示するプレースホルダー）
+const BLURHASH_CHARS = '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~';
+
+function decode83(str) {
+    let value = 0;
+    for (const c of str) {
+        value = value * 83 + BLURHASH_CHARS.indexOf(c);
+    }
+    return value;
+}
+
+function srgbToLinear(value) {
+    const v = value / 255;
+    return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4);
+}
+
+function linearToSrgb(value) {
+    const v = Math.max(0, Math.min(1, value));
+    return v <= 0.0031308 ? Math.round(v * 12.92 * 255) : Math.round((1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255);
+}
+
+function signPow(value, exp) {
+    return Math.sign(value) * Math.pow(Math.abs(value), exp);
+}
+
+function decodeBlurhash(hash, width, height) {
+    if (!hash || hash.length < 6) return null;
+    const sizeFlag = decode83(hash[0]);
+    const numX = (sizeFlag % 9) + 1;
+    const numY = Math.floor(sizeFlag / 9) + 1;
+    if (hash.length !== 4 + 2 * numX * numY) return null;
+
+    const maxValue = (decode83(hash[1]) + 1) / 166;
+    const colors = [];
+    const dc = decode83(hash.substring(2, 6));
+    colors.push([srgbToLinear(dc >> 16), srgbToLinear((dc >> 8) & 255), srgbToLinear(dc & 255)]);
+    for (let i = 1; i < numX * numY; i++) {
+        const value = decode83(hash.substring(4 + i * 2, 6 + i * 2));
+        const quant = [Math.floor(value / (19 * 19)), Math.floor(value / 19) % 19, value % 19];
+        colors.push(quant.map(q => signPow((q - 9) / 9, 2) * maxValue));
+    }
+
+    const pixels = new Uint8ClampedArray(width * height * 4);
+    for (let y = 0; y < height; y++) {
+        for (let x = 0; x < width; x++) {
+            let r = 0, g = 0, b = 0;
+            for (let j = 0; j < numY; j++) {
+                for (let i = 0; i < numX; i++) {
+                    const basis = Math.cos(Math.PI * x * i / width) * Math.cos(Math.PI * y * j / height);
+                    const color = colors[i + j * numX];
+                    r += color[0] * basis;
+                    g += color[1] * basis;
+                    b += color[2] * basis;
+                }
+            }
+            const offset = 4 * (x + y * width);
+            pixels[offset] = linearToSrgb(r);
+            pixels[offset + 1] = linearToSrgb(g);
+            pixels[offset + 2] = linearToSrgb(b);
+            pixels[offset + 3] = 255;
+        }
+    }
+    return pixels;
+}
+
+function applyBlurhashes(root) {
+    root.querySelectorAll('[data-blurhash]').forEach(el => {
+        const size = 32;
+        const pixels = decodeBlurhash(el.dataset.blurhash, size, size);
+        el.removeAttribute('data-blurhash');
+        if (!pixels) return;
+        const canvas = document.createElement('canvas');
+        canvas.width = size;
+        canvas.height = size;
+        canvas.getContext('2d').putImageData(new ImageData(pixels, size, size), 0, 0);
+        el.style.backgroundImage = `url(${canvas.toDataURL()})`;
+    });
 }
\ No newline at end of file
@@ -0,0 +1,106 @@
+// パスキー（WebAuthn）
+
+function base64urlToBuffer(value) {
+    const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    const padded = base64 + '='.repeat((4 - base64.length % 4) % 4);
+    return Uint8Array.from(atob(padded), c => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64url(buffer) {
+    const bytes = new Uint8Array(buffer);
+    let binary = '';
+    bytes.forEach(b => binary += String.fromCharCode(b));
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function postJSON(url, body) {
+    return fetch(url, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            'X-CSRF-Token': csrfToken(),
+        },
+        body: body ? JSON.stringify(body) : undefined
+    }).then(response => response.json());
+}
+
+// パスキー登録
+function registerPasskey(name) {
+    return postJSON('/webauthn/register/begin')
+        .then(data => {
+            if (!data.success) throw new Error(data.message);
+            const options = data.data;
+            options.challenge = base64urlToBuffer(options.challenge);
+            options.user.id = base64urlToBuffer(options.user.id);
+            options.excludeCredentials.forEach(c => c.id = base64urlToBuffer(c.id));
+            return navigator.credentials.create({ publicKey: options });
+        })
+        .then(credential => postJSON('/webauthn/register/finish', {
+            id: credential.id,
+            type: credential.type,
+            name: name,
+            response: {
+                clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+                attestationObject: bufferToBase64url(credential.response.attestationObject)
+            }
+        }));
+}
+
+// パスキーでログイン
+function loginWithPasskey() {
+    return postJSON('/webauthn/login/begin')
+        .then(data => {
+            if (!data.success) throw new Error(data.message);
+            const options = data.data;
+            options.challenge = base64urlToBuffer(options.challenge);
+            options.allowCredentials.forEach(c => c.id = base64urlToBuffer(c.id));
+            return navigator.credentials.get({ publicKey: options });
+        })
+        .then(credential => postJSON('/webauthn/login/finish', {
+            id: credential.id,
+            type: credential.type,
+            response: {
+                clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+                authenticatorData: bufferToBase64url(credential.response.authenticatorData),
+                signature: bufferToBase64url(credential.response.signature),
+                userHandle: credential.response.userHandle ? bufferToBase64url(credential.response.userHandle) : ''
+            }
+        }));
+}
+
+document.addEventListener('DOMContentLoaded', function() {
+    const loginBtn = document.getElementById('passkey-login');
+    if (loginBtn) {
+        if (!window.PublicKeyCredential) {
+            loginBtn.style.display = 'none';
+        }
+        loginBtn.addEventListener('click', function() {
+            loginWithPasskey()
+                .then(data => {
+                    if (data.success) {
+                        window.location.href = (data.data && data.data.redirect) || '/';
+                    } else {
+                        alert('パスキーでのログインに失敗しました');
+                    }
+                })
+                .catch(error => console.error('Error:', error));
+        });
+    }
+
+    const registerForm = document.getElementById('passkey-register');
+    if (registerForm) {
+        registerForm.addEventListener('submit', function(e) {
+            e.preventDefault();
+            const name = registerForm.querySelector('input[name="name"]').value;
+            registerPasskey(name)
+                .then(data => {
+                    if (data.success) {
+                        window.location.reload();
+                    } else {
+                        alert('パスキーの登録に失敗しました');
+                    }
+                })
+                .catch(error => console.error('Error:', error));
+        });
+    }
+});
\ No newline at end of file
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 再接続時の再送のために保持するイベントの数
+	streamBufferSize = 512
+	// クライアントごとの送信待ちイベントの上限（超えたら切断し、再接続で再送する）
+	streamQueueSize = 64
+	// 接続を維持するためのハートビートの間隔
+	streamHeartbeat = 25 * time.Second
+	// 切断されたクライアントが再接続するまでの待ち時間（ミリ秒）
+	streamRetry = 3000
+)
+
+// ストリームで送るイベント
+type streamEvent struct {
+	seq   uint64
+	kind  string
+	data  []byte
+	users map[int]bool // 送信先のユーザー（nil なら接続中の全員）
+}
+
+func (e streamEvent) to(userID int) bool {
+	return e.users == nil || e.users[userID]
+}
+
+// 接続中のクライアント
+type streamSubscriber struct {
+	userID int
+	events chan streamEvent
+}
+
+// プロセス内の pub/sub（ユーザーごとに接続中のクライアントへ配信する）
+type streamHub struct {
+	mu          sync.Mutex
+	boot        int64
+	seq         uint64
+	buffer      []streamEvent
+	subscribers map[int]map[*streamSubscriber]bool
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{
+		boot:        time.Now().UnixNano(),
+		subscribers: make(map[int]map[*streamSubscriber]bool),
+	}
+}
+
+// イベントID（再起動後の Last-Event-ID を見分けるため起動時刻を含める）
+func (h *streamHub) eventID(seq uint64) string {
+	return fmt.Sprintf("%d-%d", h.boot, seq)
+}
+
+// クライアントを登録し、Last-Event-ID より後のイベントを返す
+// 再送できない（古すぎる・再起動前の）IDの場合は代わりに resync イベントを返す
+func (h *streamHub) subscribe(userID int, lastEventID string) (*streamSubscriber, []streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &streamSubscriber{userID: userID, events: make(chan streamEvent, streamQueueSize)}
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[*streamSubscriber]bool)
+	}
+	h.subscribers[userID][sub] = true
+
+	if lastEventID == "" {
+		return sub, nil
+	}
+	resync := []streamEvent{{seq: h.seq, kind: "resync", data: []byte("{}")}}
+	boot, seq, ok := parseStreamEventID(lastEventID)
+	if !ok || boot != h.boot || seq > h.seq {
+		return sub, resync
+	}
+	if len(h.buffer) > 0 && seq+1 < h.buffer[0].seq {
+		return sub, resync
+	}
+	var replay []streamEvent
+	for _, e := range h.buffer {
+		if e.seq > seq && e.to(userID) {
+			replay = append(replay, e)
+		}
+	}
+	return sub, replay
+}
+
+func parseStreamEventID(id string) (boot int64, seq uint64, ok bool) {
+	b, s, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	boot, err := strconv.ParseInt(b, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return boot, seq, true
+}
+
+func (h *streamHub) unsubscribe(sub *streamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub)
+}
+
+// 登録を解除して送信チャネルを閉じる（呼び出し側でロックする）
+func (h *streamHub) remove(sub *streamSubscriber) {
+	subs := h.subscribers[sub.userID]
+	if !subs[sub] {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscribers, sub.userID)
+	}
+	close(sub.events)
+}
+
+// イベントを配信する（users が空なら接続中の全員に送る）
+func (h *streamHub) publish(kind string, v interface{}, users ...int) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("ストリームイベントの作成に失敗しました:", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	e := streamEvent{seq: h.seq, kind: kind, data: data}
+	if len(users) > 0 {
+		e.users = make(map[int]bool, len(users))
+		for _, id := range users {
+			e.users[id] = true
+		}
+	}
+	h.buffer = append(h.buffer, e)
+	if len(h.buffer) > streamBufferSize {
+		h.buffer = h.buffer[len(h.buffer)-streamBufferSize:]
+	}
+
+	deliver := func(subs map[*streamSubscriber]bool) {
+		for sub := range subs {
+			select {
+			case sub.events <- e:
+			default:
+				// 受信が追いつかないクライアントは切断する
+				h.remove(sub)
+			}
+		}
+	}
+	if e.users == nil {
+		for _, subs := range h.subscribers {
+			deliver(subs)
+		}
+		return
+	}
+	for id := range e.users {
+		deliver(h.subscribers[id])
+	}
+}
+
+// 投稿のいいね・返信・リポストの数
+type postCounts struct {
+	PostID   int `json:"post_id"`
+	Likes    int `json:"likes"`
+	Comments int `json:"comments"`
+	Reposts  int `json:"reposts"`
+}
+
+// 未読の通知数と最新の通知
+type notificationUpdate struct {
+	Unread       int           `json:"unread"`
+	Notification *Notification `json:"notification,omitempty"`
+}
+
+// 新しい投稿を作成者とフォロワーのタイムラインに配信する
+func (app *App) publishPost(postID int) {
+	post := app.getPost(postID)
+	if post == nil || post.InReplyTo != 0 {
+		return
+	}
+
+	users := []int{post.UserID}
+	rows, err := app.db.Query("SELECT follower_id FROM follows WHERE following_id = ?", post.UserID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var followerID int
+		if err := rows.Scan(&followerID); err == nil {
+			users = append(users, followerID)
+		}
+	}
+	app.stream.publish("post", post, users...)
+}
+
+// 投稿のいいね・返信・リポストの数の変化を配信する
+func (app *App) publishCounts(postID int) {
+	counts := postCounts{PostID: postID}
+	err := app.db.QueryRow("SELECT likes, comments, reposts FROM posts WHERE id = ?", postID).
+		Scan(&counts.Likes, &counts.Comments, &counts.Reposts)
+	if err != nil {
+		return
+	}
+	app.stream.publish("counts", counts)
+}
+
+// 未読の通知数と最新の通知をそれぞれのユーザーに配信する
+func (app *App) publishNotifications(userIDs ...int) {
+	for _, userID := range userIDs {
+		update := notificationUpdate{Unread: app.countUnreadNotifications(userID)}
+		if latest, _, err := app.getNotifications(userID, 0, 1); err == nil && len(latest) > 0 {
+			update.Notification = &latest[0]
+		}
+		app.stream.publish("notification", update, userID)
+	}
+}
+
+// 投稿に関する通知を受け取ったユーザー
+func (app *App) notificationRecipients(postID int) []int {
+	rows, err := app.db.Query("SELECT DISTINCT user_id FROM notifications WHERE post_id = ? OR source_id = ?", postID, postID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var users []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err == nil {
+			users = append(users, userID)
+		}
+	}
+	return users
+}
+
+func writeStreamEvent(w http.ResponseWriter, id, kind string, data []byte) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, kind, data)
+	return err
+}
+
+// Server-Sent Events のストリーム
+// 再接続時は Last-Event-ID ヘッダーより後のイベントを再送し、再送できなければ resync イベントを送る
+func (app *App) streamAPI(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	sub, replay := app.stream.subscribe(userID, r.Header.Get("Last-Event-ID"))
+	defer app.stream.unsubscribe(sub)
+
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry)
+	for _, e := range replay {
+		writeStreamEvent(w, app.stream.eventID(e.seq), e.kind, e.data)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if err := writeStreamEvent(w, app.stream.eventID(e.seq), e.kind, e.data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// トレンドの集計期間と、スコアが半分になるまでの時間
+const (
+	trendingWindow   = 24 * time.Hour
+	trendingHalfLife = 3 * time.Hour
+)
+
+// タグページで1ページに表示する投稿の数
+const tagPageSize = 20
+
+// 投稿のハッシュタグを本文から登録し直す（日時は投稿日時のまま）
+func savePostTags(db execer, postID int, content string) error {
+	if _, err := db.Exec("DELETE FROM post_tags WHERE post_id = ?", postID); err != nil {
+		return err
+	}
+	for _, tag := range extractHashtags(content) {
+		_, err := db.Exec(`INSERT INTO post_tags (post_id, tag, created_at)
+			SELECT id, ?, created_at FROM posts WHERE id = ?`, tag, postID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ハッシュタグ機能を入れる前の投稿のタグを登録する
+func (db *Database) backfillPostTags() error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM post_tags").Scan(&count); err != nil || count > 0 {
+		return err
+	}
+
+	rows, err := db.Query("SELECT id, content FROM posts WHERE content LIKE '%#%'")
+	if err != nil {
+		return err
+	}
+	posts := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		posts[id] = content
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, content := range posts {
+		if err := savePostTags(tx, id, content); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// トレンドのハッシュタグ
+// 集計期間内に使ったユーザーごとに、最後に使った時刻から減衰させたスコアを合計する
+func (app *App) getTrendingTags(limit int) []TrendingTag {
+	rows, err := app.db.Query(`
+		SELECT t.tag, MAX(t.created_at)
+		FROM post_tags t
+		JOIN posts p ON t.post_id = p.id
+		WHERE t.created_at > ?
+		GROUP BY t.tag, p.user_id
+	`, sqlTime(time.Now().Add(-trendingWindow)))
+	if err != nil {
+		return []TrendingTag{}
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	scores := make(map[string]*TrendingTag)
+	for rows.Next() {
+		var tag string
+		var lastUsed string
+		if err := rows.Scan(&tag, &lastUsed); err != nil {
+			continue
+		}
+		// MAX() の結果は文字列で返る
+		usedAt, err := time.Parse("2006-01-02 15:04:05", lastUsed)
+		if err != nil {
+			continue
+		}
+		t, ok := scores[tag]
+		if !ok {
+			t = &TrendingTag{Tag: tag}
+			scores[tag] = t
+		}
+		t.Count++
+		t.Score += math.Exp2(-now.Sub(usedAt).Hours() / trendingHalfLife.Hours())
+	}
+
+	trending := make([]TrendingTag, 0, len(scores))
+	for _, t := range scores {
+		trending = append(trending, *t)
+	}
+	sort.Slice(trending, func(i, j int) bool {
+		if trending[i].Score != trending[j].Score {
+			return trending[i].Score > trending[j].Score
+		}
+		return trending[i].Tag < trending[j].Tag
+	})
+	if len(trending) > limit {
+		trending = trending[:limit]
+	}
+	return trending
+}
+
+// ハッシュタグの付いた投稿（新しい順）
+func (app *App) getTagPosts(tag string, limit, offset int) []Post {
+	query := `
+		SELECT p.id, p.user_id, u.username, u.avatar, p.content, p.in_reply_to, p.quote_of,
+		       p.likes, p.comments, p.reposts, p.created_at, p.edited_at
+		FROM post_tags t
+		JOIN posts p ON t.post_id = p.id
+		JOIN users u ON p.user_id = u.id
+		WHERE t.tag = ?
+		ORDER BY p.created_at DESC, p.id DESC
+		LIMIT ? OFFSET ?
+	`
+	return app.queryPosts(query, tag, limit, offset)
+}
+
+// タグページ
+func (app *App) tagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := normalizeTag(mux.Vars(r)["tag"])
+	userID := app.getCurrentUserID(w, r)
+	page := pageParam(r)
+
+	// 次のページの有無を判定するため1件多く取得する
+	posts := app.getTagPosts(tag, tagPageSize+1, (page-1)*tagPageSize)
+	hasMore := len(posts) > tagPageSize
+	if hasMore {
+		posts = posts[:tagPageSize]
+	}
+
+	data := PageData{
+		Title:           "#" + tag,
+		IsAuthenticated: userID > 0,
+		CurrentUserID:   userID,
+		Tag:             tag,
+		Posts:           posts,
+		TrendingTags:    app.getTrendingTags(10),
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if hasMore {
+		data.NextPage = page + 1
+	}
+	app.renderTemplate(w, r, "tag", data)
+}
+
+// タグの投稿一覧API
+func (app *App) getTagPostsAPI(w http.ResponseWriter, r *http.Request) {
+	tag := normalizeTag(mux.Vars(r)["tag"])
+	page := pageParam(r)
+	posts := app.getTagPosts(tag, tagPageSize, (page-1)*tagPageSize)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Posts:   posts,
+	})
+}
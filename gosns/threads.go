@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// スレッド表示で1ページに含める返信の数
+const threadPageSize = 50
+
+// 返信の字下げの上限（これより深い返信は同じ位置に並べる）
+const maxThreadIndent = 5
+
+var errPostNotFound = errors.New("post not found")
+
+// 投稿のスレッド（返信先の投稿・対象の投稿・返信ツリー）
+type Thread struct {
+	Ancestors     []Post        `json:"ancestors"`
+	Post          Post          `json:"post"`
+	Replies       []ThreadReply `json:"replies"`
+	ParentDeleted bool          `json:"parent_deleted"`
+	Page          int           `json:"page"`
+	HasMore       bool          `json:"has_more"`
+}
+
+// スレッド内の返信（depth は対象の投稿からの深さ、直接の返信が1）
+// Deleted は削除された投稿の位置を示すためのもので、ID以外の内容を持たない
+type ThreadReply struct {
+	Post
+	Depth   int  `json:"depth"`
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func (t *Thread) NextPage() int {
+	return t.Page + 1
+}
+
+func (r ThreadReply) Indent() int {
+	return min(r.Depth, maxThreadIndent) - 1
+}
+
+type rowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// 投稿が属するスレッドの起点の投稿IDを取得
+func threadRoot(db rowQueryer, postID int) (int, error) {
+	var rootID int
+	err := db.QueryRow("SELECT COALESCE(root_id, id) FROM posts WHERE id = ?", postID).Scan(&rootID)
+	if err == sql.ErrNoRows {
+		return 0, errPostNotFound
+	}
+	return rootID, err
+}
+
+// 投稿が存在することを確認
+func requirePost(db rowQueryer, postID int) error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM posts WHERE id = ?", postID).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return errPostNotFound
+	}
+	return nil
+}
+
+// スレッドを取得する（返信は深さ優先・古い順に並べてページ分割する）
+func (app *App) getThread(postID, page int) (*Thread, error) {
+	rootID, err := threadRoot(app.db, postID)
+	if err != nil {
+		return nil, err
+	}
+
+	// スレッド全体の親子関係だけを読み込み、表示する投稿を決める
+	rows, err := app.db.Query(`SELECT id, COALESCE(in_reply_to, 0) FROM posts
+		WHERE id = ? OR root_id = ?
+		ORDER BY created_at, id`, rootID, rootID)
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[int]int)
+	children := make(map[int][]int)
+	order := make(map[int]int)
+	for rows.Next() {
+		var id, parentID int
+		if err := rows.Scan(&id, &parentID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		parents[id] = parentID
+		children[parentID] = append(children[parentID], id)
+		order[id] = 2*len(order) + 1
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	thread := &Thread{Page: page}
+
+	// 返信先をたどる（削除済みの投稿で途切れる場合がある）
+	var ancestorIDs []int
+	parentID := parents[postID]
+	for parentID != 0 {
+		next, ok := parents[parentID]
+		if !ok {
+			thread.ParentDeleted = true
+			break
+		}
+		ancestorIDs = append([]int{parentID}, ancestorIDs...)
+		parentID = next
+	}
+
+	// 削除された投稿への返信は返信先をたどれないため、起点の投稿を表示するときに
+	// 起点への返信として削除済みの表示を置き、その下に並べる
+	if postID == rootID {
+		var orphaned bool
+		for parentID, ids := range children {
+			if _, ok := parents[parentID]; ok || parentID == 0 {
+				continue
+			}
+			// 削除された投稿は最初の返信の直前に置く
+			order[parentID] = order[ids[0]] - 1
+			children[rootID] = append(children[rootID], parentID)
+			orphaned = true
+		}
+		if orphaned {
+			top := children[rootID]
+			sort.Slice(top, func(i, j int) bool { return order[top[i]] < order[top[j]] })
+		}
+	}
+
+	// 返信ツリーを深さ優先で並べる
+	type node struct{ id, depth int }
+	var replies []node
+	var walk func(id, depth int)
+	walk = func(id, depth int) {
+		for _, child := range children[id] {
+			replies = append(replies, node{child, depth})
+			walk(child, depth+1)
+		}
+	}
+	walk(postID, 1)
+
+	start := min((page-1)*threadPageSize, len(replies))
+	end := min(start+threadPageSize, len(replies))
+	thread.HasMore = end < len(replies)
+
+	ids := append([]int{postID}, ancestorIDs...)
+	for _, n := range replies[start:end] {
+		ids = append(ids, n.id)
+	}
+	posts := app.getPostsByID(ids)
+
+	focus, ok := posts[postID]
+	if !ok {
+		return nil, errPostNotFound
+	}
+	thread.Post = focus
+	thread.Ancestors = []Post{}
+	for _, id := range ancestorIDs {
+		thread.Ancestors = append(thread.Ancestors, posts[id])
+	}
+	thread.Replies = []ThreadReply{}
+	for _, n := range replies[start:end] {
+		post, ok := posts[n.id]
+		if !ok {
+			post = Post{ID: n.id}
+		}
+		thread.Replies = append(thread.Replies, ThreadReply{Post: post, Depth: n.depth, Deleted: !ok})
+	}
+	return thread, nil
+}
+
+// 投稿をIDで取得する
+func (app *App) getPostsByID(ids []int) map[int]Post {
+	query, args := postsByIDQuery(ids)
+	posts := make(map[int]Post, len(ids))
+	for _, post := range app.queryPosts(query, args...) {
+		posts[post.ID] = post
+	}
+	return posts
+}
+
+func postsByIDQuery(ids []int) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		args[i] = id
+		placeholders[i] = "?"
+	}
+
+	query := `
+		SELECT p.id, p.user_id, u.username, u.avatar, p.content, p.in_reply_to, p.quote_of,
+		       p.likes, p.comments, p.reposts, p.created_at, p.edited_at
+		FROM posts p
+		JOIN users u ON p.user_id = u.id
+		WHERE p.id IN (` + strings.Join(placeholders, ",") + `)`
+	return query, args
+}
+
+// スレッド表示ページ
+func (app *App) threadHandler(w http.ResponseWriter, r *http.Request) {
+	postID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	app.renderThread(w, r, postID, app.getCurrentUserID(w, r), "")
+}
+
+func (app *App) renderThread(w http.ResponseWriter, r *http.Request, postID, userID int, errMsg string) {
+	thread, err := app.getThread(postID, pageParam(r))
+	if err == errPostNotFound {
+		http.Error(w, "投稿が見つかりません", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "スレッドの取得に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		Title:           thread.Post.Username + "の投稿",
+		IsAuthenticated: userID > 0,
+		CurrentUserID:   userID,
+		Thread:          thread,
+		Error:           errMsg,
+	}
+	app.renderTemplate(w, r, "thread", data)
+}
+
+// スレッド取得API
+func (app *App) getThreadAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	postID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid post ID",
+		})
+		return
+	}
+
+	thread, err := app.getThread(postID, pageParam(r))
+	if err != nil {
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Post not found",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Thread:  thread,
+	})
+}
+
+// ページ番号（1から）
+func pageParam(r *http.Request) int {
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		return p
+	}
+	return 1
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func createTestReply(t *testing.T, app *App, userID, replyTo int, content string) int {
+	t.Helper()
+
+	postID, err := app.createPost(userID, content, postRefs{replyTo: replyTo}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return postID
+}
+
+type threadEntry struct {
+	id, depth int
+	deleted   bool
+}
+
+func threadEntries(thread *Thread) []threadEntry {
+	var entries []threadEntry
+	for _, r := range thread.Replies {
+		entries = append(entries, threadEntry{r.ID, r.Depth, r.Deleted})
+	}
+	return entries
+}
+
+func TestThreadDepthFirstOrder(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	bob := createTestUser(t, app, "bob", true)
+
+	root, err := app.createPost(alice, "起点", postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := createTestReply(t, app, bob, root, "a")
+	b := createTestReply(t, app, alice, root, "b")
+	a1 := createTestReply(t, app, alice, a, "a1")
+	b1 := createTestReply(t, app, bob, b, "b1")
+	a1x := createTestReply(t, app, bob, a1, "a1x")
+	a2 := createTestReply(t, app, bob, a, "a2")
+
+	thread, err := app.getThread(root, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []threadEntry{{a, 1, false}, {a1, 2, false}, {a1x, 3, false}, {a2, 2, false}, {b, 1, false}, {b1, 2, false}}
+	if got := threadEntries(thread); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replies = %v, want %v", got, want)
+	}
+
+	// 返信を表示すると深さはその投稿から数える
+	thread, err = app.getThread(a1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thread.Ancestors) != 2 || thread.Ancestors[0].ID != root || thread.Ancestors[1].ID != a {
+		t.Fatalf("ancestors = %v, want [%d %d]", thread.Ancestors, root, a)
+	}
+	want = []threadEntry{{a1x, 1, false}}
+	if got := threadEntries(thread); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replies = %v, want %v", got, want)
+	}
+}
+
+func TestThreadPagination(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+
+	root, err := app.createPost(alice, "起点", postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []int
+	for i := 0; i < threadPageSize+5; i++ {
+		replies = append(replies, createTestReply(t, app, alice, root, "返信"+strconv.Itoa(i)))
+	}
+
+	var seen []int
+	for _, tc := range []struct{ page, replies int }{{1, threadPageSize}, {2, 5}, {3, 0}} {
+		thread, err := app.getThread(root, tc.page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(thread.Replies) != tc.replies {
+			t.Fatalf("page %d: %d replies, want %d", tc.page, len(thread.Replies), tc.replies)
+		}
+		if thread.HasMore != (tc.page == 1) {
+			t.Fatalf("page %d: HasMore = %v", tc.page, thread.HasMore)
+		}
+		for _, r := range thread.Replies {
+			seen = append(seen, r.ID)
+		}
+	}
+
+	// ページをつなげると全ての返信が古い順に1回ずつ並ぶ
+	if !reflect.DeepEqual(seen, replies) {
+		t.Fatalf("paged replies = %v, want %v", seen, replies)
+	}
+}
+
+func TestThreadKeepsRepliesToDeletedPosts(t *testing.T) {
+	app, _ := newTestApp(t)
+	alice := createTestUser(t, app, "alice", true)
+	bob := createTestUser(t, app, "bob", true)
+
+	root, err := app.createPost(alice, "起点", postRefs{}, &postAttachments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := createTestReply(t, app, alice, root, "最初の返信")
+	deleted := createTestReply(t, app, bob, root, "削除する返信")
+	orphan := createTestReply(t, app, alice, deleted, "削除された投稿への返信")
+	nested := createTestReply(t, app, bob, orphan, "さらに返信")
+	last := createTestReply(t, app, alice, root, "最後の返信")
+	if _, err := app.deletePost(deleted, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	thread, err := app.getThread(root, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []threadEntry{{first, 1, false}, {deleted, 1, true}, {orphan, 2, false}, {nested, 3, false}, {last, 1, false}}
+	if got := threadEntries(thread); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replies = %v, want %v", got, want)
+	}
+
+	// 削除された投稿への返信を表示すると返信先の削除を示す
+	thread, err = app.getThread(orphan, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !thread.ParentDeleted || len(thread.Ancestors) != 0 {
+		t.Fatalf("ParentDeleted = %v ancestors = %v", thread.ParentDeleted, thread.Ancestors)
+	}
+
+	r := httptest.NewRequest("GET", "/posts/"+strconv.Itoa(root), nil)
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(root)})
+	w := httptest.NewRecorder()
+	app.threadHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("thread page: status %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "この投稿は削除されました") || !strings.Contains(body, "削除された投稿への返信") {
+		t.Fatal("thread page does not show the deleted placeholder and its replies")
+	}
+}
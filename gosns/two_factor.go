@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod         = 30
+	totpDigits         = 6
+	totpSkew           = 1
+	recoveryCodeCount  = 10
+	pendingLoginTTL    = 5 * time.Minute
+	pendingLoginCookie = "pending_login"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPシークレット生成（160bit）
+func generateTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// RFC 6238 のコード計算
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// コードを検証し、一致したタイムステップを返す
+// lastStep 以前のステップは再利用として拒否する
+func validateTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		step := current + int64(i)
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// 認証アプリ登録用URI
+func totpURI(secret, account string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", "GoSNS")
+	v.Set("period", strconv.Itoa(totpPeriod))
+	v.Set("digits", strconv.Itoa(totpDigits))
+	return "otpauth://totp/" + url.PathEscape("GoSNS:"+account) + "?" + v.Encode()
+}
+
+// リカバリーコードを再生成（平文は呼び出し元で一度だけ表示）
+func (app *App) regenerateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = raw[:4] + "-" + raw[4:]
+		if _, err := tx.Exec("INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)",
+			userID, hashToken(raw)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// リカバリーコードを消費
+func (app *App) useRecoveryCode(userID int, code string) bool {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	res, err := app.db.Exec("UPDATE totp_recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		userID, hashToken(normalized))
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// TOTPコードまたはリカバリーコードを検証
+func (app *App) verifySecondFactor(userID int, code string) bool {
+	var secret string
+	var lastStep int64
+	err := app.db.QueryRow("SELECT COALESCE(totp_secret, ''), totp_last_step FROM users WHERE id = ?", userID).
+		Scan(&secret, &lastStep)
+	if err != nil || secret == "" {
+		return false
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := validateTOTP(secret, code, time.Now(), lastStep); ok {
+		// 同じコードの再利用を防ぐため使用済みステップを記録（同時に送られた同じコードは1件だけ通す）
+		res, err := app.db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?",
+			step, userID, step)
+		if err != nil {
+			return false
+		}
+		n, _ := res.RowsAffected()
+		return n == 1
+	}
+	return app.useRecoveryCode(userID, code)
+}
+
+// パスワード・外部認証成功後の処理（2FA有効時は2段階目へ）
+func (app *App) completeLogin(w http.ResponseWriter, r *http.Request, userID int, username string) {
+	var totpEnabled bool
+	app.db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", userID).Scan(&totpEnabled)
+
+	if totpEnabled {
+		expires := time.Now().Add(pendingLoginTTL).Unix()
+		http.SetCookie(w, &http.Cookie{
+			Name:     pendingLoginCookie,
+			Value:    signToken(fmt.Sprintf("%d.%d", userID, expires)),
+			HttpOnly: true,
+			Secure:   false,
+			MaxAge:   int(pendingLoginTTL.Seconds()),
+			Path:     "/login/2fa",
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.startSession(w, r, userID, username); err != nil {
+		http.Error(w, "ログインに失敗しました", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, popLoginNext(w, r), http.StatusSeeOther)
+}
+
+// 2段階目待ちのユーザーID取得
+func pendingLoginUserID(r *http.Request) int {
+	cookie, err := r.Cookie(pendingLoginCookie)
+	if err != nil {
+		return 0
+	}
+	payload, ok := verifySignedToken(cookie.Value)
+	if !ok {
+		return 0
+	}
+
+	parts := strings.SplitN(payload, ".", 2)
+	if len(parts) != 2 {
+		return 0
+	}
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0
+	}
+	return userID
+}
+
+// ログイン2段階目（認証コード入力）
+func (app *App) twoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	userID := pendingLoginUserID(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	data := PageData{Title: "二段階認証"}
+	if r.Method == "GET" {
+		app.renderTemplate(w, r, "two_factor_login", data)
+		return
+	}
+
+	if wait := app.loginRetryAfter(r, userID, ""); wait > 0 {
+		setRetryAfter(w, wait)
+		data.Error = "認証の試行回数が多すぎます。しばらく時間をおいてから再度お試しください"
+		app.renderTemplate(w, r, "two_factor_login", data)
+		return
+	}
+
+	if !app.verifySecondFactor(userID, r.FormValue("code")) {
+		app.recordLoginFailure(r, userID, "", loginMethodTOTP)
+		data.Error = "認証コードが正しくありません"
+		app.renderTemplate(w, r, "two_factor_login", data)
+		return
+	}
+	app.recordLogin(r, userID, "", loginMethodTOTP, true)
+
+	var username string
+	if err := app.db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		http.Error(w, "ログインに失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingLoginCookie,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/login/2fa",
+		SameSite: http.SameSiteLaxMode,
+	})
+	if err := app.startSession(w, r, userID, username); err != nil {
+		http.Error(w, "ログインに失敗しました", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, popLoginNext(w, r), http.StatusSeeOther)
+}
+
+// 二段階認証設定ページ
+func (app *App) twoFactorSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	var user User
+	var secret string
+	err := app.db.QueryRow("SELECT id, username, email, totp_enabled, COALESCE(totp_secret, '') FROM users WHERE id = ?", userID).
+		Scan(&user.ID, &user.Username, &user.Email, &user.TOTPEnabled, &secret)
+	if err != nil {
+		http.Error(w, "ユーザーが見つかりません", http.StatusNotFound)
+		return
+	}
+
+	data := PageData{
+		Title:           "二段階認証",
+		IsAuthenticated: true,
+		CurrentUserID:   userID,
+		CurrentUser:     &user,
+	}
+
+	// 未登録の場合は確認待ちのシークレットを発行
+	if !user.TOTPEnabled {
+		if secret == "" {
+			secret = generateTOTPSecret()
+			app.db.Exec("UPDATE users SET totp_secret = ? WHERE id = ?", secret, userID)
+		}
+		data.TOTPSecret = secret
+		data.TOTPURI = totpURI(secret, user.Email)
+	}
+
+	app.renderTemplate(w, r, "two_factor", data)
+}
+
+// 二段階認証の有効化
+func (app *App) enableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	var user User
+	var secret string
+	err := app.db.QueryRow("SELECT id, username, email, totp_enabled, COALESCE(totp_secret, '') FROM users WHERE id = ?", userID).
+		Scan(&user.ID, &user.Username, &user.Email, &user.TOTPEnabled, &secret)
+	if err != nil || user.TOTPEnabled || secret == "" {
+		http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+		return
+	}
+
+	data := PageData{
+		Title:           "二段階認証",
+		IsAuthenticated: true,
+		CurrentUserID:   userID,
+		CurrentUser:     &user,
+	}
+
+	step, ok := validateTOTP(secret, strings.TrimSpace(r.FormValue("code")), time.Now(), 0)
+	if !ok {
+		data.Error = "認証コードが正しくありません"
+		data.TOTPSecret = secret
+		data.TOTPURI = totpURI(secret, user.Email)
+		app.renderTemplate(w, r, "two_factor", data)
+		return
+	}
+
+	codes, err := app.regenerateRecoveryCodes(userID)
+	if err != nil {
+		log.Println("リカバリーコード生成エラー:", err)
+		http.Error(w, "二段階認証の設定に失敗しました", http.StatusInternalServerError)
+		return
+	}
+	app.db.Exec("UPDATE users SET totp_enabled = TRUE, totp_last_step = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		step, userID)
+
+	user.TOTPEnabled = true
+	data.Message = "二段階認証を有効にしました"
+	data.RecoveryCodes = codes
+	app.renderTemplate(w, r, "two_factor", data)
+}
+
+// 二段階認証の無効化
+func (app *App) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	if !app.verifySecondFactor(userID, r.FormValue("code")) {
+		var user User
+		app.db.QueryRow("SELECT id, username, email, totp_enabled FROM users WHERE id = ?", userID).
+			Scan(&user.ID, &user.Username, &user.Email, &user.TOTPEnabled)
+		app.renderTemplate(w, r, "two_factor", PageData{
+			Title:           "二段階認証",
+			IsAuthenticated: true,
+			CurrentUserID:   userID,
+			CurrentUser:     &user,
+			Error:           "認証コードが正しくありません",
+		})
+		return
+	}
+
+	app.db.Exec("UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_last_step = 0, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		userID)
+	app.db.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID)
+
+	http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+}
+
+// リカバリーコードの再発行
+func (app *App) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	var user User
+	err := app.db.QueryRow("SELECT id, username, email, totp_enabled FROM users WHERE id = ?", userID).
+		Scan(&user.ID, &user.Username, &user.Email, &user.TOTPEnabled)
+	if err != nil || !user.TOTPEnabled {
+		http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+		return
+	}
+
+	data := PageData{
+		Title:           "二段階認証",
+		IsAuthenticated: true,
+		CurrentUserID:   userID,
+		CurrentUser:     &user,
+	}
+
+	if !app.verifySecondFactor(userID, r.FormValue("code")) {
+		data.Error = "認証コードが正しくありません"
+		app.renderTemplate(w, r, "two_factor", data)
+		return
+	}
+
+	codes, err := app.regenerateRecoveryCodes(userID)
+	if err != nil {
+		log.Println("リカバリーコード生成エラー:", err)
+		http.Error(w, "リカバリーコードの生成に失敗しました", http.StatusInternalServerError)
+		return
+	}
+
+	data.Message = "リカバリーコードを再発行しました"
+	data.RecoveryCodes = codes
+	app.renderTemplate(w, r, "two_factor", data)
+}
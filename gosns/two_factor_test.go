@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TOTPを有効にしたユーザーを作成し、現在のコードを返す
+func enableTestTOTP(t *testing.T, app *App, username string) (int, string) {
+	t.Helper()
+
+	userID := createTestUser(t, app, username, true)
+	secret := generateTOTPSecret()
+	if _, err := app.db.Exec("UPDATE users SET totp_secret = ?, totp_enabled = TRUE WHERE id = ?", secret, userID); err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID, totpCode(key, time.Now().Unix()/totpPeriod)
+}
+
+func TestSecondFactorRejectsReplay(t *testing.T) {
+	app, _ := newTestApp(t)
+	userID, code := enableTestTOTP(t, app, "alice")
+
+	if !app.verifySecondFactor(userID, code) {
+		t.Fatal("valid code rejected")
+	}
+	if app.verifySecondFactor(userID, code) {
+		t.Fatal("replayed code accepted")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// アップロードの上限
+const (
+	maxPostImageSize     = 10 << 20
+	maxAvatarSize        = 5 << 20
+	maxImagePixels       = 40_000_000
+	maxAnimationPixels   = 100_000_000 // アニメーションGIFのフレーム数×幅×高さ
+	maxFormBodySize      = 1 << 20
+	maxPostImages        = 4
+	maxAltTextLength     = 1000
+	maxVideoSize         = 40 << 20
+	maxMultipartBodySize = max(maxPostImages*maxPostImageSize, maxVideoSize) + maxFormBodySize
+	maxUploadMemory      = 8 << 20
+)
+
+// 許可する画像形式
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var (
+	errUploadTooLarge = errors.New("upload exceeds size limit")
+	errUploadType     = errors.New("unsupported upload type")
+	errUploadInvalid  = errors.New("upload is not a valid image")
+	errTooManyImages  = errors.New("too many images")
+	errAltTooLong     = errors.New("alt text too long")
+	errMixedMedia     = errors.New("video cannot be combined with other media")
+)
+
+// フォームに表示するエラーメッセージ
+func uploadErrorMessage(err error) string {
+	switch err {
+	case errUploadTooLarge:
+		return "画像のファイルサイズまたは解像度が大きすぎます"
+	case errUploadType:
+		return "JPEG・PNG・GIF・WebP形式の画像を選択してください"
+	case errUploadInvalid:
+		return "画像ファイルが壊れているか、画像以外のデータが含まれています"
+	case errTooManyImages:
+		return fmt.Sprintf("画像は%d枚まで添付できます", maxPostImages)
+	case errAltTooLong:
+		return fmt.Sprintf("代替テキストは%d文字以内で入力してください", maxAltTextLength)
+	case errMixedMedia:
+		return "動画・アニメーションGIFは1投稿に1つだけ、画像と同時には添付できません"
+	case errVideoUnavailable:
+		return "動画のアップロードは現在利用できません"
+	case errVideoTooLarge:
+		return fmt.Sprintf("動画のファイルサイズは%dMBまでです", maxVideoSize>>20)
+	case errVideoTooLong:
+		return fmt.Sprintf("動画の長さは%d秒までです", int(maxVideoDuration.Seconds()))
+	case errVideoInvalid:
+		return "動画ファイルを読み込めませんでした"
+	}
+	return "画像の保存に失敗しました"
+}
+
+func uploadErrorStatus(err error) int {
+	switch err {
+	case errUploadTooLarge, errVideoTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errUploadType, errVideoUnavailable:
+		return http.StatusUnsupportedMediaType
+	case errUploadInvalid, errTooManyImages, errAltTooLong, errMixedMedia, errVideoTooLong, errVideoInvalid:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func isMultipart(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+}
+
+// リクエストボディの上限設定とマルチパートフォームの解析
+func limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMultipart(r) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxFormBodySize)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxMultipartBodySize)
+		if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("ファイルサイズが大きすぎます（上限 %dMB）", maxPostImageSize>>20), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "フォームの送信内容が正しくありません", http.StatusBadRequest)
+			return
+		}
+		// ルーターがリクエストを複製するため、一時ファイルはここで削除する
+		defer r.MultipartForm.RemoveAll()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// アップロードファイルの配信（ブラウザによる形式推測やスクリプト実行を防ぐ）
+func uploadHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 保存済みの画像（サイズごとの参照と寸法）
+type savedImage struct {
+	refs     map[string]string
+	sizes    map[string]image.Point
+	blurhash string
+}
+
+// フォームで送信されたファイル（未選択の場合は空）
+func uploadedFiles(r *http.Request, field string) []*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+			return nil
+		}
+	}
+	return r.MultipartForm.File[field]
+}
+
+// フォームの画像を1枚保存する（未選択の場合は nil）
+func (app *App) saveUploadedImage(r *http.Request, field string, maxSize int64, variants []imageVariant) (*savedImage, error) {
+	files := uploadedFiles(r, field)
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return app.saveImage(r.Context(), files[0], maxSize, variants)
+}
+
+// 画像を検証・変換して保存する
+func (app *App) saveImage(ctx context.Context, header *multipart.FileHeader, maxSize int64, variants []imageVariant) (*savedImage, error) {
+	if header.Size > maxSize {
+		return nil, errUploadTooLarge
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errUploadTooLarge
+	}
+
+	// 送信されたファイル名やContent-Typeは信用せず、内容から形式を判定する
+	if !allowedImageTypes[http.DetectContentType(data)] {
+		return nil, errUploadType
+	}
+	if err := validateImage(data); err != nil {
+		return nil, err
+	}
+
+	processed, err := processImage(data, variants)
+	if err != nil {
+		return nil, err
+	}
+	return app.storeImage(ctx, processed)
+}
+
+// 変換済みの画像を保存先に書き込む
+func (app *App) storeImage(ctx context.Context, processed *processedImage) (*savedImage, error) {
+	base := uuid.New().String()
+	saved := &savedImage{
+		refs:     make(map[string]string),
+		sizes:    make(map[string]image.Point),
+		blurhash: processed.blurhash,
+	}
+	for name, f := range processed.files {
+		key := base + "_" + name + f.ext
+		if err := app.media.Put(ctx, key, bytes.NewReader(f.data), int64(len(f.data)), mediaContentType(key)); err != nil {
+			app.deleteSavedImages(ctx, saved)
+			return nil, err
+		}
+		saved.refs[name] = mediaRefPrefix + key
+		saved.sizes[name] = image.Pt(f.width, f.height)
+	}
+	return saved, nil
+}
+
+// 保存済みの画像を削除（後続の処理に失敗した場合など）
+func (app *App) deleteSavedImages(ctx context.Context, images ...*savedImage) {
+	for _, img := range images {
+		for _, ref := range img.refs {
+			app.deleteMedia(ctx, ref)
+		}
+	}
+}
+
+// 画像として正しく、画素数が上限以内であることを確認
+// （保存するのは再エンコードした画像のみなので、元データに付加されたデータは残らない）
+func validateImage(data []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errUploadInvalid
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return errUploadTooLarge
+	}
+	return nil
+}
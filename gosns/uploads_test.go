@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func testJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// モーションフォトやMPFのように末尾にデータが付いたJPEGも受け付け、保存時には取り除く
+func TestImageWithTrailerIsReencoded(t *testing.T) {
+	trailer := append(testJPEG(t, 8, 8), []byte("MotionPhoto_Data<html>")...)
+	data := append(testJPEG(t, 64, 48), trailer...)
+
+	if err := validateImage(data); err != nil {
+		t.Fatalf("validateImage: %v", err)
+	}
+	processed, err := processImage(data, []imageVariant{{name: "feed", maxSize: 1080}})
+	if err != nil {
+		t.Fatalf("processImage: %v", err)
+	}
+	f := processed.files["feed"]
+	if f.width != 64 || f.height != 48 {
+		t.Fatalf("size = %dx%d, want 64x48", f.width, f.height)
+	}
+	if bytes.Contains(f.data, []byte("MotionPhoto_Data")) {
+		t.Fatal("trailer kept in stored image")
+	}
+}
+
+func TestValidateImageRejectsInvalid(t *testing.T) {
+	if err := validateImage([]byte("<html>not an image</html>")); err != errUploadInvalid {
+		t.Fatalf("err = %v, want errUploadInvalid", err)
+	}
+}
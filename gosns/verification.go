@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	verificationTokenTTL   = 24 * time.Hour
+	verificationResendWait = time.Minute
+	verificationDailyLimit = 5
+)
+
+// 認証メール送信
+func (app *App) sendVerificationEmail(userID int, email string) error {
+	token := signToken(fmt.Sprintf("%d.%s", userID, randomToken(24)))
+
+	_, err := app.db.Exec("INSERT INTO email_verifications (user_id, token_hash, expires_at) VALUES (?, ?, ?)",
+		userID, hashToken(token), sqlTime(time.Now().Add(verificationTokenTTL)))
+	if err != nil {
+		return err
+	}
+
+	link := baseURL + "/verify?token=" + url.QueryEscape(token)
+	return app.mailer.Send(Message{
+		To:      email,
+		Subject: "【GoSNS】メールアドレスの確認",
+		Body: "GoSNSへのご登録ありがとうございます。\n\n" +
+			"以下のリンクからメールアドレスを確認してください（24時間有効）。\n\n" +
+			link + "\n",
+	})
+}
+
+// 認証トークンを検証してユーザーを認証済みにする
+func (app *App) confirmEmailVerification(token string) error {
+	payload, ok := verifySignedToken(token)
+	if !ok {
+		return fmt.Errorf("invalid token signature")
+	}
+	userID, err := strconv.Atoi(strings.SplitN(payload, ".", 2)[0])
+	if err != nil {
+		return fmt.Errorf("invalid token payload")
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(`SELECT id FROM email_verifications
+		WHERE token_hash = ? AND user_id = ? AND used_at IS NULL AND expires_at > ?`,
+		hashToken(token), userID, sqlTime(time.Now())).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("token not found or expired")
+	}
+
+	// 同一ユーザーの未使用トークンもまとめて無効化
+	if _, err := tx.Exec("UPDATE email_verifications SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND used_at IS NULL",
+		userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET verified = TRUE, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 再送信の制限確認
+func (app *App) verificationThrottled(userID int) bool {
+	var recent, daily int
+	app.db.QueryRow("SELECT COUNT(*) FROM email_verifications WHERE user_id = ? AND created_at > ?",
+		userID, sqlTime(time.Now().Add(-verificationResendWait))).Scan(&recent)
+	app.db.QueryRow("SELECT COUNT(*) FROM email_verifications WHERE user_id = ? AND created_at > ?",
+		userID, sqlTime(time.Now().Add(-24*time.Hour))).Scan(&daily)
+	return recent > 0 || daily >= verificationDailyLimit
+}
+
+// ユーザーの認証状態取得
+func (app *App) isVerified(userID int) bool {
+	var verified bool
+	err := app.db.QueryRow("SELECT verified FROM users WHERE id = ?", userID).Scan(&verified)
+	return err == nil && verified
+}
+
+// メール確認ページ
+func (app *App) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	data := PageData{Title: "メールアドレスの確認"}
+
+	userID := app.getCurrentUserID(w, r)
+	if userID > 0 {
+		data.IsAuthenticated = true
+		data.CurrentUserID = userID
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		if userID > 0 && app.isVerified(userID) {
+			data.Message = "メールアドレスは確認済みです"
+		}
+		app.renderTemplate(w, r, "verify", data)
+		return
+	}
+
+	if err := app.confirmEmailVerification(token); err != nil {
+		data.Error = "確認リンクが無効か、有効期限が切れています"
+		app.renderTemplate(w, r, "verify", data)
+		return
+	}
+
+	data.Message = "メールアドレスの確認が完了しました"
+	app.renderTemplate(w, r, "verify", data)
+}
+
+// 認証メール再送信
+func (app *App) resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	data := PageData{
+		Title:           "メールアドレスの確認",
+		IsAuthenticated: true,
+		CurrentUserID:   userID,
+	}
+
+	var email string
+	var verified bool
+	err := app.db.QueryRow("SELECT email, verified FROM users WHERE id = ?", userID).Scan(&email, &verified)
+	if err != nil {
+		http.Error(w, "ユーザーが見つかりません", http.StatusNotFound)
+		return
+	}
+
+	if verified {
+		data.Message = "メールアドレスは確認済みです"
+		app.renderTemplate(w, r, "verify", data)
+		return
+	}
+
+	if app.verificationThrottled(userID) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		data.Error = "しばらく時間をおいてから再度お試しください"
+		app.renderTemplate(w, r, "verify", data)
+		return
+	}
+
+	if err := app.sendVerificationEmail(userID, email); err != nil {
+		log.Println("認証メール送信エラー:", err)
+		data.Error = "メールの送信に失敗しました"
+		app.renderTemplate(w, r, "verify", data)
+		return
+	}
+
+	data.Message = "確認メールを送信しました"
+	app.renderTemplate(w, r, "verify", data)
+}
+
+// 未認証ユーザーの操作を制限
+func (app *App) requireVerified(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(int)
+		if app.isVerified(userID) {
+			next(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(APIResponse{
+				Success: false,
+				Message: "Email address not verified",
+			})
+			return
+		}
+
+		http.Redirect(w, r, "/verify", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 送信されたメールの本文から確認トークンを取り出す
+func verificationToken(t *testing.T, msg Message) string {
+	t.Helper()
+
+	i := strings.Index(msg.Body, "/verify?token=")
+	if i < 0 {
+		t.Fatalf("verification link not found in body: %q", msg.Body)
+	}
+	link := strings.Fields(msg.Body[i:])[0]
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get("token")
+}
+
+func TestEmailVerificationFlow(t *testing.T) {
+	app, mailer := newTestApp(t)
+	userID := createTestUser(t, app, "alice", false)
+
+	if err := app.sendVerificationEmail(userID, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := mailer.Messages()
+	if len(msgs) != 1 || msgs[0].To != "alice@example.com" {
+		t.Fatalf("messages = %+v, want one message to alice", msgs)
+	}
+	token := verificationToken(t, msgs[0])
+
+	if err := app.confirmEmailVerification(token + "x"); err == nil {
+		t.Fatal("tampered token was accepted")
+	}
+	if app.isVerified(userID) {
+		t.Fatal("user verified before confirming")
+	}
+
+	if err := app.confirmEmailVerification(token); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	if !app.isVerified(userID) {
+		t.Fatal("user not verified after confirming")
+	}
+
+	// 使用済みのトークンは再利用できない
+	if err := app.confirmEmailVerification(token); err == nil {
+		t.Fatal("used token was accepted again")
+	}
+}
+
+func TestEmailVerificationExpired(t *testing.T) {
+	app, mailer := newTestApp(t)
+	userID := createTestUser(t, app, "bob", false)
+
+	if err := app.sendVerificationEmail(userID, "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	token := verificationToken(t, mailer.Messages()[0])
+
+	_, err := app.db.Exec("UPDATE email_verifications SET expires_at = ? WHERE user_id = ?",
+		sqlTime(time.Now().Add(-time.Minute)), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.confirmEmailVerification(token); err == nil {
+		t.Fatal("expired token was accepted")
+	}
+	if app.isVerified(userID) {
+		t.Fatal("user verified with expired token")
+	}
+}
+
+func TestResendVerificationThrottle(t *testing.T) {
+	app, mailer := newTestApp(t)
+	userID := createTestUser(t, app, "carol", false)
+
+	resend := func() int {
+		w := httptest.NewRecorder()
+		r := withUser(httptest.NewRequest("POST", "/verify/resend", nil), userID)
+		app.resendVerificationHandler(w, r)
+		return w.Code
+	}
+	// 送信時刻を過去にずらして待ち時間を経過させる
+	age := func(d time.Duration) {
+		_, err := app.db.Exec("UPDATE email_verifications SET created_at = ? WHERE user_id = ?",
+			sqlTime(time.Now().Add(-d)), userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if code := resend(); code != http.StatusOK {
+		t.Fatalf("first resend: status %d", code)
+	}
+	if code := resend(); code != http.StatusTooManyRequests {
+		t.Fatalf("immediate resend: status %d, want 429", code)
+	}
+	if n := len(mailer.Messages()); n != 1 {
+		t.Fatalf("sent %d messages, want 1", n)
+	}
+
+	for i := 1; i < verificationDailyLimit; i++ {
+		age(2 * verificationResendWait)
+		if code := resend(); code != http.StatusOK {
+			t.Fatalf("resend %d: status %d", i+1, code)
+		}
+	}
+
+	// 1日の上限に達したら待ち時間が経過しても送らない
+	age(2 * verificationResendWait)
+	if code := resend(); code != http.StatusTooManyRequests {
+		t.Fatalf("resend over daily limit: status %d, want 429", code)
+	}
+	if n := len(mailer.Messages()); n != verificationDailyLimit {
+		t.Fatalf("sent %d messages, want %d", n, verificationDailyLimit)
+	}
+}
+
+func TestRequireVerifiedBlocksPosting(t *testing.T) {
+	app, _ := newTestApp(t)
+	unverified := createTestUser(t, app, "dave", false)
+	verified := createTestUser(t, app, "erin", true)
+
+	post := func(userID int) *httptest.ResponseRecorder {
+		form := url.Values{"content": {"hello"}}
+		r := httptest.NewRequest("POST", "/posts", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		app.requireVerified(app.createPostHandler)(w, withUser(r, userID))
+		return w
+	}
+	countPosts := func(userID int) int {
+		var n int
+		if err := app.db.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = ?", userID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	w := post(unverified)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/verify" {
+		t.Fatalf("unverified post: status %d location %q, want redirect to /verify", w.Code, w.Header().Get("Location"))
+	}
+	if n := countPosts(unverified); n != 0 {
+		t.Fatalf("unverified user created %d posts", n)
+	}
+
+	w = post(verified)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("verified post: status %d location %q", w.Code, w.Header().Get("Location"))
+	}
+	if n := countPosts(verified); n != 1 {
+		t.Fatalf("verified user has %d posts, want 1", n)
+	}
+}
+
+func TestRequireVerifiedAPI(t *testing.T) {
+	app, _ := newTestApp(t)
+	userID := createTestUser(t, app, "frank", false)
+
+	called := false
+	h := app.requireVerified(func(w http.ResponseWriter, r *http.Request) { called = true })
+	w := httptest.NewRecorder()
+	h(w, withUser(httptest.NewRequest("POST", "/api/posts/1/comments", nil), userID))
+
+	if called {
+		t.Fatal("handler called for unverified user")
+	}
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want 403", w.Code)
+	}
+}
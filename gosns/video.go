@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 動画の上限と変換設定
+const (
+	maxVideoDuration  = 140 * time.Second
+	maxVideoDimension = 4096
+	videoOutputSize   = 1280
+	videoProbeTimeout = 30 * time.Second
+	videoJobTimeout   = 10 * time.Minute
+	videoQueueSize    = 64
+)
+
+// 添付メディアの種別
+const (
+	mediaTypeImage = "image"
+	mediaTypeVideo = "video"
+	mediaTypeGIF   = "gif"
+)
+
+// 添付メディアの処理状態
+const (
+	mediaStatusReady      = "ready"
+	mediaStatusProcessing = "processing"
+	mediaStatusFailed     = "failed"
+)
+
+// 許可する動画形式と保存時の拡張子
+var allowedVideoTypes = map[string]string{
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+}
+
+// ffmpegに指定する入力形式（内容からの推測に任せず、判定済みの形式に固定する）
+var videoDemuxers = map[string]string{
+	".mp4":  "mov",
+	".webm": "matroska",
+	".gif":  "gif",
+}
+
+// ポスター画像（動画の1フレーム目）のサイズ
+var posterImageVariants = []imageVariant{
+	{name: "thumb", maxSize: 320, square: true},
+	{name: "poster", maxSize: 1080},
+}
+
+var (
+	errVideoUnavailable = errors.New("video processing is not available")
+	errVideoTooLarge    = errors.New("video exceeds size limit")
+	errVideoTooLong     = errors.New("video exceeds duration limit")
+	errVideoInvalid     = errors.New("upload is not a valid video")
+)
+
+func init() {
+	// 環境によっては mime.types に含まれないため登録しておく
+	mime.AddExtensionType(".mp4", "video/mp4")
+	mime.AddExtensionType(".webm", "video/webm")
+}
+
+// 保存済みの変換前の動画
+type savedVideo struct {
+	kind string
+	ref  string
+	info *videoInfo
+}
+
+// ffprobeで取得した動画の情報
+type videoInfo struct {
+	width    int
+	height   int
+	duration float64
+}
+
+// ffmpegによる動画変換ジョブ
+type videoProcessor struct {
+	ffmpeg  string
+	ffprobe string
+	jobs    chan int
+}
+
+// コマンドが見つからない場合は nil を返す（動画投稿は無効になる）
+func newVideoProcessor(cfg VideoConfig) *videoProcessor {
+	if cfg.FFmpeg == "" || cfg.FFprobe == "" {
+		return nil
+	}
+	ffmpeg, err := exec.LookPath(cfg.FFmpeg)
+	if err != nil {
+		log.Println("ffmpegが見つからないため動画投稿を無効にします:", err)
+		return nil
+	}
+	ffprobe, err := exec.LookPath(cfg.FFprobe)
+	if err != nil {
+		log.Println("ffprobeが見つからないため動画投稿を無効にします:", err)
+		return nil
+	}
+	return &videoProcessor{ffmpeg: ffmpeg, ffprobe: ffprobe, jobs: make(chan int, videoQueueSize)}
+}
+
+// 動画の寸法と長さを取得する
+func (p *videoProcessor) probe(ctx context.Context, file, demuxer string) (*videoInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, videoProbeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, p.ffprobe, "-v", "error", "-protocol_whitelist", "file", "-f", demuxer,
+		"-select_streams", "v:0", "-show_entries", "stream=width,height:format=duration", "-of", "json", file).Output()
+	if err != nil {
+		return nil, errVideoInvalid
+	}
+
+	var result struct {
+		Streams []struct {
+			Width  int `json:"width"`
+			Height int `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil || len(result.Streams) == 0 {
+		return nil, errVideoInvalid
+	}
+	info := &videoInfo{width: result.Streams[0].Width, height: result.Streams[0].Height}
+	info.duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+	if info.width <= 0 || info.height <= 0 {
+		return nil, errVideoInvalid
+	}
+	return info, nil
+}
+
+func (p *videoProcessor) run(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, p.ffmpeg, append([]string{"-nostdin", "-v", "error", "-y"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// 添付ファイルを動画として扱うかを判定する（動画でなければ空文字）
+func (app *App) videoKind(header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	contentType := http.DetectContentType(head[:n])
+	if _, ok := allowedVideoTypes[contentType]; ok {
+		if app.video == nil {
+			return "", errVideoUnavailable
+		}
+		return mediaTypeVideo, nil
+	}
+
+	// アニメーションGIFは動画に変換する（ffmpegがない場合は画像として保存）
+	if contentType == "image/gif" && app.video != nil && header.Size <= maxPostImageSize {
+		data, err := io.ReadAll(io.MultiReader(bytes.NewReader(head[:n]), io.LimitReader(file, maxPostImageSize)))
+		if err == nil && gifFrameCount(data) > 1 {
+			return mediaTypeGIF, nil
+		}
+	}
+	return "", nil
+}
+
+// 動画を検証し、変換前のファイルを保存する（変換はバックグラウンドで行う）
+func (app *App) saveVideo(ctx context.Context, header *multipart.FileHeader, kind string) (*savedVideo, error) {
+	maxSize, errTooLarge := int64(maxVideoSize), errVideoTooLarge
+	if kind == mediaTypeGIF {
+		maxSize, errTooLarge = maxPostImageSize, errUploadTooLarge
+	}
+	if header.Size > maxSize {
+		return nil, errTooLarge
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tmp, err := os.CreateTemp("", "gosns-video-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, io.LimitReader(file, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSize {
+		return nil, errTooLarge
+	}
+
+	// 送信されたファイル名やContent-Typeは信用せず、内容から形式を判定する
+	head := make([]byte, 512)
+	n, _ := tmp.ReadAt(head, 0)
+	ext := ".gif"
+	if kind == mediaTypeVideo {
+		var ok bool
+		if ext, ok = allowedVideoTypes[http.DetectContentType(head[:n])]; !ok {
+			return nil, errUploadType
+		}
+	}
+
+	info, err := app.video.probe(ctx, tmp.Name(), videoDemuxers[ext])
+	if err != nil {
+		return nil, err
+	}
+	if info.width > maxVideoDimension || info.height > maxVideoDimension {
+		return nil, errTooLarge
+	}
+	if info.duration > maxVideoDuration.Seconds() {
+		return nil, errVideoTooLong
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	key := uuid.New().String() + "_source" + ext
+	if err := app.media.Put(ctx, key, tmp, size, mediaContentType(key)); err != nil {
+		return nil, err
+	}
+	return &savedVideo{kind: kind, ref: mediaRefPrefix + key, info: info}, nil
+}
+
+// 変換ワーカーを起動し、処理中のまま残っているジョブを再開する
+func (app *App) startVideoWorker() {
+	if app.video == nil {
+		return
+	}
+	go func() {
+		for id := range app.video.jobs {
+			app.processVideo(id)
+		}
+	}()
+
+	rows, err := app.db.Query("SELECT id FROM post_media WHERE status = ? ORDER BY id", mediaStatusProcessing)
+	if err != nil {
+		log.Println("動画変換ジョブの再開エラー:", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			app.enqueueVideo(id)
+		}
+	}
+}
+
+func (app *App) enqueueVideo(mediaID int) {
+	select {
+	case app.video.jobs <- mediaID:
+	default:
+		// キューが一杯の場合はリクエストを待たせずに順番待ちする
+		go func() { app.video.jobs <- mediaID }()
+	}
+}
+
+// 変換済みの動画とポスター画像
+type transcodedVideo struct {
+	ref    string
+	poster *savedImage
+	info   *videoInfo
+}
+
+// 動画変換ジョブ
+func (app *App) processVideo(mediaID int) {
+	ctx, cancel := context.WithTimeout(context.Background(), videoJobTimeout)
+	defer cancel()
+
+	var kind, source string
+	err := app.db.QueryRow("SELECT type, url FROM post_media WHERE id = ? AND status = ?", mediaID, mediaStatusProcessing).
+		Scan(&kind, &source)
+	if err != nil {
+		return
+	}
+
+	result, err := app.transcodeVideo(ctx, kind, source)
+	if err != nil {
+		log.Println("動画変換エラー:", mediaID, err)
+		app.db.Exec("UPDATE post_media SET status = ?, url = '' WHERE id = ? AND status = ?",
+			mediaStatusFailed, mediaID, mediaStatusProcessing)
+		app.deleteMedia(ctx, source)
+		return
+	}
+
+	res, err := app.db.Exec(`UPDATE post_media SET url = ?, poster_url = ?, thumb_url = ?, width = ?, height = ?, duration = ?, blurhash = ?, status = ?
+		WHERE id = ? AND status = ?`,
+		result.ref, result.poster.refs["poster"], result.poster.refs["thumb"], result.info.width, result.info.height,
+		result.info.duration, result.poster.blurhash, mediaStatusReady, mediaID, mediaStatusProcessing)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	if err != nil {
+		// 変換中に投稿が削除された場合など
+		app.deleteMedia(ctx, result.ref)
+		app.deleteSavedImages(ctx, result.poster)
+	}
+	app.deleteMedia(ctx, source)
+}
+
+// 元ファイルをブラウザで再生できるMP4（H.264/AAC）とポスター画像に変換する
+func (app *App) transcodeVideo(ctx context.Context, kind, source string) (*transcodedVideo, error) {
+	key, _ := strings.CutPrefix(source, mediaRefPrefix)
+	demuxer, ok := videoDemuxers[path.Ext(key)]
+	if !ok {
+		return nil, errVideoInvalid
+	}
+
+	dir, err := os.MkdirTemp("", "gosns-video-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "source"+path.Ext(key))
+	if err := app.downloadMedia(ctx, key, src); err != nil {
+		return nil, err
+	}
+
+	// 長辺を videoOutputSize に収め、メタデータ（位置情報など）は引き継がない
+	out := filepath.Join(dir, "video.mp4")
+	args := []string{"-protocol_whitelist", "file", "-f", demuxer, "-i", src,
+		"-map", "0:v:0", "-map_metadata", "-1",
+		"-vf", fmt.Sprintf("scale=w='min(%d,iw)':h='min(%d,ih)':force_original_aspect_ratio=decrease:force_divisible_by=2", videoOutputSize, videoOutputSize),
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-t", strconv.Itoa(int(maxVideoDuration.Seconds())), "-movflags", "+faststart"}
+	if kind == mediaTypeGIF {
+		args = append(args, "-an")
+	} else {
+		args = append(args, "-map", "0:a:0?", "-c:a", "aac", "-b:a", "128k")
+	}
+	if err := app.video.run(ctx, append(args, out)...); err != nil {
+		return nil, err
+	}
+	info, err := app.video.probe(ctx, out, "mov")
+	if err != nil {
+		return nil, err
+	}
+
+	poster := filepath.Join(dir, "poster.png")
+	if err := app.video.run(ctx, "-f", "mov", "-i", out, "-frames:v", "1", "-f", "image2", poster); err != nil {
+		return nil, err
+	}
+	posterData, err := os.ReadFile(poster)
+	if err != nil {
+		return nil, err
+	}
+	processed, err := processImage(posterData, posterImageVariants)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	videoKey := uuid.New().String() + "_video.mp4"
+	if err := app.media.Put(ctx, videoKey, f, stat.Size(), mediaContentType(videoKey)); err != nil {
+		return nil, err
+	}
+	saved, err := app.storeImage(ctx, processed)
+	if err != nil {
+		app.deleteMedia(ctx, mediaRefPrefix+videoKey)
+		return nil, err
+	}
+	return &transcodedVideo{ref: mediaRefPrefix + videoKey, poster: saved, info: info}, nil
+}
+
+// 保存先のメディアをローカルの一時ファイルに取り出す
+func (app *App) downloadMedia(ctx context.Context, key, dest string) error {
+	body, err := app.media.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	webauthnChallengeTTL    = 5 * time.Minute
+	webauthnSessionCookie   = "webauthn_session"
+	webauthnFlagUserPresent = 0x01
+	webauthnFlagAttested    = 0x40
+	webauthnFlagExtensions  = 0x80
+)
+
+// COSEアルゴリズム識別子
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// セレモニー中のチャレンジ（サーバー側で保持し一度だけ使用）
+type webauthnChallenge struct {
+	Challenge []byte
+	UserID    int
+	Type      string
+	Expires   time.Time
+}
+
+type challengeStore struct {
+	mu    sync.Mutex
+	items map[string]webauthnChallenge
+}
+
+func newChallengeStore() *challengeStore {
+	return &challengeStore{items: make(map[string]webauthnChallenge)}
+}
+
+func (s *challengeStore) put(c webauthnChallenge) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 期限切れを掃除
+	now := time.Now()
+	for k, v := range s.items {
+		if now.After(v.Expires) {
+			delete(s.items, k)
+		}
+	}
+
+	key := randomToken(24)
+	s.items[key] = c
+	return key
+}
+
+func (s *challengeStore) take(key, typ string) (webauthnChallenge, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.items[key]
+	delete(s.items, key)
+	if !ok || c.Type != typ || time.Now().After(c.Expires) {
+		return webauthnChallenge{}, false
+	}
+	return c, true
+}
+
+// Relying Party 情報
+type relyingParty struct {
+	ID     string
+	Name   string
+	Origin string
+}
+
+func currentRelyingParty() relyingParty {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return relyingParty{Name: "GoSNS"}
+	}
+	return relyingParty{
+		ID:     u.Hostname(),
+		Name:   "GoSNS",
+		Origin: u.Scheme + "://" + u.Host,
+	}
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func (rp relyingParty) verifyClientData(raw []byte, typ string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return fmt.Errorf("invalid clientDataJSON: %w", err)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("unexpected client data type %q", cd.Type)
+	}
+	got, err := decodeBase64URL(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return errors.New("challenge mismatch")
+	}
+	if cd.Origin != rp.Origin {
+		return fmt.Errorf("unexpected origin %q", cd.Origin)
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	ad := &authenticatorData{
+		RPIDHash:  b[:32],
+		Flags:     b[32],
+		SignCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	rest := b[37:]
+
+	if ad.Flags&webauthnFlagAttested != 0 {
+		// AAGUID(16) + 認証情報ID長(2) + 認証情報ID + COSE公開鍵
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, errors.New("credential id truncated")
+		}
+		ad.CredentialID = rest[:idLen]
+		rest = rest[idLen:]
+
+		_, after, err := cborDecode(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		ad.PublicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+
+	if ad.Flags&webauthnFlagExtensions != 0 {
+		_, after, err := cborDecode(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extensions: %w", err)
+		}
+		rest = after
+	}
+
+	if len(rest) != 0 {
+		return nil, errors.New("trailing bytes in authenticator data")
+	}
+	return ad, nil
+}
+
+func (rp relyingParty) checkAuthenticatorData(ad *authenticatorData) error {
+	want := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.RPIDHash, want[:]) {
+		return errors.New("rp id hash mismatch")
+	}
+	if ad.Flags&webauthnFlagUserPresent == 0 {
+		return errors.New("user not present")
+	}
+	return nil
+}
+
+// 登録セレモニーの検証（attestation は "none" として扱う）
+func (rp relyingParty) verifyRegistration(clientDataJSON, attestationObject, challenge []byte) (*authenticatorData, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	obj, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("attestation object is not a map")
+	}
+	rawAuthData, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("missing authData")
+	}
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.checkAuthenticatorData(ad); err != nil {
+		return nil, err
+	}
+	if ad.CredentialID == nil {
+		return nil, errors.New("missing attested credential data")
+	}
+	if _, err := parseCOSEKey(ad.PublicKey); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// 認証セレモニーの検証。更新後の署名カウンタを返す
+func (rp relyingParty) verifyAssertion(clientDataJSON, rawAuthData, signature, challenge, coseKey []byte, storedCount uint32) (uint32, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.checkAuthenticatorData(ad); err != nil {
+		return 0, err
+	}
+
+	key, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return 0, err
+	}
+	clientHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), rawAuthData...), clientHash[:]...)
+	if err := verifyCOSESignature(key, signed, signature); err != nil {
+		return 0, err
+	}
+
+	// カウンタが進んでいない場合は複製された認証器の可能性
+	if (ad.SignCount != 0 || storedCount != 0) && ad.SignCount <= storedCount {
+		return 0, errors.New("sign count did not increase")
+	}
+	return ad.SignCount, nil
+}
+
+type coseKey struct {
+	Alg    int64
+	Public crypto.PublicKey
+}
+
+func parseCOSEKey(b []byte) (*coseKey, error) {
+	v, _, err := cborDecode(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid COSE key: %w", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("COSE key is not a map")
+	}
+
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("unsupported EC2 key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC2 point not on curve")
+		}
+		return &coseKey{Alg: alg, Public: pub}, nil
+	case kty == 1 && alg == coseAlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("unsupported OKP key")
+		}
+		return &coseKey{Alg: alg, Public: ed25519.PublicKey(x)}, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("unsupported RSA key")
+		}
+		exp := 0
+		for _, c := range e {
+			exp = exp<<8 | int(c)
+		}
+		return &coseKey{Alg: alg, Public: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported COSE key type %d / alg %d", kty, alg)
+	}
+}
+
+func verifyCOSESignature(key *coseKey, data, sig []byte) error {
+	switch pub := key.Public.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return errors.New("invalid signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, data, sig) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported public key")
+	}
+	return nil
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// ブラウザから送られる PublicKeyCredential
+type webauthnCredentialRequest struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+func (app *App) newWebAuthnChallenge(w http.ResponseWriter, userID int, typ string) []byte {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		panic(err)
+	}
+
+	key := app.challenges.put(webauthnChallenge{
+		Challenge: challenge,
+		UserID:    userID,
+		Type:      typ,
+		Expires:   time.Now().Add(webauthnChallengeTTL),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     webauthnSessionCookie,
+		Value:    key,
+		HttpOnly: true,
+		Secure:   false,
+		MaxAge:   int(webauthnChallengeTTL.Seconds()),
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return challenge
+}
+
+func (app *App) takeWebAuthnChallenge(w http.ResponseWriter, r *http.Request, typ string) (webauthnChallenge, bool) {
+	cookie, err := r.Cookie(webauthnSessionCookie)
+	if err != nil {
+		return webauthnChallenge{}, false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     webauthnSessionCookie,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return app.challenges.take(cookie.Value, typ)
+}
+
+// ユーザーの登録済みパスキー取得
+func (app *App) getUserCredentials(userID int) []Credential {
+	rows, err := app.db.Query(`SELECT id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at
+		FROM credentials WHERE user_id = ? ORDER BY created_at ASC`, userID)
+	if err != nil {
+		return []Credential{}
+	}
+	defer rows.Close()
+
+	var credentials []Credential
+	for rows.Next() {
+		var c Credential
+		err := rows.Scan(&c.ID, &c.UserID, &c.CredentialID, &c.PublicKey, &c.SignCount, &c.Name, &c.CreatedAt, &c.LastUsedAt)
+		if err != nil {
+			continue
+		}
+		credentials = append(credentials, c)
+	}
+	return credentials
+}
+
+// パスキー登録開始API
+func (app *App) beginPasskeyRegistrationAPI(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	username := r.Context().Value("username").(string)
+	rp := currentRelyingParty()
+
+	exclude := []map[string]string{}
+	for _, c := range app.getUserCredentials(userID) {
+		exclude = append(exclude, map[string]string{"type": "public-key", "id": c.CredentialID})
+	}
+
+	challenge := app.newWebAuthnChallenge(w, userID, "webauthn.create")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+			"rp":        map[string]string{"id": rp.ID, "name": rp.Name},
+			"user": map[string]string{
+				"id":          base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(userID))),
+				"name":        username,
+				"displayName": username,
+			},
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": coseAlgES256},
+				{"type": "public-key", "alg": coseAlgEdDSA},
+				{"type": "public-key", "alg": coseAlgRS256},
+			},
+			"excludeCredentials": exclude,
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+			"attestation": "none",
+			"timeout":     webauthnChallengeTTL.Milliseconds(),
+		},
+	})
+}
+
+// パスキー登録完了API
+func (app *App) finishPasskeyRegistrationAPI(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	challenge, ok := app.takeWebAuthnChallenge(w, r, "webauthn.create")
+	if !ok || challenge.UserID != userID {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Registration session expired",
+		})
+		return
+	}
+
+	var req webauthnCredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	clientDataJSON, err1 := decodeBase64URL(req.Response.ClientDataJSON)
+	attestationObject, err2 := decodeBase64URL(req.Response.AttestationObject)
+	if err1 != nil || err2 != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid credential encoding",
+		})
+		return
+	}
+
+	ad, err := currentRelyingParty().verifyRegistration(clientDataJSON, attestationObject, challenge.Challenge)
+	if err != nil {
+		log.Println("パスキー登録検証エラー:", err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Credential verification failed",
+		})
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "パスキー"
+	}
+
+	_, err = app.db.Exec("INSERT INTO credentials (user_id, credential_id, public_key, sign_count, name) VALUES (?, ?, ?, ?, ?)",
+		userID, base64.RawURLEncoding.EncodeToString(ad.CredentialID), ad.PublicKey, ad.SignCount, name)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Credential already registered",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Message: "Passkey registered successfully",
+	})
+}
+
+// パスキーログイン開始API
+func (app *App) beginPasskeyLoginAPI(w http.ResponseWriter, r *http.Request) {
+	rp := currentRelyingParty()
+	challenge := app.newWebAuthnChallenge(w, 0, "webauthn.get")
+
+	// allowCredentials を空にして端末に保存されたパスキーから選択させる
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"challenge":        base64.RawURLEncoding.EncodeToString(challenge),
+			"rpId":             rp.ID,
+			"allowCredentials": []interface{}{},
+			"userVerification": "preferred",
+			"timeout":          webauthnChallengeTTL.Milliseconds(),
+		},
+	})
+}
+
+// パスキーログイン完了API
+func (app *App) finishPasskeyLoginAPI(w http.ResponseWriter, r *http.Request) {
+	challenge, ok := app.takeWebAuthnChallenge(w, r, "webauthn.get")
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Login session expired",
+		})
+		return
+	}
+
+	var req webauthnCredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	var cred Credential
+	var username string
+	err := app.db.QueryRow(`SELECT c.id, c.user_id, c.public_key, c.sign_count, u.username
+		FROM credentials c JOIN users u ON c.user_id = u.id WHERE c.credential_id = ?`,
+		strings.TrimRight(req.ID, "=")).Scan(&cred.ID, &cred.UserID, &cred.PublicKey, &cred.SignCount, &username)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Unknown credential",
+		})
+		return
+	}
+
+	clientDataJSON, err1 := decodeBase64URL(req.Response.ClientDataJSON)
+	authData, err2 := decodeBase64URL(req.Response.AuthenticatorData)
+	signature, err3 := decodeBase64URL(req.Response.Signature)
+	userHandle, err4 := decodeBase64URL(req.Response.UserHandle)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Invalid credential encoding",
+		})
+		return
+	}
+	if len(userHandle) > 0 && string(userHandle) != strconv.Itoa(cred.UserID) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "User handle mismatch",
+		})
+		return
+	}
+
+	signCount, err := currentRelyingParty().verifyAssertion(clientDataJSON, authData, signature,
+		challenge.Challenge, cred.PublicKey, cred.SignCount)
+	if err != nil {
+		log.Println("パスキー認証検証エラー:", err)
+		app.recordLogin(r, cred.UserID, "", loginMethodPasskey, false)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Credential verification failed",
+		})
+		return
+	}
+
+	app.db.Exec("UPDATE credentials SET sign_count = ?, last_used_at = CURRENT_TIMESTAMP WHERE id = ?",
+		signCount, cred.ID)
+	app.recordLogin(r, cred.UserID, "", loginMethodPasskey, true)
+
+	if err := app.startSession(w, r, cred.UserID, username); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Message: "Failed to log in",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: true,
+		Message: "Logged in successfully",
+		Data:    map[string]string{"redirect": popLoginNext(w, r)},
+	})
+}
+
+// パスキー管理ページ
+func (app *App) passkeysHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+
+	app.renderTemplate(w, r, "passkeys", PageData{
+		Title:           "パスキー",
+		IsAuthenticated: true,
+		CurrentUserID:   userID,
+		Credentials:     app.getUserCredentials(userID),
+	})
+}
+
+// パスキー削除
+func (app *App) deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("user_id").(int)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err == nil {
+		app.db.Exec("DELETE FROM credentials WHERE id = ? AND user_id = ?", id, userID)
+	}
+	http.Redirect(w, r, "/settings/passkeys", http.StatusSeeOther)
+}
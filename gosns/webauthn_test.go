@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// テスト用の最小限のCBORエンコーダ（マップはキーの順序を保つ）
+type cborPair struct {
+	key, value interface{}
+}
+
+type cborMap []cborPair
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+}
+
+func cborEncode(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		return cborEncode(int64(v))
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []interface{}:
+		b := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			b = append(b, cborEncode(item)...)
+		}
+		return b
+	case cborMap:
+		b := cborHead(5, uint64(len(v)))
+		for _, p := range v {
+			b = append(b, cborEncode(p.key)...)
+			b = append(b, cborEncode(p.value)...)
+		}
+		return b
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	default:
+		panic("cborEncode: unsupported type")
+	}
+}
+
+// メモリ上で鍵を持つソフトウェア認証器
+type softAuthenticator struct {
+	rpID         string
+	origin       string
+	alg          int64
+	key          crypto.Signer
+	credentialID []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, alg int64) *softAuthenticator {
+	t.Helper()
+
+	rp := currentRelyingParty()
+	a := &softAuthenticator{rpID: rp.ID, origin: rp.Origin, alg: alg, credentialID: make([]byte, 16)}
+	rand.Read(a.credentialID)
+
+	var err error
+	switch alg {
+	case coseAlgES256:
+		a.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case coseAlgEdDSA:
+		_, a.key, err = ed25519.GenerateKey(rand.Reader)
+	case coseAlgRS256:
+		a.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	switch pub := a.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		return cborEncode(cborMap{{1, 2}, {3, coseAlgES256}, {-1, 1}, {-2, x}, {-3, y}})
+	case ed25519.PublicKey:
+		return cborEncode(cborMap{{1, 1}, {3, coseAlgEdDSA}, {-1, 6}, {-2, []byte(pub)}})
+	case *rsa.PublicKey:
+		e := big32(pub.E)
+		return cborEncode(cborMap{{1, 3}, {3, coseAlgRS256}, {-1, pub.N.Bytes()}, {-2, e}})
+	}
+	panic("unsupported key")
+}
+
+func big32(n int) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(n))
+	return bytes.TrimLeft(b, "\x00")
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	flags := byte(webauthnFlagUserPresent)
+	if attested {
+		flags |= webauthnFlagAttested
+	}
+	b := append(rpIDHash[:], flags)
+	b = binary.BigEndian.AppendUint32(b, a.signCount)
+	if attested {
+		b = append(b, make([]byte, 16)...) // AAGUID
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.credentialID)))
+		b = append(b, a.credentialID...)
+		b = append(b, a.coseKey()...)
+	}
+	return b
+}
+
+func (a *softAuthenticator) clientData(typ string, challenge []byte) []byte {
+	b, _ := json.Marshal(clientData{
+		Type:      typ,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    a.origin,
+	})
+	return b
+}
+
+// navigator.credentials.create() に相当
+func (a *softAuthenticator) create(challenge []byte) (clientDataJSON, attestationObject []byte) {
+	obj := cborMap{{"fmt", "none"}, {"attStmt", cborMap{}}, {"authData", a.authData(true)}}
+	return a.clientData("webauthn.create", challenge), cborEncode(obj)
+}
+
+// navigator.credentials.get() に相当
+func (a *softAuthenticator) get(t *testing.T, challenge []byte) (clientDataJSON, authData, signature []byte) {
+	t.Helper()
+
+	a.signCount++
+	clientDataJSON = a.clientData("webauthn.get", challenge)
+	authData = a.authData(false)
+	clientHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), clientHash[:]...)
+
+	var err error
+	switch key := a.key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, signed)
+	default:
+		digest := sha256.Sum256(signed)
+		signature, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientDataJSON, authData, signature
+}
+
+func newChallenge() []byte {
+	c := make([]byte, 32)
+	rand.Read(c)
+	return c
+}
+
+var webauthnAlgs = []struct {
+	name string
+	alg  int64
+}{
+	{"ES256", coseAlgES256},
+	{"EdDSA", coseAlgEdDSA},
+	{"RS256", coseAlgRS256},
+}
+
+func TestWebAuthnRegistrationAndAssertion(t *testing.T) {
+	newTestApp(t)
+	rp := currentRelyingParty()
+
+	for _, tc := range webauthnAlgs {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newSoftAuthenticator(t, tc.alg)
+
+			challenge := newChallenge()
+			clientDataJSON, attObj := a.create(challenge)
+			ad, err := rp.verifyRegistration(clientDataJSON, attObj, challenge)
+			if err != nil {
+				t.Fatalf("registration: %v", err)
+			}
+			if !bytes.Equal(ad.CredentialID, a.credentialID) {
+				t.Fatalf("credential id = %x, want %x", ad.CredentialID, a.credentialID)
+			}
+			key, err := parseCOSEKey(ad.PublicKey)
+			if err != nil || key.Alg != tc.alg {
+				t.Fatalf("parsed key alg %v err %v", key, err)
+			}
+
+			stored := ad.SignCount
+			for i := 0; i < 2; i++ {
+				challenge = newChallenge()
+				clientDataJSON, authData, sig := a.get(t, challenge)
+				count, err := rp.verifyAssertion(clientDataJSON, authData, sig, challenge, ad.PublicKey, stored)
+				if err != nil {
+					t.Fatalf("assertion %d: %v", i+1, err)
+				}
+				if count != a.signCount {
+					t.Fatalf("sign count = %d, want %d", count, a.signCount)
+				}
+				stored = count
+			}
+		})
+	}
+}
+
+func TestWebAuthnRejectsBadSignature(t *testing.T) {
+	newTestApp(t)
+	rp := currentRelyingParty()
+
+	for _, tc := range webauthnAlgs {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newSoftAuthenticator(t, tc.alg)
+			challenge := newChallenge()
+			clientDataJSON, authData, sig := a.get(t, challenge)
+			sig[len(sig)-1] ^= 0x01
+
+			if _, err := rp.verifyAssertion(clientDataJSON, authData, sig, challenge, a.coseKey(), 0); err == nil {
+				t.Fatal("tampered signature accepted")
+			}
+
+			// 別の鍵で署名されたアサーション
+			other := newSoftAuthenticator(t, tc.alg)
+			clientDataJSON, authData, sig = other.get(t, challenge)
+			if _, err := rp.verifyAssertion(clientDataJSON, authData, sig, challenge, a.coseKey(), 0); err == nil {
+				t.Fatal("signature from another key accepted")
+			}
+		})
+	}
+}
+
+func TestWebAuthnRejectsWrongRelyingParty(t *testing.T) {
+	newTestApp(t)
+	rp := currentRelyingParty()
+
+	t.Run("origin", func(t *testing.T) {
+		a := newSoftAuthenticator(t, coseAlgES256)
+		a.origin = "https://evil.example"
+		challenge := newChallenge()
+
+		clientDataJSON, attObj := a.create(challenge)
+		if _, err := rp.verifyRegistration(clientDataJSON, attObj, challenge); err == nil {
+			t.Fatal("registration from another origin accepted")
+		}
+		clientDataJSON, authData, sig := a.get(t, challenge)
+		if _, err := rp.verifyAssertion(clientDataJSON, authData, sig, challenge, a.coseKey(), 0); err == nil {
+			t.Fatal("assertion from another origin accepted")
+		}
+	})
+
+	t.Run("rpIdHash", func(t *testing.T) {
+		a := newSoftAuthenticator(t, coseAlgES256)
+		a.rpID = "evil.example"
+		challenge := newChallenge()
+
+		clientDataJSON, attObj := a.create(challenge)
+		if _, err := rp.verifyRegistration(clientDataJSON, attObj, challenge); err == nil {
+			t.Fatal("registration for another rp id accepted")
+		}
+		clientDataJSON, authData, sig := a.get(t, challenge)
+		if _, err := rp.verifyAssertion(clientDataJSON, authData, sig, challenge, a.coseKey(), 0); err == nil {
+			t.Fatal("assertion for another rp id accepted")
+		}
+	})
+
+	t.Run("challenge", func(t *testing.T) {
+		a := newSoftAuthenticator(t, coseAlgES256)
+		clientDataJSON, authData, sig := a.get(t, newChallenge())
+		if _, err := rp.verifyAssertion(clientDataJSON, authData, sig, newChallenge(), a.coseKey(), 0); err == nil {
+			t.Fatal("assertion for another challenge accepted")
+		}
+	})
+
+	t.Run("type", func(t *testing.T) {
+		a := newSoftAuthenticator(t, coseAlgES256)
+		challenge := newChallenge()
+		_, authData, sig := a.get(t, challenge)
+		if _, err := rp.verifyAssertion(a.clientData("webauthn.create", challenge), authData, sig, challenge, a.coseKey(), 0); err == nil {
+			t.Fatal("create client data accepted for assertion")
+		}
+	})
+}
+
+func TestWebAuthnSignCountRollback(t *testing.T) {
+	newTestApp(t)
+	rp := currentRelyingParty()
+	a := newSoftAuthenticator(t, coseAlgES256)
+
+	tests := []struct {
+		name          string
+		stored, count uint32
+		ok            bool
+	}{
+		{"increase", 5, 6, true},
+		{"equal", 5, 5, false},
+		{"rollback", 5, 3, false},
+		{"counter unsupported", 0, 0, true},
+		{"reset to zero", 5, 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a.signCount = tc.count - 1 // get() で1つ進める（0 はラップして 0 に戻る）
+			challenge := newChallenge()
+			clientDataJSON, authData, sig := a.get(t, challenge)
+			_, err := rp.verifyAssertion(clientDataJSON, authData, sig, challenge, a.coseKey(), tc.stored)
+			if (err == nil) != tc.ok {
+				t.Fatalf("stored %d, count %d: err = %v, want ok %v", tc.stored, tc.count, err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestCBORDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want interface{}
+	}{
+		{"small int", []byte{0x17}, int64(23)},
+		{"uint8", []byte{0x18, 0xff}, int64(255)},
+		{"uint16", []byte{0x19, 0x01, 0x00}, int64(256)},
+		{"uint32", []byte{0x1a, 0x00, 0x01, 0x00, 0x00}, int64(65536)},
+		{"uint64", []byte{0x1b, 0, 0, 0, 1, 0, 0, 0, 0}, int64(1 << 32)},
+		{"negative", []byte{0x20}, int64(-1)},
+		{"negative uint16", []byte{0x39, 0x01, 0x00}, int64(-257)},
+		{"bytes", []byte{0x42, 0x01, 0x02}, []byte{0x01, 0x02}},
+		{"string", []byte{0x63, 'f', 'm', 't'}, "fmt"},
+		{"array", []byte{0x82, 0x01, 0x20}, []interface{}{int64(1), int64(-1)}},
+		{"map", []byte{0xa2, 0x01, 0x02, 0x61, 'a', 0xf5}, map[interface{}]interface{}{int64(1): int64(2), "a": true}},
+		{"false", []byte{0xf4}, false},
+		{"null", []byte{0xf6}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, rest, err := cborDecode(append(tc.in, 0xff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %#v, want %#v", got, tc.want)
+			}
+			if !bytes.Equal(rest, []byte{0xff}) {
+				t.Fatalf("rest = %x, want ff", rest)
+			}
+		})
+	}
+}
+
+func TestCBORDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"truncated length", []byte{0x19, 0x01}},
+		{"truncated bytes", []byte{0x43, 0x01, 0x02}},
+		{"truncated array", []byte{0x83, 0x01}},
+		{"huge array", []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"huge map", []byte{0xba, 0xff, 0xff, 0xff, 0xff}},
+		{"overflow", []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"indefinite length", []byte{0x5f}},
+		{"tag", []byte{0xc0, 0x01}},
+		{"float", []byte{0xf9, 0x00, 0x00}},
+		{"array map key", []byte{0xa1, 0x80, 0x01}},
+		{"too deep", bytes.Repeat([]byte{0x81}, cborMaxDepth+2)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := cborDecode(tc.in); err == nil {
+				t.Fatalf("decode %x succeeded", tc.in)
+			}
+		})
+	}
+}
+
+func TestParseCOSEKeyRejectsInvalidKeys(t *testing.T) {
+	offCurve := make([]byte, 32)
+	offCurve[31] = 1
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  cborMap
+	}{
+		{"point not on curve", cborMap{{1, 2}, {3, coseAlgES256}, {-1, 1}, {-2, offCurve}, {-3, offCurve}}},
+		{"wrong curve", cborMap{{1, 2}, {3, coseAlgES256}, {-1, 2}, {-2, offCurve}, {-3, offCurve}}},
+		{"short ed25519 key", cborMap{{1, 1}, {3, coseAlgEdDSA}, {-1, 6}, {-2, []byte{1, 2, 3}}}},
+		{"short rsa modulus", cborMap{{1, 3}, {3, coseAlgRS256}, {-1, rsaKey.N.Bytes()}, {-2, big32(rsaKey.E)}}},
+		{"unsupported alg", cborMap{{1, 2}, {3, -35}}},
+		{"missing kty", cborMap{{3, coseAlgES256}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseCOSEKey(cborEncode(tc.key)); err == nil {
+				t.Fatal("invalid key accepted")
+			}
+		})
+	}
+	if _, err := parseCOSEKey(cborEncode([]interface{}{1})); err == nil {
+		t.Fatal("non-map COSE key accepted")
+	}
+}
+
+// 登録からログインまでAPIを通して確認する
+func TestPasskeyRegistrationAndLoginAPI(t *testing.T) {
+	app, _ := newTestApp(t)
+	userID := createTestUser(t, app, "alice", true)
+	a := newSoftAuthenticator(t, coseAlgES256)
+
+	type beginResponse struct {
+		Data struct {
+			Challenge string `json:"challenge"`
+		} `json:"data"`
+	}
+	// begin API を呼んでチャレンジとセッションCookieを受け取る
+	begin := func(h http.HandlerFunc, r *http.Request) ([]byte, *http.Cookie) {
+		w := httptest.NewRecorder()
+		h(w, r)
+		var resp beginResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		challenge, err := decodeBase64URL(resp.Data.Challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == webauthnSessionCookie {
+				return challenge, c
+			}
+		}
+		t.Fatal("webauthn session cookie not set")
+		return nil, nil
+	}
+	finish := func(h http.HandlerFunc, r *http.Request, cookie *http.Cookie, body interface{}) (APIResponse, *httptest.ResponseRecorder) {
+		b, _ := json.Marshal(body)
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		h(w, r)
+		var resp APIResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp, w
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+
+	challenge, cookie := begin(app.beginPasskeyRegistrationAPI,
+		withUser(httptest.NewRequest("POST", "/webauthn/register/begin", nil), userID))
+	clientDataJSON, attObj := a.create(challenge)
+	reg := map[string]interface{}{
+		"id":   enc(a.credentialID),
+		"type": "public-key",
+		"name": "テスト",
+		"response": map[string]string{
+			"clientDataJSON":    enc(clientDataJSON),
+			"attestationObject": enc(attObj),
+		},
+	}
+	resp, _ := finish(app.finishPasskeyRegistrationAPI,
+		withUser(httptest.NewRequest("POST", "/webauthn/register/finish", nil), userID), cookie, reg)
+	if !resp.Success {
+		t.Fatalf("registration failed: %s", resp.Message)
+	}
+
+	// 使用済みのチャレンジは再利用できない
+	resp, _ = finish(app.finishPasskeyRegistrationAPI,
+		withUser(httptest.NewRequest("POST", "/webauthn/register/finish", nil), userID), cookie, reg)
+	if resp.Success {
+		t.Fatal("registration challenge reused")
+	}
+
+	login := func() (APIResponse, *httptest.ResponseRecorder) {
+		challenge, cookie := begin(app.beginPasskeyLoginAPI, httptest.NewRequest("POST", "/webauthn/login/begin", nil))
+		clientDataJSON, authData, sig := a.get(t, challenge)
+		return finish(app.finishPasskeyLoginAPI, httptest.NewRequest("POST", "/webauthn/login/finish", nil), cookie,
+			map[string]interface{}{
+				"id":   enc(a.credentialID),
+				"type": "public-key",
+				"response": map[string]string{
+					"clientDataJSON":    enc(clientDataJSON),
+					"authenticatorData": enc(authData),
+					"signature":         enc(sig),
+					"userHandle":        enc([]byte(strconv.Itoa(userID))),
+				},
+			})
+	}
+
+	resp, w := login()
+	if !resp.Success {
+		t.Fatalf("login failed: %s", resp.Message)
+	}
+	if len(w.Result().Cookies()) == 0 {
+		t.Fatal("no session cookies set after login")
+	}
+	var stored uint32
+	app.db.QueryRow("SELECT sign_count FROM credentials WHERE user_id = ?", userID).Scan(&stored)
+	if stored != a.signCount {
+		t.Fatalf("stored sign count = %d, want %d", stored, a.signCount)
+	}
+
+	// 複製された認証器（カウンタが巻き戻る）は拒否する
+	a.signCount = 0
+	if resp, _ := login(); resp.Success {
+		t.Fatal("login with rolled back sign count succeeded")
+	}
+}